@@ -0,0 +1,435 @@
+package aof
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/rdb"
+	"github.com/codecrafters-io/redis-starter-go/app/resp"
+)
+
+const (
+	FsyncAlways   = "always"
+	FsyncEverySec = "everysec"
+	FsyncNo       = "no"
+)
+
+type Config struct {
+	// Dir is the directory holding the legacy single file AOF.
+	Dir string
+	// DirName is the directory inside Dir with the base, incr files and manifest.
+	DirName           string
+	FileName          string
+	Fsync             string
+	LoadTruncated     bool
+	UseRdbPreamble    bool
+	RewritePercentage int
+	RewriteMinSize    int64
+}
+
+// AppendOnlyFile is a multi part AOF: a base file holding the dataset at the
+// time of the last rewrite and incremental files with the commands executed
+// since then, all of them listed in the manifest.
+type AppendOnlyFile struct {
+	config    Config
+	manifest  manifest
+	file      *os.File
+	size      int64
+	baseSize  int64
+	rewriting bool
+	// generation changes whenever the dataset is replaced, a rewrite of an
+	// older generation is discarded.
+	generation int
+	mutex      sync.Mutex
+	dirty      bool
+	done       chan struct{}
+}
+
+func Open(config Config) (*AppendOnlyFile, error) {
+	switch config.Fsync {
+	case FsyncAlways, FsyncEverySec, FsyncNo:
+	default:
+		return nil, fmt.Errorf("unknown appendfsync policy: %v", config.Fsync)
+	}
+	a := &AppendOnlyFile{
+		config: config,
+		done:   make(chan struct{}),
+	}
+	err := os.MkdirAll(a.dir(), 0755)
+	if err != nil {
+		return nil, err
+	}
+	a.manifest, err = readManifest(a.manifestPath())
+	if errors.Is(err, os.ErrNotExist) {
+		err = a.upgradeLegacyFile()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// upgradeLegacyFile moves a single file AOF written before the multi part
+// layout into the AOF directory and uses it as the base file.
+func (a *AppendOnlyFile) upgradeLegacyFile() error {
+	legacyPath := filepath.Join(a.config.Dir, a.config.FileName)
+	_, err := os.Stat(legacyPath)
+	if err == nil {
+		err = os.Rename(legacyPath, filepath.Join(a.dir(), a.config.FileName))
+		if err != nil {
+			return err
+		}
+		a.manifest.base = &manifestFile{name: a.config.FileName, seq: 1, kind: baseFileKind}
+		fmt.Printf("append only file %v upgraded to multi part layout\n", legacyPath)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return a.manifest.write(a.manifestPath())
+}
+
+// Load replays the base file and every incremental file. Only the last file
+// may be cut in the middle of a command by a crash: when loadTruncated is set
+// the incomplete command is removed, any other malformed content stops the
+// load with an error.
+func (a *AppendOnlyFile) Load(strategy rdb.ReadStrategy, apply func(resp.RespDataType)) error {
+	files := a.manifest.files()
+	for i, file := range files {
+		last := i == len(files)-1
+		size, err := a.loadFile(file, last && a.config.LoadTruncated, strategy, apply)
+		if err != nil {
+			return fmt.Errorf("%s: %w", file.name, err)
+		}
+		a.size += size
+	}
+	a.baseSize = a.size
+	return nil
+}
+
+func (a *AppendOnlyFile) loadFile(file manifestFile, loadTruncated bool, strategy rdb.ReadStrategy, apply func(resp.RespDataType)) (int64, error) {
+	path := filepath.Join(a.dir(), file.name)
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) && file.kind == incrFileKind {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	reader := bufio.NewReader(f)
+	var preambleSize int64
+	prefix, _ := reader.Peek(5)
+	if string(prefix) == "REDIS" {
+		err = rdb.Read(reader, strategy, true)
+		if err != nil {
+			return 0, err
+		}
+		position, err := f.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return 0, err
+		}
+		preambleSize = position - int64(reader.Buffered())
+	}
+	respReader := resp.NewReader(reader)
+	var commands int
+	for {
+		offset := preambleSize + int64(respReader.BytesRead)
+		request, err := resp.Parse(respReader)
+		if err == io.EOF && preambleSize+int64(respReader.BytesRead) == offset {
+			fmt.Printf("append only file %v loaded: %d commands\n", file.name, commands)
+			return offset, nil
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			if !loadTruncated {
+				return 0, fmt.Errorf("append only file is truncated at offset %d, start with aof-load-truncated yes to repair it", offset)
+			}
+			fmt.Printf("append only file is truncated at offset %d, removing the incomplete command\n", offset)
+			return offset, os.Truncate(path, offset)
+		}
+		if err != nil {
+			return 0, fmt.Errorf("bad append only file format at offset %d: %w", offset, err)
+		}
+		apply(request)
+		commands += 1
+	}
+}
+
+// StartAppending opens the last incremental file, creating a new one when the
+// manifest doesn't list any, and starts the fsync policy.
+func (a *AppendOnlyFile) StartAppending() error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	var err error
+	if len(a.manifest.incrs) == 0 {
+		err = a.openNewIncrFile()
+	} else {
+		a.file, err = os.OpenFile(a.path(a.manifest.incrs[len(a.manifest.incrs)-1]), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	}
+	if err != nil {
+		return err
+	}
+	if a.config.Fsync == FsyncEverySec {
+		go a.syncEverySecond()
+	}
+	return nil
+}
+
+// Append writes the command in RESP form. With the always policy the file
+// is synced before returning, so the command is durable once replied to.
+func (a *AppendOnlyFile) Append(request resp.RespDataType) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	bytes := request.Bytes()
+	_, err := a.file.Write(bytes)
+	if err != nil {
+		return err
+	}
+	a.size += int64(len(bytes))
+	switch a.config.Fsync {
+	case FsyncAlways:
+		return a.file.Sync()
+	case FsyncEverySec:
+		a.dirty = true
+	}
+	return nil
+}
+
+// ShouldRewrite reports whether the files grew past auto-aof-rewrite-min-size
+// and by auto-aof-rewrite-percentage since the last rewrite.
+func (a *AppendOnlyFile) ShouldRewrite() bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.rewriting || a.config.RewritePercentage <= 0 || a.size < a.config.RewriteMinSize {
+		return false
+	}
+	base := max(a.baseSize, 1)
+	return (a.size-base)*100/base >= int64(a.config.RewritePercentage)
+}
+
+// Rewrite compacts the AOF into a new base file built from entries in the
+// background. Writes arriving during the rewrite are buffered in a fresh
+// incremental file opened before returning, so entries must be a point in
+// time snapshot taken under the same lock that orders calls to Append.
+func (a *AppendOnlyFile) Rewrite(entries []rdb.DbEntry) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.rewriting {
+		return fmt.Errorf("background append only file rewriting already in progress")
+	}
+	err := a.openNewIncrFile()
+	if err != nil {
+		return err
+	}
+	a.rewriting = true
+	generation := a.generation
+	preamble := a.usePreamble(entries)
+	go func() {
+		err := a.rewrite(entries, preamble, generation)
+		if err != nil {
+			fmt.Printf("background append only file rewrite failed: %v\n", err)
+			a.mutex.Lock()
+			a.rewriting = false
+			a.mutex.Unlock()
+		}
+	}()
+	return nil
+}
+
+// Replace makes entries the whole content of the AOF, when they replaced the
+// dataset it logged, e.g. after a full resynchronization with master. The
+// new base file is written before returning, so a restart never replays the
+// old dataset, and a rewrite in progress is discarded as it is based on it.
+// Like Rewrite, entries must be taken under the lock ordering Append.
+func (a *AppendOnlyFile) Replace(entries []rdb.DbEntry) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.generation += 1
+	err := a.openNewIncrFile()
+	if err != nil {
+		return err
+	}
+	preamble := a.usePreamble(entries)
+	tmp, size, err := a.writeBase(entries, preamble, a.generation)
+	if err != nil {
+		return err
+	}
+	return a.installBase(tmp, size, preamble)
+}
+
+// usePreamble reports whether the base file is written as RDB, which is also
+// the case without aof-use-rdb-preamble when commands can't recreate some
+// entry.
+func (a *AppendOnlyFile) usePreamble(entries []rdb.DbEntry) bool {
+	if a.config.UseRdbPreamble {
+		return true
+	}
+	if needsPreamble(entries) {
+		fmt.Println("append only file base written as RDB, some streams can't be rewritten as commands")
+		return true
+	}
+	return false
+}
+
+func (a *AppendOnlyFile) rewrite(entries []rdb.DbEntry, preamble bool, generation int) error {
+	tmp, size, err := a.writeBase(entries, preamble, generation)
+	if err != nil {
+		return err
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if generation != a.generation {
+		os.Remove(tmp)
+		a.rewriting = false
+		fmt.Println("background append only file rewrite discarded, the dataset was replaced")
+		return nil
+	}
+	err = a.installBase(tmp, size, preamble)
+	if err != nil {
+		return err
+	}
+	a.rewriting = false
+	fmt.Printf("background append only file rewrite finished: %v\n", a.manifest.base.name)
+	return nil
+}
+
+// writeBase writes entries to a temporary file and returns its path and
+// size.
+func (a *AppendOnlyFile) writeBase(entries []rdb.DbEntry, preamble bool, generation int) (string, int64, error) {
+	name := fmt.Sprintf("temp-rewriteaof-%d-%d.aof", os.Getpid(), generation)
+	tmp := filepath.Join(a.dir(), name)
+	file, err := os.Create(tmp)
+	if err != nil {
+		return "", 0, err
+	}
+	writer := bufio.NewWriter(file)
+	if preamble {
+		err = rdb.Write(writer, entries)
+	} else {
+		err = writeCommands(writer, entries)
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return "", 0, err
+	}
+	info, err := os.Stat(tmp)
+	if err != nil {
+		return "", 0, err
+	}
+	return tmp, info.Size(), nil
+}
+
+// installBase makes the temporary file the base file, the files it
+// replaces are removed. Caller must hold the mutex.
+func (a *AppendOnlyFile) installBase(tmp string, size int64, preamble bool) error {
+	base := a.manifest.nextBase(a.config.FileName, preamble)
+	err := os.Rename(tmp, a.path(base))
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	a.manifest.replaceBase(base)
+	err = a.manifest.write(a.manifestPath())
+	if err != nil {
+		return err
+	}
+	for _, file := range a.manifest.history {
+		os.Remove(a.path(file))
+	}
+	a.manifest.history = nil
+	err = a.manifest.write(a.manifestPath())
+	if err != nil {
+		return err
+	}
+	current, err := a.file.Stat()
+	if err != nil {
+		return err
+	}
+	a.baseSize = size + current.Size()
+	a.size = a.baseSize
+	return nil
+}
+
+// openNewIncrFile switches appends to a new incremental file. The manifest
+// is persisted first, so the new file is never lost after a crash.
+func (a *AppendOnlyFile) openNewIncrFile() error {
+	incr := a.manifest.nextIncr(a.config.FileName)
+	file, err := os.OpenFile(a.path(incr), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	a.manifest.incrs = append(a.manifest.incrs, incr)
+	err = a.manifest.write(a.manifestPath())
+	if err != nil {
+		a.manifest.incrs = a.manifest.incrs[:len(a.manifest.incrs)-1]
+		file.Close()
+		return err
+	}
+	if a.file != nil {
+		a.file.Sync()
+		a.file.Close()
+	}
+	a.file = file
+	a.dirty = false
+	return nil
+}
+
+func (a *AppendOnlyFile) Close() error {
+	close(a.done)
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	err := a.file.Sync()
+	if err != nil {
+		a.file.Close()
+		return err
+	}
+	return a.file.Close()
+}
+
+func (a *AppendOnlyFile) syncEverySecond() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-a.done:
+			return
+		case <-ticker.C:
+			a.mutex.Lock()
+			if a.dirty {
+				err := a.file.Sync()
+				if err != nil {
+					fmt.Printf("failed to fsync append only file: %v\n", err)
+				} else {
+					a.dirty = false
+				}
+			}
+			a.mutex.Unlock()
+		}
+	}
+}
+
+func (a *AppendOnlyFile) dir() string {
+	return filepath.Join(a.config.Dir, a.config.DirName)
+}
+
+func (a *AppendOnlyFile) manifestPath() string {
+	return filepath.Join(a.dir(), a.config.FileName+".manifest")
+}
+
+func (a *AppendOnlyFile) path(file manifestFile) string {
+	return filepath.Join(a.dir(), file.name)
+}
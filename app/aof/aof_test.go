@@ -0,0 +1,106 @@
+package aof
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/codecrafters-io/redis-starter-go/app/rdb"
+	"github.com/codecrafters-io/redis-starter-go/app/resp"
+)
+
+type noopStrategy struct{}
+
+func (noopStrategy) AddDbEntry(rdb.DbEntry) {}
+
+func (noopStrategy) AddAux(string, resp.RespDataType) {}
+
+func command(args ...string) resp.Array {
+	var array resp.Array
+	for _, arg := range args {
+		array.Content = append(array.Content, resp.BulkString(arg))
+	}
+	return array
+}
+
+func TestLoadTruncatedTail(t *testing.T) {
+	commands := []resp.RespDataType{
+		command("SET", "a", "1"),
+		command("SET", "b", "\r\n\x00"),
+	}
+	tests := []struct {
+		name          string
+		tail          string
+		loadTruncated bool
+		wantErr       bool
+	}{
+		{name: "complete", tail: ""},
+		{name: "cut in header", tail: "*3\r\n$3", loadTruncated: true},
+		{name: "cut in bulk", tail: "*3\r\n$3\r\nSET\r\n$1\r\nc\r\n$5\r\n12", loadTruncated: true},
+		{name: "cut without repair", tail: "*3\r\n$3\r\nSET", wantErr: true},
+		{name: "malformed", tail: "*3\r\n$x\r\n", loadTruncated: true, wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := Config{
+				Dir:           t.TempDir(),
+				DirName:       "appendonlydir",
+				FileName:      "appendonly.aof",
+				Fsync:         FsyncNo,
+				LoadTruncated: test.loadTruncated,
+			}
+			a, err := Open(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := a.StartAppending(); err != nil {
+				t.Fatal(err)
+			}
+			for _, command := range commands {
+				if err := a.Append(command); err != nil {
+					t.Fatal(err)
+				}
+			}
+			_, err = a.file.WriteString(test.tail)
+			if err != nil {
+				t.Fatal(err)
+			}
+			path := a.path(a.manifest.incrs[0])
+			if err := a.Close(); err != nil {
+				t.Fatal(err)
+			}
+			var complete int64
+			for _, command := range commands {
+				complete += int64(len(command.Bytes()))
+			}
+
+			a, err = Open(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var loaded []resp.RespDataType
+			err = a.Load(noopStrategy{}, func(request resp.RespDataType) {
+				loaded = append(loaded, request)
+			})
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("Load succeeded with tail %q", test.tail)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Load failed: %v", err)
+			}
+			if !reflect.DeepEqual(loaded, commands) {
+				t.Errorf("Load applied %#v, want %#v", loaded, commands)
+			}
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Size() != complete || a.size != complete {
+				t.Errorf("file size = %d, loaded size = %d, want %d", info.Size(), a.size, complete)
+			}
+		})
+	}
+}
@@ -0,0 +1,166 @@
+package aof
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	baseFileKind    = 'b'
+	historyFileKind = 'h'
+	incrFileKind    = 'i'
+)
+
+type manifestFile struct {
+	name string
+	seq  int
+	kind byte
+}
+
+// manifest uses the Redis 7 format, one file per line:
+//
+//	file appendonly.aof.1.base.rdb seq 1 type b
+//	file appendonly.aof.1.incr.aof seq 1 type i
+type manifest struct {
+	base    *manifestFile
+	incrs   []manifestFile
+	history []manifestFile
+}
+
+func readManifest(path string) (manifest, error) {
+	var m manifest
+	file, err := os.Open(path)
+	if err != nil {
+		return m, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields)%2 != 0 {
+			return m, fmt.Errorf("invalid manifest line %d: %q", line, text)
+		}
+		var f manifestFile
+		for i := 0; i < len(fields); i += 2 {
+			switch fields[i] {
+			case "file":
+				f.name = fields[i+1]
+			case "seq":
+				f.seq, err = strconv.Atoi(fields[i+1])
+				if err != nil {
+					return m, fmt.Errorf("invalid manifest line %d: %w", line, err)
+				}
+			case "type":
+				f.kind = fields[i+1][0]
+			}
+		}
+		if f.name == "" || f.name != filepath.Base(f.name) {
+			return m, fmt.Errorf("invalid file name in manifest line %d: %q", line, text)
+		}
+		switch f.kind {
+		case baseFileKind:
+			if m.base != nil {
+				return m, fmt.Errorf("manifest contains more than one base file")
+			}
+			m.base = &f
+		case incrFileKind:
+			m.incrs = append(m.incrs, f)
+		case historyFileKind:
+			m.history = append(m.history, f)
+		default:
+			return m, fmt.Errorf("unknown file type in manifest line %d: %q", line, text)
+		}
+	}
+	return m, scanner.Err()
+}
+
+// write persists the manifest atomically by renaming a synced temp file.
+func (m *manifest) write(path string) error {
+	var builder strings.Builder
+	for _, f := range m.all() {
+		fmt.Fprintf(&builder, "file %s seq %d type %c\n", f.name, f.seq, f.kind)
+	}
+	tmp := filepath.Join(filepath.Dir(path), "temp-"+filepath.Base(path))
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = file.WriteString(builder.String())
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// files returns the files to load in order: the base file, then incrs.
+func (m *manifest) files() []manifestFile {
+	var files []manifestFile
+	if m.base != nil {
+		files = append(files, *m.base)
+	}
+	return append(files, m.incrs...)
+}
+
+func (m *manifest) all() []manifestFile {
+	return append(m.files(), m.history...)
+}
+
+func (m *manifest) nextIncr(fileName string) manifestFile {
+	seq := 1
+	if len(m.incrs) > 0 {
+		seq = m.incrs[len(m.incrs)-1].seq + 1
+	}
+	return manifestFile{
+		name: fmt.Sprintf("%s.%d.incr.aof", fileName, seq),
+		seq:  seq,
+		kind: incrFileKind,
+	}
+}
+
+func (m *manifest) nextBase(fileName string, rdbPreamble bool) manifestFile {
+	seq := 1
+	if m.base != nil {
+		seq = m.base.seq + 1
+	}
+	extension := "aof"
+	if rdbPreamble {
+		extension = "rdb"
+	}
+	return manifestFile{
+		name: fmt.Sprintf("%s.%d.base.%s", fileName, seq, extension),
+		seq:  seq,
+		kind: baseFileKind,
+	}
+}
+
+// replaceBase turns the previous base and every incr file but the one
+// currently appended to into history files.
+func (m *manifest) replaceBase(base manifestFile) {
+	if m.base != nil {
+		old := *m.base
+		old.kind = historyFileKind
+		m.history = append(m.history, old)
+	}
+	for _, incr := range m.incrs[:len(m.incrs)-1] {
+		incr.kind = historyFileKind
+		m.history = append(m.history, incr)
+	}
+	m.incrs = m.incrs[len(m.incrs)-1:]
+	m.base = &base
+}
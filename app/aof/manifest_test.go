@@ -0,0 +1,116 @@
+package aof
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestManifestRoundTrip(t *testing.T) {
+	tests := []struct {
+		name     string
+		manifest manifest
+	}{
+		{"empty", manifest{}},
+		{
+			name:     "base only",
+			manifest: manifest{base: &manifestFile{name: "appendonly.aof.1.base.rdb", seq: 1, kind: baseFileKind}},
+		},
+		{
+			name: "base, incrs and history",
+			manifest: manifest{
+				base: &manifestFile{name: "appendonly.aof.2.base.aof", seq: 2, kind: baseFileKind},
+				incrs: []manifestFile{
+					{name: "appendonly.aof.3.incr.aof", seq: 3, kind: incrFileKind},
+					{name: "appendonly.aof.4.incr.aof", seq: 4, kind: incrFileKind},
+				},
+				history: []manifestFile{
+					{name: "appendonly.aof.1.base.rdb", seq: 1, kind: historyFileKind},
+				},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "appendonly.aof.manifest")
+			if err := test.manifest.write(path); err != nil {
+				t.Fatal(err)
+			}
+			got, err := readManifest(path)
+			if err != nil {
+				t.Fatalf("readManifest failed: %v", err)
+			}
+			if !reflect.DeepEqual(got, test.manifest) {
+				t.Errorf("readManifest() = %+v, want %+v", got, test.manifest)
+			}
+		})
+	}
+}
+
+func TestReadManifest(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    manifest
+		wantErr bool
+	}{
+		{
+			name:    "comments, blank lines and any key order",
+			content: "# written by redis\n\nseq 1 type b file appendonly.aof.1.base.rdb\n  file appendonly.aof.1.incr.aof seq 1 type i  \n",
+			want: manifest{
+				base:  &manifestFile{name: "appendonly.aof.1.base.rdb", seq: 1, kind: baseFileKind},
+				incrs: []manifestFile{{name: "appendonly.aof.1.incr.aof", seq: 1, kind: incrFileKind}},
+			},
+		},
+		{name: "odd number of fields", content: "file appendonly.aof.1.incr.aof seq\n", wantErr: true},
+		{name: "bad seq", content: "file appendonly.aof.1.incr.aof seq one type i\n", wantErr: true},
+		{name: "missing file", content: "seq 1 type i\n", wantErr: true},
+		{name: "path outside dir", content: "file ../appendonly.aof.1.incr.aof seq 1 type i\n", wantErr: true},
+		{name: "unknown type", content: "file appendonly.aof.1.incr.aof seq 1 type x\n", wantErr: true},
+		{
+			name:    "two base files",
+			content: "file a.1.base.rdb seq 1 type b\nfile a.2.base.rdb seq 2 type b\n",
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "appendonly.aof.manifest")
+			if err := os.WriteFile(path, []byte(test.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			got, err := readManifest(path)
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("readManifest(%q) succeeded", test.content)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("readManifest(%q) failed: %v", test.content, err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("readManifest(%q) = %+v, want %+v", test.content, got, test.want)
+			}
+		})
+	}
+}
+
+func TestManifestReplaceBase(t *testing.T) {
+	m := manifest{base: &manifestFile{name: "a.1.base.rdb", seq: 1, kind: baseFileKind}}
+	m.incrs = append(m.incrs, m.nextIncr("a"))
+	m.incrs = append(m.incrs, m.nextIncr("a"))
+	m.replaceBase(m.nextBase("a", false))
+	want := manifest{
+		base:  &manifestFile{name: "a.2.base.aof", seq: 2, kind: baseFileKind},
+		incrs: []manifestFile{{name: "a.2.incr.aof", seq: 2, kind: incrFileKind}},
+		history: []manifestFile{
+			{name: "a.1.base.rdb", seq: 1, kind: historyFileKind},
+			{name: "a.1.incr.aof", seq: 1, kind: historyFileKind},
+		},
+	}
+	if !reflect.DeepEqual(m, want) {
+		t.Errorf("replaceBase() = %+v, want %+v", m, want)
+	}
+}
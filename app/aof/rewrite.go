@@ -0,0 +1,109 @@
+package aof
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/codecrafters-io/redis-starter-go/app/rdb"
+	"github.com/codecrafters-io/redis-starter-go/app/resp"
+	"github.com/codecrafters-io/redis-starter-go/app/stream"
+)
+
+// RewriteCommands returns the commands recreating the entry. Expiration is
+// emitted as an absolute PXAT so replaying the commands later keeps it.
+// Streams without entries and consumer groups have no command to recreate
+// them yet, an error is returned for them.
+func RewriteCommands(entry rdb.DbEntry) ([]resp.Array, error) {
+	switch value := entry.Value.(type) {
+	case *stream.Stream:
+		err := checkStream(value)
+		if err != nil {
+			return nil, fmt.Errorf("can't rewrite stream %q as commands: %w", entry.Key, err)
+		}
+		return streamCommands(entry.Key, value), nil
+	case string:
+		return []resp.Array{setCommand(entry, value)}, nil
+	case resp.RespDataType:
+		return []resp.Array{setCommand(entry, resp.String(value))}, nil
+	default:
+		return nil, fmt.Errorf("unexpected db entry value type: %T", entry.Value)
+	}
+}
+
+// needsPreamble reports whether some entry can only be kept by the RDB
+// preamble.
+func needsPreamble(entries []rdb.DbEntry) bool {
+	for _, entry := range entries {
+		s, ok := entry.Value.(*stream.Stream)
+		if ok && checkStream(s) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func checkStream(s *stream.Stream) error {
+	if s.Metadata().Length == 0 {
+		return fmt.Errorf("the stream is empty")
+	}
+	if len(s.Groups()) > 0 {
+		return fmt.Errorf("the stream has consumer groups")
+	}
+	return nil
+}
+
+func setCommand(entry rdb.DbEntry, value string) resp.Array {
+	command := []resp.RespDataType{
+		resp.BulkString("SET"),
+		entry.Key,
+		resp.BulkString(value),
+	}
+	if !entry.ExpireAt.IsZero() {
+		command = append(command,
+			resp.BulkString("PXAT"),
+			resp.BulkString(strconv.FormatInt(entry.ExpireAt.UnixMilli(), 10)),
+		)
+	}
+	return resp.Array{Content: command}
+}
+
+func streamCommands(key resp.BulkString, s *stream.Stream) []resp.Array {
+	entries := s.Entries()
+	commands := make([]resp.Array, 0, len(entries)+1)
+	for _, entry := range entries {
+		command := make([]resp.RespDataType, 0, 3+len(entry.Payload)*2)
+		command = append(command, resp.BulkString("XADD"), key, resp.BulkString(entry.ID.String()))
+		for _, pair := range entry.Payload {
+			command = append(command, resp.BulkString(pair.Field), resp.BulkString(pair.Value))
+		}
+		commands = append(commands, resp.Array{Content: command})
+	}
+	metadata := s.Metadata()
+	commands = append(commands, resp.Array{Content: []resp.RespDataType{
+		resp.BulkString("XSETID"),
+		key,
+		resp.BulkString(metadata.LastID.String()),
+		resp.BulkString("ENTRIESADDED"),
+		resp.BulkString(strconv.FormatUint(metadata.EntriesAdded, 10)),
+		resp.BulkString("MAXDELETEDID"),
+		resp.BulkString(metadata.MaxDeletedID.String()),
+	}})
+	return commands
+}
+
+func writeCommands(writer io.Writer, entries []rdb.DbEntry) error {
+	for _, entry := range entries {
+		commands, err := RewriteCommands(entry)
+		if err != nil {
+			return err
+		}
+		for _, command := range commands {
+			_, err := writer.Write(command.Bytes())
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
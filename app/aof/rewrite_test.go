@@ -0,0 +1,203 @@
+package aof
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/rdb"
+	"github.com/codecrafters-io/redis-starter-go/app/resp"
+	"github.com/codecrafters-io/redis-starter-go/app/stream"
+)
+
+type collectStrategy struct {
+	entries []rdb.DbEntry
+}
+
+func (c *collectStrategy) AddDbEntry(entry rdb.DbEntry) {
+	c.entries = append(c.entries, entry)
+}
+
+func (c *collectStrategy) AddAux(string, resp.RespDataType) {}
+
+func testStream(groups []*stream.ConsumerGroup) *stream.Stream {
+	entries := []stream.Entry{
+		{ID: stream.NewID(1, 0), Payload: []stream.Pair{{Field: "f", Value: "v"}}},
+		{ID: stream.NewID(1, 1), Payload: []stream.Pair{{Field: "a", Value: "\x00\r\n"}, {Field: "b", Value: "2"}}},
+	}
+	metadata := stream.Metadata{
+		Length:       2,
+		LastID:       stream.NewID(5, 0),
+		MaxDeletedID: stream.NewID(3, 0),
+		EntriesAdded: 4,
+	}
+	return stream.Restore(entries, metadata, groups)
+}
+
+func TestRewriteCommands(t *testing.T) {
+	expireAt := time.UnixMilli(4102444800000)
+	tests := []struct {
+		name    string
+		entry   rdb.DbEntry
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:  "string",
+			entry: rdb.DbEntry{Key: "k", Value: resp.BulkString("v")},
+			want:  []string{"SET k v"},
+		},
+		{
+			name:  "expiring string",
+			entry: rdb.DbEntry{Key: "k", Value: "v", ExpireAt: expireAt},
+			want:  []string{"SET k v PXAT 4102444800000"},
+		},
+		{
+			name:  "stream",
+			entry: rdb.DbEntry{Key: "s", Value: testStream(nil)},
+			want: []string{
+				"XADD s 1-0 f v",
+				"XADD s 1-1 a \x00\r\n b 2",
+				"XSETID s 5-0 ENTRIESADDED 4 MAXDELETEDID 3-0",
+			},
+		},
+		{
+			name:    "empty stream",
+			entry:   rdb.DbEntry{Key: "s", Value: stream.Restore(nil, stream.Metadata{LastID: stream.NewID(1, 0)}, nil)},
+			wantErr: true,
+		},
+		{
+			name:    "stream with groups",
+			entry:   rdb.DbEntry{Key: "s", Value: testStream([]*stream.ConsumerGroup{{Name: "g", EntriesRead: 1}})},
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			commands, err := RewriteCommands(test.entry)
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("RewriteCommands() = %v, want an error", commands)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, command := range commands {
+				var args []string
+				for _, arg := range command.Content {
+					args = append(args, resp.String(arg))
+				}
+				got = append(got, strings.Join(args, " "))
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("RewriteCommands() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestReplaceRoundTrip(t *testing.T) {
+	delivered := time.UnixMilli(1700000000000)
+	groups := []*stream.ConsumerGroup{{
+		Name:        "g",
+		LastID:      stream.NewID(1, 0),
+		EntriesRead: 1,
+		Pending:     []stream.PendingEntry{{ID: stream.NewID(1, 0), DeliveryTime: delivered, DeliveryCount: 2}},
+		Consumers: []stream.Consumer{
+			{Name: "c", SeenTime: delivered, ActiveTime: delivered, Pending: []stream.StreamID{stream.NewID(1, 0)}},
+		},
+	}}
+	keys := []rdb.DbEntry{
+		{Key: "k", Value: resp.BulkString("v")},
+		{Key: "expiring", Value: resp.BulkString("v"), ExpireAt: time.UnixMilli(4102444800000)},
+	}
+	tests := []struct {
+		name         string
+		entries      []rdb.DbEntry
+		wantPreamble bool
+	}{
+		{"strings and stream", append(keys, rdb.DbEntry{Key: "s", Value: testStream(nil)}), false},
+		{"empty stream", append(keys, rdb.DbEntry{Key: "s", Value: stream.Restore(nil, stream.Metadata{LastID: stream.NewID(7, 0), EntriesAdded: 1}, nil)}), true},
+		{"stream with groups", append(keys, rdb.DbEntry{Key: "s", Value: testStream(groups)}), true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := Config{Dir: t.TempDir(), DirName: "appendonlydir", FileName: "appendonly.aof", Fsync: FsyncNo}
+			a, err := Open(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := a.StartAppending(); err != nil {
+				t.Fatal(err)
+			}
+			if err := a.Append(command("SET", "old", "dataset")); err != nil {
+				t.Fatal(err)
+			}
+			if err := a.Replace(test.entries); err != nil {
+				t.Fatalf("Replace failed: %v", err)
+			}
+			if got := filepath.Ext(a.manifest.base.name) == ".rdb"; got != test.wantPreamble {
+				t.Errorf("base file %s, want preamble %v", a.manifest.base.name, test.wantPreamble)
+			}
+			if err := a.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			a, err = Open(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var strategy collectStrategy
+			var commands []resp.Array
+			err = a.Load(&strategy, func(request resp.RespDataType) {
+				commands = append(commands, request.(resp.Array))
+			})
+			if err != nil {
+				t.Fatalf("Load failed: %v", err)
+			}
+			var want []resp.Array
+			if test.wantPreamble {
+				assertEntries(t, strategy.entries, test.entries)
+			} else {
+				for _, entry := range test.entries {
+					entryCommands, err := RewriteCommands(entry)
+					if err != nil {
+						t.Fatal(err)
+					}
+					want = append(want, entryCommands...)
+				}
+			}
+			if !reflect.DeepEqual(commands, want) {
+				t.Errorf("Load applied %v, want %v", commands, want)
+			}
+		})
+	}
+}
+
+func assertEntries(t *testing.T, got []rdb.DbEntry, want []rdb.DbEntry) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("loaded %d entries, want %d", len(got), len(want))
+	}
+	for i := range got {
+		if got[i].Key != want[i].Key || !got[i].ExpireAt.Equal(want[i].ExpireAt) {
+			t.Errorf("entry %d = %q expiring at %v, want %q expiring at %v", i, got[i].Key, got[i].ExpireAt, want[i].Key, want[i].ExpireAt)
+		}
+		g, ok := got[i].Value.(*stream.Stream)
+		if !ok {
+			if !reflect.DeepEqual(got[i].Value, want[i].Value) {
+				t.Errorf("entry %q = %#v, want %#v", got[i].Key, got[i].Value, want[i].Value)
+			}
+			continue
+		}
+		w := want[i].Value.(*stream.Stream)
+		if !reflect.DeepEqual(g.Entries(), w.Entries()) || !reflect.DeepEqual(g.Metadata(), w.Metadata()) || !reflect.DeepEqual(g.Groups(), w.Groups()) {
+			t.Errorf("stream %q differs after reload", got[i].Key)
+		}
+	}
+}
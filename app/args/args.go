@@ -2,6 +2,7 @@ package args
 
 import (
 	"fmt"
+	"math"
 	"os"
 	"strconv"
 	"strings"
@@ -10,24 +11,104 @@ import (
 )
 
 type Args struct {
-	Port        uint16
-	ReplicaOf   replication.ReplicaAddress
-	RdbDir      string
-	RdbFileName string
-	Raw         map[string]string
+	Port                     uint16
+	ReplicaOf                replication.ReplicaAddress
+	RdbDir                   string
+	RdbFileName              string
+	RdbChecksum              bool
+	AppendOnly               bool
+	AppendFileName           string
+	AppendFsync              string
+	AofLoadTruncated         bool
+	AppendDirName            string
+	AofUseRdbPreamble        bool
+	AutoAofRewritePercentage int
+	AutoAofRewriteMinSize    int64
+	ReplBacklogSize          int64
+	ReplPingReplicaPeriod    int
+	ReplTimeout              int
+	ReplicaReadOnly          bool
+	ReplDisklessSync         bool
+	ReplDisklessSyncDelay    int
+	ReplDisklessLoad         string
+	MinReplicasToWrite       int
+	MinReplicasMaxLag        int
+	ProtoMaxBulkLen          int64
+	ProtoMaxMultibulkLen     int64
+	ClientQueryBufferLimit   int64
+	Sentinel                 bool
+	SentinelMonitors         []SentinelMonitor
+	Raw                      map[string]string
+}
+
+// SentinelMonitor is a master watched in sentinel mode.
+type SentinelMonitor struct {
+	Name    string
+	Address replication.ReplicaAddress
+	Quorum  int
+	// DownAfterMs is how long the master may not reply before it's
+	// considered down, FailoverTimeoutMs limits a failover of it.
+	DownAfterMs       int
+	FailoverTimeoutMs int
 }
 
 var parsers = map[string]flagParser{
-	"port":       port,
-	"replicaof":  replicaof,
-	"dir":        rdbDir,
-	"dbfilename": rdbFileName,
+	"port":                             port,
+	"replicaof":                        replicaof,
+	"dir":                              rdbDir,
+	"dbfilename":                       rdbFileName,
+	"rdbchecksum":                      rdbChecksum,
+	"appendonly":                       appendOnly,
+	"appendfilename":                   appendFileName,
+	"appendfsync":                      appendFsync,
+	"aof-load-truncated":               aofLoadTruncated,
+	"appenddirname":                    appendDirName,
+	"aof-use-rdb-preamble":             aofUseRdbPreamble,
+	"auto-aof-rewrite-percentage":      autoAofRewritePercentage,
+	"auto-aof-rewrite-min-size":        autoAofRewriteMinSize,
+	"repl-backlog-size":                replBacklogSize,
+	"repl-ping-replica-period":         replPingReplicaPeriod,
+	"repl-timeout":                     replTimeout,
+	"replica-read-only":                replicaReadOnly,
+	"slave-read-only":                  replicaReadOnly,
+	"repl-diskless-sync":               replDisklessSync,
+	"repl-diskless-sync-delay":         replDisklessSyncDelay,
+	"repl-diskless-load":               replDisklessLoad,
+	"min-replicas-to-write":            minReplicasToWrite,
+	"min-slaves-to-write":              minReplicasToWrite,
+	"min-replicas-max-lag":             minReplicasMaxLag,
+	"min-slaves-max-lag":               minReplicasMaxLag,
+	"proto-max-bulk-len":               protoMaxBulkLen,
+	"proto-max-multibulk-len":          protoMaxMultibulkLen,
+	"client-query-buffer-limit":        clientQueryBufferLimit,
+	"sentinel":                         sentinel,
+	"sentinel-monitor":                 sentinelMonitor,
+	"sentinel-down-after-milliseconds": sentinelDownAfter,
+	"sentinel-failover-timeout":        sentinelFailoverTimeout,
 }
 
 func ParseArgs() Args {
 	osArgs := os.Args[1:]
 	var args Args
 	args.Raw = make(map[string]string)
+	args.RdbChecksum = true
+	args.AppendFileName = "appendonly.aof"
+	args.AppendFsync = "everysec"
+	args.AofLoadTruncated = true
+	args.AppendDirName = "appendonlydir"
+	args.AofUseRdbPreamble = true
+	args.AutoAofRewritePercentage = 100
+	args.AutoAofRewriteMinSize = 64 * 1024 * 1024
+	args.ReplBacklogSize = 1024 * 1024
+	args.ReplPingReplicaPeriod = 10
+	args.ReplTimeout = 60
+	args.ReplicaReadOnly = true
+	args.ReplDisklessSync = true
+	args.ReplDisklessSyncDelay = 5
+	args.ReplDisklessLoad = replication.DisklessLoadDisabled
+	args.MinReplicasMaxLag = 10
+	args.ProtoMaxBulkLen = 512 * 1024 * 1024
+	args.ClientQueryBufferLimit = 1024 * 1024 * 1024
 	for {
 		if len(osArgs) == 0 {
 			break
@@ -38,11 +119,23 @@ func ParseArgs() Args {
 			rest, value := parser(osArgs[1:], &args)
 			osArgs = rest
 			args.Raw[flag] = value
+		} else {
+			fmt.Printf("unknown flag: %v\n", osArgs[0])
+			osArgs = osArgs[1:]
 		}
 	}
+	if args.Port == 0 && args.Sentinel {
+		args.Port = 26379
+	}
 	if args.Port == 0 {
 		args.Port = 6379
 	}
+	if args.RdbDir == "" {
+		args.RdbDir = "."
+	}
+	if args.RdbFileName == "" {
+		args.RdbFileName = "dump.rdb"
+	}
 	return args
 }
 
@@ -97,3 +190,362 @@ func rdbFileName(rest []string, args *Args) ([]string, string) {
 	args.RdbFileName = rest[0]
 	return rest[1:], rest[0]
 }
+
+func rdbChecksum(rest []string, args *Args) ([]string, string) {
+	if len(rest) == 0 {
+		return rest, ""
+	}
+	args.RdbChecksum = parseYesNo(rest[0], args.RdbChecksum)
+	return rest[1:], rest[0]
+}
+
+func appendOnly(rest []string, args *Args) ([]string, string) {
+	if len(rest) == 0 {
+		return rest, ""
+	}
+	args.AppendOnly = parseYesNo(rest[0], args.AppendOnly)
+	return rest[1:], rest[0]
+}
+
+func appendFileName(rest []string, args *Args) ([]string, string) {
+	if len(rest) == 0 {
+		return rest, ""
+	}
+	args.AppendFileName = rest[0]
+	return rest[1:], rest[0]
+}
+
+func appendFsync(rest []string, args *Args) ([]string, string) {
+	if len(rest) == 0 {
+		return rest, ""
+	}
+	switch value := strings.ToLower(rest[0]); value {
+	case "always", "everysec", "no":
+		args.AppendFsync = value
+	default:
+		fmt.Printf("invalid appendfsync policy: %v\n", rest[0])
+	}
+	return rest[1:], rest[0]
+}
+
+func aofLoadTruncated(rest []string, args *Args) ([]string, string) {
+	if len(rest) == 0 {
+		return rest, ""
+	}
+	args.AofLoadTruncated = parseYesNo(rest[0], args.AofLoadTruncated)
+	return rest[1:], rest[0]
+}
+
+func appendDirName(rest []string, args *Args) ([]string, string) {
+	if len(rest) == 0 {
+		return rest, ""
+	}
+	args.AppendDirName = rest[0]
+	return rest[1:], rest[0]
+}
+
+func aofUseRdbPreamble(rest []string, args *Args) ([]string, string) {
+	if len(rest) == 0 {
+		return rest, ""
+	}
+	args.AofUseRdbPreamble = parseYesNo(rest[0], args.AofUseRdbPreamble)
+	return rest[1:], rest[0]
+}
+
+func autoAofRewritePercentage(rest []string, args *Args) ([]string, string) {
+	if len(rest) == 0 {
+		return rest, ""
+	}
+	num, err := strconv.Atoi(rest[0])
+	if err != nil || num < 0 {
+		fmt.Printf("failed to parse auto-aof-rewrite-percentage: %v\n", rest[0])
+	} else {
+		args.AutoAofRewritePercentage = num
+	}
+	return rest[1:], rest[0]
+}
+
+func autoAofRewriteMinSize(rest []string, args *Args) ([]string, string) {
+	if len(rest) == 0 {
+		return rest, ""
+	}
+	size, err := parseMemory(rest[0])
+	if err != nil {
+		fmt.Printf("failed to parse auto-aof-rewrite-min-size: %v\n", err)
+	} else {
+		args.AutoAofRewriteMinSize = size
+	}
+	return rest[1:], rest[0]
+}
+
+func replBacklogSize(rest []string, args *Args) ([]string, string) {
+	if len(rest) == 0 {
+		return rest, ""
+	}
+	size, err := parseMemory(rest[0])
+	if err != nil || size == 0 {
+		fmt.Printf("failed to parse repl-backlog-size: %v\n", rest[0])
+	} else {
+		args.ReplBacklogSize = size
+	}
+	return rest[1:], rest[0]
+}
+
+// protoMaxBulkLen and clientQueryBufferLimit, like in Redis, can't be set
+// below 1mb.
+func protoMaxBulkLen(rest []string, args *Args) ([]string, string) {
+	if len(rest) == 0 {
+		return rest, ""
+	}
+	size, err := parseMemory(rest[0])
+	if err != nil || size < 1024*1024 {
+		fmt.Printf("failed to parse proto-max-bulk-len: %v\n", rest[0])
+	} else {
+		args.ProtoMaxBulkLen = size
+	}
+	return rest[1:], rest[0]
+}
+
+// protoMaxMultibulkLen is the most elements a client request may have. It's
+// not limited by default, like in Redis, where only the query buffer limit
+// bounds requests; 0 turns the limit off again.
+func protoMaxMultibulkLen(rest []string, args *Args) ([]string, string) {
+	if len(rest) == 0 {
+		return rest, ""
+	}
+	num, err := strconv.ParseInt(rest[0], 10, 64)
+	if err != nil || num < 0 || num > math.MaxInt32 {
+		fmt.Printf("failed to parse proto-max-multibulk-len: %v\n", rest[0])
+	} else {
+		args.ProtoMaxMultibulkLen = num
+	}
+	return rest[1:], rest[0]
+}
+
+func clientQueryBufferLimit(rest []string, args *Args) ([]string, string) {
+	if len(rest) == 0 {
+		return rest, ""
+	}
+	size, err := parseMemory(rest[0])
+	if err != nil || size < 1024*1024 {
+		fmt.Printf("failed to parse client-query-buffer-limit: %v\n", rest[0])
+	} else {
+		args.ClientQueryBufferLimit = size
+	}
+	return rest[1:], rest[0]
+}
+
+func replPingReplicaPeriod(rest []string, args *Args) ([]string, string) {
+	if len(rest) == 0 {
+		return rest, ""
+	}
+	num, err := strconv.Atoi(rest[0])
+	if err != nil || num <= 0 {
+		fmt.Printf("failed to parse repl-ping-replica-period: %v\n", rest[0])
+	} else {
+		args.ReplPingReplicaPeriod = num
+	}
+	return rest[1:], rest[0]
+}
+
+func replTimeout(rest []string, args *Args) ([]string, string) {
+	if len(rest) == 0 {
+		return rest, ""
+	}
+	num, err := strconv.Atoi(rest[0])
+	if err != nil || num <= 0 {
+		fmt.Printf("failed to parse repl-timeout: %v\n", rest[0])
+	} else {
+		args.ReplTimeout = num
+	}
+	return rest[1:], rest[0]
+}
+
+func replicaReadOnly(rest []string, args *Args) ([]string, string) {
+	if len(rest) == 0 {
+		return rest, ""
+	}
+	args.ReplicaReadOnly = parseYesNo(rest[0], args.ReplicaReadOnly)
+	return rest[1:], rest[0]
+}
+
+func replDisklessSync(rest []string, args *Args) ([]string, string) {
+	if len(rest) == 0 {
+		return rest, ""
+	}
+	args.ReplDisklessSync = parseYesNo(rest[0], args.ReplDisklessSync)
+	return rest[1:], rest[0]
+}
+
+func replDisklessSyncDelay(rest []string, args *Args) ([]string, string) {
+	if len(rest) == 0 {
+		return rest, ""
+	}
+	num, err := strconv.Atoi(rest[0])
+	if err != nil || num < 0 {
+		fmt.Printf("failed to parse repl-diskless-sync-delay: %v\n", rest[0])
+	} else {
+		args.ReplDisklessSyncDelay = num
+	}
+	return rest[1:], rest[0]
+}
+
+func replDisklessLoad(rest []string, args *Args) ([]string, string) {
+	if len(rest) == 0 {
+		return rest, ""
+	}
+	switch value := strings.ToLower(rest[0]); value {
+	case replication.DisklessLoadDisabled, replication.DisklessLoadOnEmptyDb, replication.DisklessLoadSwapDb:
+		args.ReplDisklessLoad = value
+	default:
+		fmt.Printf("invalid repl-diskless-load: %v\n", rest[0])
+	}
+	return rest[1:], rest[0]
+}
+
+func minReplicasToWrite(rest []string, args *Args) ([]string, string) {
+	if len(rest) == 0 {
+		return rest, ""
+	}
+	num, err := strconv.Atoi(rest[0])
+	if err != nil || num < 0 {
+		fmt.Printf("failed to parse min-replicas-to-write: %v\n", rest[0])
+	} else {
+		args.MinReplicasToWrite = num
+	}
+	return rest[1:], rest[0]
+}
+
+func minReplicasMaxLag(rest []string, args *Args) ([]string, string) {
+	if len(rest) == 0 {
+		return rest, ""
+	}
+	num, err := strconv.Atoi(rest[0])
+	if err != nil || num < 0 {
+		fmt.Printf("failed to parse min-replicas-max-lag: %v\n", rest[0])
+	} else {
+		args.MinReplicasMaxLag = num
+	}
+	return rest[1:], rest[0]
+}
+
+// sentinel turns on sentinel mode, it takes no value.
+func sentinel(rest []string, args *Args) ([]string, string) {
+	args.Sentinel = true
+	return rest, "yes"
+}
+
+// sentinelMonitor parses "<name> <host> <port> <quorum>".
+func sentinelMonitor(rest []string, args *Args) ([]string, string) {
+	if len(rest) == 0 {
+		return rest, ""
+	}
+	parts := strings.Fields(rest[0])
+	if len(parts) != 4 {
+		fmt.Printf("invalid sentinel-monitor: %v\n", rest[0])
+		return rest[1:], rest[0]
+	}
+	port, err := strconv.ParseUint(parts[2], 10, 16)
+	if err != nil {
+		fmt.Printf("failed to parse sentinel-monitor port: %v\n", parts[2])
+		return rest[1:], rest[0]
+	}
+	quorum, err := strconv.Atoi(parts[3])
+	if err != nil || quorum <= 0 {
+		fmt.Printf("failed to parse sentinel-monitor quorum: %v\n", parts[3])
+		return rest[1:], rest[0]
+	}
+	args.SentinelMonitors = append(args.SentinelMonitors, SentinelMonitor{
+		Name:              parts[0],
+		Address:           replication.ReplicaAddress{Host: parts[1], Port: uint16(port)},
+		Quorum:            quorum,
+		DownAfterMs:       30000,
+		FailoverTimeoutMs: 180000,
+	})
+	return rest[1:], rest[0]
+}
+
+// sentinelDownAfter parses "<name> <milliseconds>" for a master declared
+// with sentinel-monitor before.
+func sentinelDownAfter(rest []string, args *Args) ([]string, string) {
+	if len(rest) == 0 {
+		return rest, ""
+	}
+	monitor, ms := sentinelOption(rest[0], args)
+	if monitor != nil {
+		monitor.DownAfterMs = ms
+	}
+	return rest[1:], rest[0]
+}
+
+// sentinelFailoverTimeout parses "<name> <milliseconds>" for a master
+// declared with sentinel-monitor before.
+func sentinelFailoverTimeout(rest []string, args *Args) ([]string, string) {
+	if len(rest) == 0 {
+		return rest, ""
+	}
+	monitor, ms := sentinelOption(rest[0], args)
+	if monitor != nil {
+		monitor.FailoverTimeoutMs = ms
+	}
+	return rest[1:], rest[0]
+}
+
+func sentinelOption(value string, args *Args) (*SentinelMonitor, int) {
+	parts := strings.Fields(value)
+	if len(parts) != 2 {
+		fmt.Printf("invalid sentinel option: %v\n", value)
+		return nil, 0
+	}
+	ms, err := strconv.Atoi(parts[1])
+	if err != nil || ms <= 0 {
+		fmt.Printf("failed to parse sentinel option milliseconds: %v\n", parts[1])
+		return nil, 0
+	}
+	for i := range args.SentinelMonitors {
+		if args.SentinelMonitors[i].Name == parts[0] {
+			return &args.SentinelMonitors[i], ms
+		}
+	}
+	fmt.Printf("no master named %v is monitored\n", parts[0])
+	return nil, 0
+}
+
+// parseMemory parses sizes the way redis.conf does: 1k is 1000 bytes,
+// 1kb is 1024 bytes and so on up to gigabytes.
+func parseMemory(value string) (int64, error) {
+	units := []struct {
+		suffix     string
+		multiplier int64
+	}{
+		{"kb", 1024}, {"mb", 1024 * 1024}, {"gb", 1024 * 1024 * 1024},
+		{"k", 1000}, {"m", 1000 * 1000}, {"g", 1000 * 1000 * 1000},
+		{"b", 1},
+	}
+	lower := strings.ToLower(value)
+	multiplier := int64(1)
+	for _, unit := range units {
+		if number, ok := strings.CutSuffix(lower, unit.suffix); ok {
+			lower = number
+			multiplier = unit.multiplier
+			break
+		}
+	}
+	num, err := strconv.ParseInt(lower, 10, 64)
+	if err != nil || num < 0 {
+		return 0, fmt.Errorf("invalid memory size: %v", value)
+	}
+	return num * multiplier, nil
+}
+
+func parseYesNo(value string, fallback bool) bool {
+	switch strings.ToLower(value) {
+	case "yes":
+		return true
+	case "no":
+		return false
+	default:
+		fmt.Printf("expected yes or no, got: %v\n", value)
+		return fallback
+	}
+}
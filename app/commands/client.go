@@ -0,0 +1,163 @@
+package commands
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/codecrafters-io/redis-starter-go/app/replication"
+	"github.com/codecrafters-io/redis-starter-go/app/resp"
+)
+
+// client is the state of a client connection. The name is guarded by the
+// context mutex, the protocol is read when publishing to the client too.
+// Replies are buffered in output until flushed.
+type client struct {
+	id       int64
+	name     string
+	protocol atomic.Int32
+	output   *resp.Writer
+}
+
+// Protocol returns the RESP version replies are sent in, 2 until the client
+// switches with HELLO and for connections that are not clients.
+func (c *client) Protocol() int {
+	if c == nil {
+		return 2
+	}
+	return int(c.protocol.Load())
+}
+
+func newClient(id int64, conn net.Conn) *client {
+	c := &client{id: id, output: resp.NewWriter(conn)}
+	c.protocol.Store(2)
+	return c
+}
+
+// Connect registers a new client connection and returns the output its
+// replies are buffered in, for the caller to flush once the requests
+// received so far are handled.
+func (c *Context) Connect(conn net.Conn) *resp.Writer {
+	c.stats.mutex.Lock()
+	c.stats.connectionsReceived += 1
+	c.stats.connectedClients += 1
+	id := c.stats.connectionsReceived
+	c.stats.mutex.Unlock()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	client := newClient(id, conn)
+	c.clients[conn.RemoteAddr().String()] = client
+	return client.output
+}
+
+// hello switches the connection to the protocol version, authenticates and
+// names it, then replies with information about the server in the new
+// protocol.
+func hello(args []resp.RespDataType, _ *execution, writer writer, context *Context) error {
+	c := clientOf(writer)
+	protocol := c.Protocol()
+	if len(args) > 0 {
+		version, err := strconv.Atoi(resp.String(args[0]))
+		if err != nil {
+			return writer.Write(resp.Error("ERR Protocol version is not an integer or out of range"))
+		}
+		if version != 2 && version != 3 {
+			return writer.Write(resp.Error("NOPROTO unsupported protocol version"))
+		}
+		protocol = version
+		args = args[1:]
+	}
+	var name *string
+	for len(args) > 0 {
+		option := strings.ToLower(resp.String(args[0]))
+		switch {
+		case option == "auth" && len(args) >= 3:
+			// No password is configured, the default user needs none.
+			if resp.String(args[1]) != "default" {
+				return writer.Write(resp.Error("WRONGPASS invalid username-password pair or user is disabled."))
+			}
+			args = args[3:]
+		case option == "setname" && len(args) >= 2:
+			value := resp.String(args[1])
+			if !validClientName(value) {
+				return writer.Write(resp.Error("ERR Client names cannot contain spaces, newlines or special characters."))
+			}
+			name = &value
+			args = args[2:]
+		default:
+			return writer.Write(resp.Error(fmt.Sprintf("ERR Syntax error in HELLO option '%v'", option)))
+		}
+	}
+
+	var id int64
+	if c != nil {
+		c.protocol.Store(int32(protocol))
+		context.mutex.Lock()
+		if name != nil {
+			c.name = *name
+		}
+		id = c.id
+		context.mutex.Unlock()
+	}
+	role := "master"
+	if _, ok := context.ReplicationRole().(*replication.SlaveRole); ok {
+		role = "replica"
+	}
+	return writer.Write(resp.Map{Content: []resp.RespDataType{
+		BulkString("server"), BulkString("redis"),
+		BulkString("version"), BulkString(version),
+		BulkString("proto"), resp.Integer(protocol),
+		BulkString("id"), resp.Integer(id),
+		BulkString("mode"), BulkString("standalone"),
+		BulkString("role"), BulkString(role),
+		BulkString("modules"), resp.Array{Content: []resp.RespDataType{}},
+	}})
+}
+
+// clientCommand implements CLIENT ID, GETNAME and SETNAME.
+func clientCommand(args []resp.RespDataType, _ *execution, writer writer, context *Context) error {
+	if len(args) == 0 {
+		return writer.Write(resp.Error("ERR wrong number of arguments for 'client' command"))
+	}
+	c := clientOf(writer)
+	subcommand := strings.ToLower(resp.String(args[0]))
+	if c == nil {
+		return fmt.Errorf("CLIENT %v received from a non client connection", subcommand)
+	}
+	switch {
+	case subcommand == "id" && len(args) == 1:
+		return writer.Write(resp.Integer(c.id))
+	case subcommand == "getname" && len(args) == 1:
+		context.mutex.Lock()
+		name := c.name
+		context.mutex.Unlock()
+		if name == "" {
+			return writer.Write(NullBulkString{})
+		}
+		return writer.Write(BulkString(name))
+	case subcommand == "setname" && len(args) == 2:
+		name := resp.String(args[1])
+		if !validClientName(name) {
+			return writer.Write(resp.Error("ERR Client names cannot contain spaces, newlines or special characters."))
+		}
+		context.mutex.Lock()
+		c.name = name
+		context.mutex.Unlock()
+		return writer.Write(SimpleString("OK"))
+	case subcommand == "id" || subcommand == "getname" || subcommand == "setname":
+		return writer.Write(resp.Error(fmt.Sprintf("ERR wrong number of arguments for 'client|%v' command", subcommand)))
+	default:
+		return writer.Write(resp.Error(fmt.Sprintf("ERR unknown subcommand '%v'. Try CLIENT HELP.", subcommand)))
+	}
+}
+
+func validClientName(name string) bool {
+	for _, char := range name {
+		if char < '!' || char > '~' {
+			return false
+		}
+	}
+	return true
+}
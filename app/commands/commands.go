@@ -1,15 +1,22 @@
 package commands
 
 import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"os"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/codecrafters-io/redis-starter-go/app/aof"
 	"github.com/codecrafters-io/redis-starter-go/app/args"
 	"github.com/codecrafters-io/redis-starter-go/app/rdb"
 	"github.com/codecrafters-io/redis-starter-go/app/replication"
@@ -17,7 +24,7 @@ import (
 	"github.com/codecrafters-io/redis-starter-go/app/stream"
 )
 
-type command func([]resp.RespDataType, resp.RespDataType, writer, *Context) error
+type command func([]resp.RespDataType, *execution, writer, *Context) error
 type transactionCommand func(started bool, key string, w writer, c *Context) error
 type BulkString = resp.BulkString
 type SimpleString = resp.SimpleString
@@ -27,17 +34,41 @@ type writer interface {
 	Write(resp.RespDataType) error
 }
 
+// connectionWriter sends replies in the protocol version the client chose,
+// client is nil for connections that are not clients. Replies to clients
+// are buffered in their output until flushed.
 type connectionWriter struct {
-	conn io.Writer
+	conn   io.Writer
+	client *client
 }
 
 func (c connectionWriter) Write(r resp.RespDataType) error {
-	_, err := c.conn.Write(r.Bytes())
+	if c.client != nil {
+		return c.client.output.Encode(r, c.client.Protocol())
+	}
+	_, err := c.conn.Write(resp.Convert(r, c.client.Protocol()).Bytes())
 	return err
 }
 
+// replyWriter records whether a command replied with an error, a failed
+// write command is not propagated.
+type replyWriter struct {
+	writer
+	stats  *stats
+	failed bool
+}
+
+func (r *replyWriter) Write(reply resp.RespDataType) error {
+	if e, ok := reply.(resp.Error); ok {
+		r.failed = true
+		r.stats.recordError(e)
+	}
+	return r.writer.Write(reply)
+}
+
 type execWriter struct {
-	buf []resp.RespDataType
+	buf    []resp.RespDataType
+	client *client
 }
 
 func (c *execWriter) Write(r resp.RespDataType) error {
@@ -46,12 +77,53 @@ func (c *execWriter) Write(r resp.RespDataType) error {
 }
 
 type Context struct {
-	args            args.Args
-	storage         map[string]entity
-	queue           map[string][]resp.RespDataType
+	args    args.Args
+	storage map[string]entity
+	queue   map[string][]resp.RespDataType
+	// writeOffsets holds the replication offset right after the last write
+	// of each client, WAIT waits for replicas to acknowledge it.
+	writeOffsets map[string]uint64
+	// replconfs holds what replicas announced with REPLCONF before PSYNC.
+	replicaConfs map[string]replicaConf
+	// clients holds the state of each client connection.
+	clients map[string]*client
+	// fullSync collects the replicas waiting for the next diskless
+	// transfer.
+	fullSync *fullSync
+	// failover is the failover in progress, nil when there is none.
+	failover *failover
+	// writesPaused is closed once client writes paused by FAILOVER can
+	// continue, nil when writes are not paused. It's guarded by the write
+	// mutex.
+	writesPaused chan struct{}
+	// channels maps Pub/Sub channels to the connections subscribed to them,
+	// subscriptions holds the channels of each subscribed connection.
+	channels        map[string]map[net.Conn]bool
+	subscriptions   map[net.Conn]map[string]bool
 	blockingXreads  map[string]map[stream.StreamID]chan<- stream.BlockingXReadPayload
-	ReplicationRole replication.Role
-	mutex           sync.Mutex
+	replicationRole replication.Role
+	roleMutex       sync.Mutex
+	// Replicate starts replicating from master in the background.
+	Replicate  func(*replication.SlaveRole)
+	AppendOnly *aof.AppendOnlyFile
+	mutex      sync.Mutex
+	// writeMutex serializes write commands, so they are propagated in the
+	// order they were executed.
+	writeMutex sync.Mutex
+	stats      stats
+}
+
+type commandSpec struct {
+	handler command
+	// write commands modify the dataset and are propagated to replicas and
+	// the AOF after successful execution.
+	write bool
+}
+
+// execution is a single run of a command. Write commands that are not
+// deterministic replace propagate with an equivalent deterministic form.
+type execution struct {
+	propagate resp.RespDataType
 }
 
 type entity struct {
@@ -63,29 +135,102 @@ func (c *Context) RdbFilePath() string {
 	return filepath.Join(c.args.RdbDir, c.args.RdbFileName)
 }
 
+func (c *Context) RdbChecksum() bool {
+	return c.args.RdbChecksum
+}
+
 func (c *Context) AddEntity(e rdb.DbEntry) {
+	var value interface{}
+	switch v := e.Value.(type) {
+	case *stream.Stream:
+		value = v
+	case resp.RespDataType:
+		value = resp.String(v)
+	default:
+		fmt.Printf("unexpected rdb entry value type: %T\n", e.Value)
+		return
+	}
 	c.storage[string(e.Key)] = entity{
-		value:    resp.String(e.Value),
+		value:    value,
 		expireAt: e.ExpireAt,
 	}
 }
 
-var commands = map[string]command{
-	"ping":     ping,
-	"echo":     echo,
-	"set":      set,
-	"get":      get,
-	"replconf": replconf,
-	"psync":    psync,
-	"info":     info,
-	"wait":     wait,
-	"config":   config,
-	"keys":     keys,
-	"incr":     incr,
-	"type":     type_,
-	"xadd":     xadd,
-	"xrange":   xrange,
-	"xread":    xread,
+// Reset replaces the whole dataset, e.g. with a snapshot received from master.
+// A transaction left incomplete by the previous master link is discarded.
+// The AOF is rewritten with the new dataset, as replaying the history of the
+// old one would diverge from master.
+func (c *Context) Reset(entries []rdb.DbEntry) {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	c.mutex.Lock()
+	delete(c.queue, "")
+	c.storage = make(map[string]entity, len(entries))
+	for _, entry := range entries {
+		c.AddEntity(entry)
+	}
+	if c.AppendOnly == nil {
+		c.mutex.Unlock()
+		return
+	}
+	snapshot := c.snapshot()
+	c.mutex.Unlock()
+	err := c.AppendOnly.Replace(snapshot)
+	if err != nil {
+		fmt.Printf("failed to rewrite append only file after full resynchronization: %v\n", err)
+	}
+}
+
+// snapshot returns all keys that are not expired yet as RDB entries. Streams
+// are cloned, so the snapshot can be encoded after the mutex is released.
+// Caller must hold the context mutex.
+func (c *Context) snapshot() []rdb.DbEntry {
+	now := time.Now()
+	entries := make([]rdb.DbEntry, 0, len(c.storage))
+	for key, e := range c.storage {
+		if !e.expireAt.IsZero() && e.expireAt.Before(now) {
+			continue
+		}
+		value := e.value
+		if s, ok := value.(*stream.Stream); ok {
+			value = s.Clone()
+		}
+		entries = append(entries, rdb.DbEntry{
+			Key:      resp.BulkString(key),
+			Value:    value,
+			ExpireAt: e.expireAt,
+		})
+	}
+	return entries
+}
+
+var commands = map[string]commandSpec{
+	"ping":         {handler: ping},
+	"echo":         {handler: echo},
+	"set":          {handler: set, write: true},
+	"get":          {handler: get},
+	"replconf":     {handler: replconf},
+	"psync":        {handler: psync},
+	"replicaof":    {handler: replicaof},
+	"slaveof":      {handler: replicaof},
+	"info":         {handler: info},
+	"hello":        {handler: hello},
+	"client":       {handler: clientCommand},
+	"wait":         {handler: wait},
+	"failover":     {handler: failoverCommand},
+	"config":       {handler: config},
+	"keys":         {handler: keys},
+	"incr":         {handler: incr, write: true},
+	"type":         {handler: type_},
+	"xadd":         {handler: xadd, write: true},
+	"xrange":       {handler: xrange},
+	"xread":        {handler: xread},
+	"xsetid":       {handler: xsetid, write: true},
+	"subscribe":    {handler: subscribe},
+	"unsubscribe":  {handler: unsubscribe},
+	"publish":      {handler: publish},
+	"save":         {handler: save},
+	"bgrewriteaof": {handler: bgrewriteaof},
 }
 
 var transactionCommands = map[string]transactionCommand{
@@ -98,30 +243,64 @@ func NewContext(args args.Args) Context {
 	return Context{
 		args:    args,
 		storage: make(map[string]entity),
-		ReplicationRole: func() replication.Role {
+		replicationRole: func() replication.Role {
 			if args.ReplicaOf.Host != "" {
-				return replication.SlaveRole{
-					Address: args.ReplicaOf,
-				}
+				return replication.NewSlave(args.ReplicaOf, replicationConfig(args))
 			} else {
-				return replication.NewMaster()
+				return replication.NewMaster(replicationConfig(args))
 			}
 		}(),
 		blockingXreads: make(map[string]map[stream.StreamID]chan<- stream.BlockingXReadPayload),
 		queue:          make(map[string][]resp.RespDataType),
+		writeOffsets:   make(map[string]uint64),
+		replicaConfs:   make(map[string]replicaConf),
+		clients:        make(map[string]*client),
+		channels:       make(map[string]map[net.Conn]bool),
+		subscriptions:  make(map[net.Conn]map[string]bool),
 		mutex:          sync.Mutex{},
+		stats:          newStats(),
+	}
+}
+
+// ReplicationRole returns the current role, REPLICAOF may replace it at any
+// time.
+func (c *Context) ReplicationRole() replication.Role {
+	c.roleMutex.Lock()
+	defer c.roleMutex.Unlock()
+	return c.replicationRole
+}
+
+// setReplicationRole replaces the role. Caller must hold the write mutex, so
+// no write is propagated by the old role afterwards.
+func (c *Context) setReplicationRole(role replication.Role) {
+	c.roleMutex.Lock()
+	defer c.roleMutex.Unlock()
+	c.replicationRole = role
+}
+
+func replicationConfig(args args.Args) replication.Config {
+	return replication.Config{
+		BacklogSize:  int(args.ReplBacklogSize),
+		PingPeriod:   time.Duration(args.ReplPingReplicaPeriod) * time.Second,
+		Timeout:      time.Duration(args.ReplTimeout) * time.Second,
+		DisklessLoad: args.ReplDisklessLoad,
+		RdbPath:      filepath.Join(args.RdbDir, args.RdbFileName),
 	}
 }
 
 func Handle(req resp.RespDataType, writer io.Writer, context *Context) {
 	w := connectionWriter{conn: writer}
-	conn, ok := writer.(net.Conn)
-	if !ok {
-		handle(req, w, context)
-		return
+	// Commands received from master or replayed from the AOF don't come
+	// from a client connection, they share a transaction queue.
+	var queueKey string
+	conn, client := writer.(net.Conn)
+	if client {
+		queueKey = conn.RemoteAddr().String()
 	}
-	queueKey := conn.RemoteAddr().String()
-	queue, transactionStarted := context.queue[queueKey]
+	context.mutex.Lock()
+	w.client = context.clients[queueKey]
+	_, transactionStarted := context.queue[queueKey]
+	context.mutex.Unlock()
 	request, ok := req.(resp.Array)
 	if !ok {
 		fmt.Printf("ignored command: %v\n", req)
@@ -130,58 +309,271 @@ func Handle(req resp.RespDataType, writer io.Writer, context *Context) {
 	if len(request.Content) == 0 {
 		return
 	}
-	command := string(request.Content[0].(BulkString))
+	command := strings.ToLower(resp.String(request.Content[0]))
 	handler, ok := transactionCommands[command]
 	if ok {
-		handler(transactionStarted, queueKey, w, context)
+		replies := &replyWriter{writer: w, stats: &context.stats}
+		start := time.Now()
+		handler(transactionStarted, queueKey, replies, context)
+		context.stats.recordCall(command, time.Since(start), replies.failed)
+	} else if client && w.client.Protocol() == 2 && context.subscribed(conn) && !subscribedCommands[command] {
+		context.reject(w, command, resp.Error(fmt.Sprintf("ERR Can't execute '%v': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT / RESET are allowed in this context", command)))
+	} else if client && context.readOnly(request) {
+		context.reject(w, command, resp.Error("READONLY You can't write against a read only replica."))
+	} else if client && context.notEnoughReplicas(request) {
+		context.reject(w, command, resp.Error("NOREPLICAS Not enough good replicas to write."))
 	} else if transactionStarted {
-		context.queue[queueKey] = append(queue, req)
+		context.mutex.Lock()
+		context.queue[queueKey] = append(context.queue[queueKey], req)
+		context.mutex.Unlock()
 		_ = w.Write(resp.SimpleString("QUEUED"))
 	} else {
-		handle(req, w, context)
+		offset := handle(req, w, context)
+		if offset > 0 {
+			context.recordWrite(queueKey, offset)
+		}
 	}
 }
 
-func handle(req resp.RespDataType, writer writer, context *Context) {
+// HandleReplicated applies a command received from master. The write mutex
+// is held until the command is forwarded to sub-replicas, so the snapshots
+// taken for them always match the replication offset.
+func HandleReplicated(req resp.RespDataType, conn replication.Connection, context *Context) {
+	context.writeMutex.Lock()
+	defer context.writeMutex.Unlock()
+	Handle(req, conn, context)
+	conn.Processed()
+}
+
+// lockWrites takes the write mutex and returns the function releasing it.
+// Commands from master run under the write mutex already, client writes
+// wait while FAILOVER pauses them.
+func (c *Context) lockWrites(w writer) func() {
+	conn := connection(w)
+	if _, ok := conn.(replication.Connection); ok {
+		return func() {}
+	}
+	_, client := conn.(net.Conn)
+	for {
+		c.writeMutex.Lock()
+		paused := c.writesPaused
+		if !client || paused == nil {
+			return c.writeMutex.Unlock
+		}
+		c.writeMutex.Unlock()
+		flush(w)
+		<-paused
+	}
+}
+
+// pauseWrites makes client writes wait until resumeWrites, writes being
+// executed complete first.
+func (c *Context) pauseWrites() {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	c.writesPaused = make(chan struct{})
+}
+
+func (c *Context) resumeWrites() {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	close(c.writesPaused)
+	c.writesPaused = nil
+}
+
+// Disconnect forgets the state of a client connection.
+func (c *Context) Disconnect(conn net.Conn) {
+	key := conn.RemoteAddr().String()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.queue, key)
+	delete(c.writeOffsets, key)
+	delete(c.replicaConfs, key)
+	delete(c.clients, key)
+	for channel := range c.subscriptions[conn] {
+		c.unsubscribe(conn, channel)
+	}
+	c.stats.mutex.Lock()
+	c.stats.connectedClients -= 1
+	c.stats.mutex.Unlock()
+}
+
+func (c *Context) recordWrite(key string, offset uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.writeOffsets[key] = offset
+}
+
+// readOnly reports whether the command is a write that clients can't run on
+// a read only replica. Commands from master are applied regardless.
+func (c *Context) readOnly(request resp.Array) bool {
+	if !c.args.ReplicaReadOnly {
+		return false
+	}
+	if _, ok := c.ReplicationRole().(*replication.SlaveRole); !ok {
+		return false
+	}
+	return isWrite(request)
+}
+
+// notEnoughReplicas reports whether the command is a write refused because
+// fewer than min-replicas-to-write replicas acknowledged something within
+// min-replicas-max-lag seconds.
+func (c *Context) notEnoughReplicas(request resp.Array) bool {
+	if c.args.MinReplicasToWrite == 0 || !isWrite(request) {
+		return false
+	}
+	master, ok := c.ReplicationRole().(*replication.MasterRole)
+	if !ok {
+		return false
+	}
+	return master.GoodReplicas(c.minReplicasMaxLag()) < c.args.MinReplicasToWrite
+}
+
+func (c *Context) minReplicasMaxLag() time.Duration {
+	return time.Duration(c.args.MinReplicasMaxLag) * time.Second
+}
+
+func isWrite(request resp.Array) bool {
+	spec, ok := commands[strings.ToLower(resp.String(request.Content[0]))]
+	return ok && spec.write
+}
+
+// handle executes the command and returns the replication offset right
+// after it was propagated, zero when nothing was sent to replicas.
+func handle(req resp.RespDataType, writer writer, context *Context) uint64 {
+	spec, ok := lookup(req)
+	if !ok {
+		return 0
+	}
+	if spec.write {
+		defer context.lockWrites(writer)()
+		// The server may have become a replica while writes were paused.
+		if isClient(writer) && context.readOnly(req.(resp.Array)) {
+			command := resp.String(req.(resp.Array).Content[0])
+			context.reject(writer, command, resp.Error("READONLY You can't write against a read only replica."))
+			return 0
+		}
+	}
+	propagate := execute(spec, req.(resp.Array), writer, context)
+	if propagate == nil {
+		return 0
+	}
+	return context.propagate(propagate)
+}
+
+// isClient reports whether replies go to a client connection.
+func isClient(w writer) bool {
+	_, ok := connection(w).(net.Conn)
+	return ok
+}
+
+// clientOf returns the client replies are written to, nil when they don't go
+// to a client.
+func clientOf(w writer) *client {
+	switch w := w.(type) {
+	case connectionWriter:
+		return w.client
+	case *replyWriter:
+		return clientOf(w.writer)
+	case *execWriter:
+		return w.client
+	default:
+		return nil
+	}
+}
+
+// flush sends the replies buffered for the client. Commands flush before
+// blocking, so replies to requests pipelined before them are not held back,
+// and before handing the connection over to replication.
+func flush(w writer) error {
+	if c := clientOf(w); c != nil {
+		return c.output.Flush()
+	}
+	return nil
+}
+
+// connection returns the connection replies are written to, nil when they
+// are collected, e.g. for EXEC.
+func connection(w writer) io.Writer {
+	switch w := w.(type) {
+	case connectionWriter:
+		return w.conn
+	case *replyWriter:
+		return connection(w.writer)
+	default:
+		return nil
+	}
+}
+
+func lookup(req resp.RespDataType) (commandSpec, bool) {
 	request, ok := req.(resp.Array)
 	if !ok {
 		fmt.Printf("ignored command: %v\n", req)
-		return
+		return commandSpec{}, false
 	}
 	if len(request.Content) == 0 {
-		return
+		return commandSpec{}, false
 	}
-	command := string(request.Content[0].(BulkString))
-	handler, ok := commands[strings.ToLower(command)]
+	command := resp.String(request.Content[0])
+	spec, ok := commands[strings.ToLower(command)]
 	if !ok {
 		fmt.Printf("unknown command received: %v\n", command)
-		return
+		return commandSpec{}, false
 	}
-	err := handler(request.Content[1:], req, writer, context)
+	return spec, true
+}
+
+// execute runs the command and returns what must be propagated: nothing for
+// read commands and failed writes. Writes must hold the write mutex.
+func execute(spec commandSpec, request resp.Array, writer writer, context *Context) resp.RespDataType {
+	ex := &execution{propagate: request}
+	replies := &replyWriter{writer: writer, stats: &context.stats}
+	start := time.Now()
+	err := spec.handler(request.Content[1:], ex, replies, context)
+	context.stats.recordCall(resp.String(request.Content[0]), time.Since(start), err != nil || replies.failed)
 	if err != nil {
-		fmt.Printf("%s command handling failure: %v\n", command, err)
+		fmt.Printf("%s command handling failure: %v\n", resp.String(request.Content[0]), err)
+		return nil
+	}
+	if !spec.write || replies.failed {
+		return nil
 	}
+	context.stats.recordChange()
+	return ex.propagate
 }
 
-func ping(args []resp.RespDataType, _ resp.RespDataType, writer writer, _ *Context) error {
+// propagate feeds an executed write command to the AOF and replicas and
+// returns the replication offset right after it. Caller must hold the write
+// mutex.
+func (c *Context) propagate(request resp.RespDataType) uint64 {
+	c.feedAppendOnly(request)
+	master, ok := c.ReplicationRole().(*replication.MasterRole)
+	if !ok {
+		return 0
+	}
+	return master.Propagate(request)
+}
+
+func ping(args []resp.RespDataType, _ *execution, writer writer, _ *Context) error {
 	len := len(args)
 	var response resp.RespDataType
 	if len == 1 {
-		response = args[1]
+		response = args[0]
 	} else {
-		response = BulkString("PONG")
+		response = SimpleString("PONG")
 	}
 	return writer.Write(response)
 }
 
-func echo(args []resp.RespDataType, _ resp.RespDataType, writer writer, _ *Context) error {
+func echo(args []resp.RespDataType, _ *execution, writer writer, _ *Context) error {
 	if len(args) != 1 {
 		return fmt.Errorf("ECHO command has 1 argument")
 	}
 	return writer.Write(args[0])
 }
 
-func set(args []resp.RespDataType, request resp.RespDataType, writer writer, context *Context) error {
+func set(args []resp.RespDataType, ex *execution, writer writer, context *Context) error {
 	if len(args) < 2 {
 		return fmt.Errorf("SET command has at least 2 arguments")
 	}
@@ -191,38 +583,47 @@ func set(args []resp.RespDataType, request resp.RespDataType, writer writer, con
 		expireAt: time.Time{},
 	}
 
-	var argIndex = 2
-	for {
-		if argIndex >= len(args) {
-			break
-		}
-		func() {
-			defer func() { argIndex += 2 }()
-			arg := resp.String(args[argIndex])
-			if strings.ToLower(arg) == "px" {
-				ms, err := strconv.Atoi(resp.String(args[argIndex+1]))
-				if err != nil {
-					fmt.Printf("expiry time must be a positive integer")
-					return
-				}
-				entity.expireAt = time.Now().Add(time.Duration(ms) * time.Millisecond)
-				fmt.Printf("Set expiry date: %v\n", entity.expireAt)
-			}
-		}()
+	for argIndex := 2; argIndex < len(args); argIndex += 2 {
+		option := strings.ToLower(resp.String(args[argIndex]))
+		if (option != "px" && option != "pxat") || argIndex+1 >= len(args) {
+			return writer.Write(resp.Error("ERR syntax error"))
+		}
+		ms, err := strconv.ParseInt(resp.String(args[argIndex+1]), 10, 64)
+		if err != nil {
+			return writer.Write(resp.Error("ERR value is not an integer or out of range"))
+		}
+		if ms <= 0 {
+			return writer.Write(resp.Error("ERR invalid expire time in 'set' command"))
+		}
+		if option == "px" {
+			entity.expireAt = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		} else {
+			entity.expireAt = time.UnixMilli(ms)
+		}
 	}
 
 	context.mutex.Lock()
 	context.storage[key] = entity
 	context.mutex.Unlock()
 
-	master, ok := context.ReplicationRole.(*replication.MasterRole)
-	if ok {
-		master.Propagate(request)
+	// Relative expiration times are propagated as absolute ones, so
+	// replicas and the AOF don't extend the lifetime of the key.
+	if !entity.expireAt.IsZero() {
+		ex.propagate = resp.Array{
+			Content: []resp.RespDataType{
+				resp.BulkString("SET"),
+				args[0],
+				args[1],
+				resp.BulkString("PXAT"),
+				resp.BulkString(strconv.FormatInt(entity.expireAt.UnixMilli(), 10)),
+			},
+		}
 	}
+
 	return writer.Write(SimpleString("OK"))
 }
 
-func get(args []resp.RespDataType, req resp.RespDataType, writer writer, context *Context) error {
+func get(args []resp.RespDataType, _ *execution, writer writer, context *Context) error {
 	if len(args) != 1 {
 		return fmt.Errorf("GET command has 1 argument")
 	}
@@ -243,7 +644,7 @@ func get(args []resp.RespDataType, req resp.RespDataType, writer writer, context
 	return writer.Write(response)
 }
 
-func incr(args []resp.RespDataType, req resp.RespDataType, writer writer, context *Context) error {
+func incr(args []resp.RespDataType, _ *execution, writer writer, context *Context) error {
 	if len(args) != 1 {
 		return fmt.Errorf("INCR command has 1 argument")
 	}
@@ -270,7 +671,7 @@ func incr(args []resp.RespDataType, req resp.RespDataType, writer writer, contex
 	return writer.Write(resp.Integer(value))
 }
 
-func type_(args []resp.RespDataType, _ resp.RespDataType, writer writer, context *Context) error {
+func type_(args []resp.RespDataType, _ *execution, writer writer, context *Context) error {
 	if len(args) != 1 {
 		return fmt.Errorf("GET command has 1 argument")
 	}
@@ -298,7 +699,7 @@ func type_(args []resp.RespDataType, _ resp.RespDataType, writer writer, context
 	return writer.Write(response)
 }
 
-func xadd(args []resp.RespDataType, _ resp.RespDataType, writer writer, context *Context) error {
+func xadd(args []resp.RespDataType, ex *execution, writer writer, context *Context) error {
 	if len(args) < 2 {
 		return fmt.Errorf("XADD command must contain key and id")
 	}
@@ -321,6 +722,7 @@ func xadd(args []resp.RespDataType, _ resp.RespDataType, writer writer, context
 	if !ok {
 		stream, err := stream.New(id, payload)
 		if err != nil {
+			context.mutex.Unlock()
 			return err
 		}
 		context.storage[key] = entity{
@@ -337,8 +739,12 @@ func xadd(args []resp.RespDataType, _ resp.RespDataType, writer writer, context
 			response = resp.BulkString(id)
 		}
 	}
-	_, ok = response.(resp.BulkString)
+	addedID, ok := response.(resp.BulkString)
 	if ok {
+		// Generated IDs are propagated explicitly.
+		ex.propagate = resp.Array{
+			Content: append([]resp.RespDataType{resp.BulkString("XADD"), args[0], addedID}, args[2:]...),
+		}
 		entry, ok := context.blockingXreads[key]
 		streamId, err := stream.ParseID(id, stream.StreamID{})
 		if ok && err == nil {
@@ -358,7 +764,53 @@ func xadd(args []resp.RespDataType, _ resp.RespDataType, writer writer, context
 	return writer.Write(response)
 }
 
-func xrange(args []resp.RespDataType, _ resp.RespDataType, writer writer, context *Context) error {
+func xsetid(args []resp.RespDataType, _ *execution, writer writer, context *Context) error {
+	if len(args) != 2 && len(args) != 4 && len(args) != 6 {
+		return writer.Write(resp.Error("ERR wrong number of arguments for 'xsetid' command"))
+	}
+	key := resp.String(args[0])
+	id, err := stream.ParseID(resp.String(args[1]), stream.StreamID{})
+	if err != nil {
+		return writer.Write(resp.Error("ERR Invalid stream ID specified as stream command argument"))
+	}
+	var entriesAdded *uint64
+	var maxDeletedID *stream.StreamID
+	for i := 2; i < len(args); i += 2 {
+		switch strings.ToLower(resp.String(args[i])) {
+		case "entriesadded":
+			value, err := strconv.ParseUint(resp.String(args[i+1]), 10, 64)
+			if err != nil {
+				return writer.Write(resp.Error("ERR value is not an integer or out of range"))
+			}
+			entriesAdded = &value
+		case "maxdeletedid":
+			value, err := stream.ParseID(resp.String(args[i+1]), stream.StreamID{})
+			if err != nil {
+				return writer.Write(resp.Error("ERR Invalid stream ID specified as stream command argument"))
+			}
+			maxDeletedID = &value
+		default:
+			return writer.Write(resp.Error("ERR syntax error"))
+		}
+	}
+	context.mutex.Lock()
+	defer context.mutex.Unlock()
+	entry, ok := context.storage[key]
+	if !ok {
+		return writer.Write(resp.Error("ERR no such key"))
+	}
+	s, isStream := entry.value.(*stream.Stream)
+	if !isStream {
+		return writer.Write(resp.Error("WRONGTYPE Operation against a key holding the wrong kind of value"))
+	}
+	err = s.SetLastID(id, entriesAdded, maxDeletedID)
+	if err != nil {
+		return writer.Write(resp.Error(err.Error()))
+	}
+	return writer.Write(SimpleString("OK"))
+}
+
+func xrange(args []resp.RespDataType, _ *execution, writer writer, context *Context) error {
 	if len(args) < 3 {
 		return fmt.Errorf("XRANGE command must contain key, stard and end")
 	}
@@ -391,11 +843,11 @@ func xrange(args []resp.RespDataType, _ resp.RespDataType, writer writer, contex
 	return writer.Write(response)
 }
 
-func xread(args []resp.RespDataType, _ resp.RespDataType, writer writer, context *Context) error {
+func xread(args []resp.RespDataType, _ *execution, writer writer, context *Context) error {
 	if len(args) < 3 {
 		return fmt.Errorf("(error) ERR wrong number of arguments for 'xread' command")
 	}
-	next := resp.String(args[0].(BulkString))
+	next := strings.ToLower(resp.String(args[0]))
 	var blockDuration time.Duration
 	var isBlocking bool
 	if next == "block" {
@@ -404,7 +856,7 @@ func xread(args []resp.RespDataType, _ resp.RespDataType, writer writer, context
 			return err
 		}
 		blockDuration = time.Duration(seconds) * time.Millisecond
-		next = resp.String(args[2].(BulkString))
+		next = strings.ToLower(resp.String(args[2]))
 		args = args[2:]
 		isBlocking = true
 	}
@@ -460,6 +912,7 @@ func xread(args []resp.RespDataType, _ resp.RespDataType, writer writer, context
 			}
 			existing[streamId] = incoming
 			context.mutex.Unlock()
+			flush(writer)
 			payload := stream.Block(blockDuration, incoming)
 			if payload != nil {
 				context.mutex.Lock()
@@ -473,105 +926,715 @@ func xread(args []resp.RespDataType, _ resp.RespDataType, writer writer, context
 						resp.Array{Content: p},
 					}},
 				}
-				content = append(content, resp.Array{Content: []resp.RespDataType{
-					resp.BulkString(key),
-					resp.Array{Content: matches},
-				}})
+				content = append(content, resp.BulkString(key), resp.Array{Content: matches})
 				delete(existing, streamId)
 			} else {
 				response = resp.NullBulkString{}
 				return writer.Write(response)
 			}
 		} else {
-			content = append(content, resp.Array{Content: []resp.RespDataType{
-				resp.BulkString(key),
-				resp.Array{Content: matches},
-			}})
+			content = append(content, resp.BulkString(key), resp.Array{Content: matches})
 		}
 	}
-	response = resp.Array{Content: content}
+	// RESP3 clients get the streams as a map, RESP2 ones as pairs.
+	if clientOf(writer).Protocol() >= 3 {
+		return writer.Write(resp.Map{Content: content})
+	}
+	pairs := make([]resp.RespDataType, 0, len(content)/2)
+	for i := 0; i < len(content); i += 2 {
+		pairs = append(pairs, resp.Array{Content: content[i : i+2]})
+	}
+	response = resp.Array{Content: pairs}
 	return writer.Write(response)
 }
 
-func replconf(args []resp.RespDataType, _ resp.RespDataType, writer writer, context *Context) error {
+func replconf(args []resp.RespDataType, _ *execution, writer writer, context *Context) error {
 	if len(args) == 0 {
 		return fmt.Errorf("replconf must contain arguments")
 	}
-	command := args[0].(BulkString)
+	command := strings.ToLower(resp.String(args[0]))
 	if command == "getack" {
-		conn := writer.(connectionWriter).conn.(*replication.SlaveConnection)
+		conn, ok := connection(writer).(*replication.SlaveConnection)
+		if !ok {
+			return fmt.Errorf("GETACK received from a client")
+		}
 		return conn.Ack()
 	} else if command == "ack" && len(args) == 2 {
 		offset, err := strconv.ParseUint(string(args[1].(BulkString)), 10, 64)
 		if err != nil {
 			return err
 		}
-		master := context.ReplicationRole.(*replication.MasterRole)
-		master.AckReceived(offset)
+		master, ok := replicationStream(context)
+		conn, isConn := connection(writer).(net.Conn)
+		if ok && isConn {
+			master.AckReceived(conn, offset)
+		}
 		return nil
+	} else if command == "listening-port" && len(args) == 2 {
+		port, err := strconv.ParseUint(resp.String(args[1]), 10, 16)
+		if err != nil {
+			return writer.Write(resp.Error("ERR value is not an integer or out of range"))
+		}
+		context.updateReplicaConf(writer, func(conf *replicaConf) {
+			conf.listeningPort = uint16(port)
+		})
+		return writer.Write(SimpleString("OK"))
+	} else if command == "capa" {
+		for i := 1; i < len(args); i += 2 {
+			if strings.EqualFold(resp.String(args[i-1]), "capa") && strings.EqualFold(resp.String(args[i]), "eof") {
+				context.updateReplicaConf(writer, func(conf *replicaConf) {
+					conf.eof = true
+				})
+			}
+		}
+		return writer.Write(SimpleString("OK"))
 	} else {
 		return writer.Write(SimpleString("OK"))
 	}
 }
 
-func psync(_ []resp.RespDataType, _ resp.RespDataType, writer writer, context *Context) error {
-	master := context.ReplicationRole.(*replication.MasterRole)
-	response := fmt.Sprintf("FULLRESYNC %v %d", master.Id, master.Offset)
+// replicaConf is what a replica announced with REPLCONF.
+type replicaConf struct {
+	listeningPort uint16
+	// eof is set when the replica accepts diskless transfers.
+	eof bool
+}
+
+func (c *Context) updateReplicaConf(w writer, update func(*replicaConf)) {
+	conn, ok := connection(w).(net.Conn)
+	if !ok {
+		return
+	}
+	key := conn.RemoteAddr().String()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	conf := c.replicaConfs[key]
+	update(&conf)
+	c.replicaConfs[key] = conf
+}
+
+func (c *Context) replicaConf(conn net.Conn) replicaConf {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.replicaConfs[conn.RemoteAddr().String()]
+}
+
+// replicationStream returns the stream served to replicas: the one of a
+// master, or the one a replica forwards from its master to sub-replicas.
+func replicationStream(context *Context) (*replication.MasterRole, bool) {
+	switch role := context.ReplicationRole().(type) {
+	case *replication.MasterRole:
+		return role, true
+	case *replication.SlaveRole:
+		return role.Downstream()
+	}
+	return nil, false
+}
+
+// psync continues replication from the backlog when the replica asks for an
+// offset that is still there. Otherwise it performs full resynchronization:
+// the snapshot is taken and the replica is attached under the write mutex,
+// so writes executed after the snapshot are buffered for the replica until
+// the transfer completes. The snapshot is stored as the RDB file before the
+// transfer unless repl-diskless-sync is enabled and the replica supports
+// diskless transfers. Replicas serve sub-replicas the stream of their
+// master while the link with it is up.
+func psync(args []resp.RespDataType, _ *execution, writer writer, context *Context) error {
+	// Replies inside EXEC are collected, they can't be followed by a
+	// snapshot and the stream.
+	conn, ok := connection(writer).(net.Conn)
+	if !ok {
+		return writer.Write(resp.Error("ERR PSYNC is only allowed from a client connection, not inside a transaction"))
+	}
+	conf := context.replicaConf(conn)
+	if len(args) == 3 && strings.EqualFold(resp.String(args[2]), "failover") {
+		if !takeOver(resp.String(args[0]), context) {
+			return writer.Write(resp.Error("ERR PSYNC FAILOVER replid must match my replid."))
+		}
+		args = args[:2]
+	}
+	master, ok := replicationStream(context)
+	if !ok {
+		return writer.Write(resp.Error("ERR Can't SYNC while not connected with my master"))
+	}
+	if len(args) == 2 {
+		offset, err := strconv.ParseUint(resp.String(args[1]), 10, 64)
+		if err == nil {
+			replica, id, ok := master.ContinueReplica(conn, conf.listeningPort, resp.String(args[0]), offset)
+			if ok {
+				err = writer.Write(SimpleString(fmt.Sprintf("CONTINUE %v", id)))
+				if err == nil {
+					err = flush(writer)
+				}
+				if err != nil {
+					master.DetachReplica(replica)
+					return err
+				}
+				if !master.ReplicaOnline(replica) {
+					return fmt.Errorf("replica %v disconnected before coming online", conn.RemoteAddr())
+				}
+				return nil
+			}
+		}
+	}
+
+	if context.args.ReplDisklessSync && conf.eof {
+		return disklessSync(conn, conf.listeningPort, writer, context)
+	}
+	context.writeMutex.Lock()
+	master, ok = replicationStream(context)
+	if !ok {
+		context.writeMutex.Unlock()
+		return writer.Write(resp.Error("ERR Can't SYNC while not connected with my master"))
+	}
+	context.mutex.Lock()
+	entries := context.snapshot()
+	replica, id, offset := master.AttachReplica(conn, conf.listeningPort)
+	context.mutex.Unlock()
+	context.writeMutex.Unlock()
+
+	response := fmt.Sprintf("FULLRESYNC %v %d", id, offset)
 	err := writer.Write(SimpleString(response))
+	if err == nil {
+		err = flush(writer)
+	}
 	if err != nil {
+		master.DetachReplica(replica)
 		return err
 	}
-	emptyRdp, err := rdb.Empty()
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		keepAlive(func() []net.Conn { return []net.Conn{conn} }, stop)
+	}()
+	file, err := writeRdb(context.RdbFilePath(), entries)
+	close(stop)
+	<-stopped
+	if err == nil {
+		err = sendRdbFile(conn, file, context.replicationTimeout())
+		file.Close()
+	}
+	if err != nil {
+		master.DetachReplica(replica)
+		return err
+	}
+	if !master.ReplicaOnline(replica) {
+		return fmt.Errorf("replica %v disconnected before coming online", conn.RemoteAddr())
+	}
+	return nil
+}
+
+// takeOver promotes this replica when its master asks for it with PSYNC
+// FAILOVER, the old master continues as a replica of this server. It fails
+// when replId is not the replication id of this server.
+func takeOver(replId string, context *Context) bool {
+	context.writeMutex.Lock()
+	defer context.writeMutex.Unlock()
+	switch role := context.ReplicationRole().(type) {
+	case *replication.SlaveRole:
+		if role.MasterReplId() != replId {
+			return false
+		}
+		role.Stop()
+		context.setReplicationRole(role.Promote())
+		fmt.Println("failover requested by master, promoted to master")
+		return true
+	case *replication.MasterRole:
+		return role.ReplId() == replId
+	}
+	return false
+}
+
+// sendRdbFile sends the snapshot stored in file as a bulk string without the
+// trailing CRLF.
+func sendRdbFile(conn net.Conn, file *os.File, timeout time.Duration) error {
+	info, err := file.Stat()
 	if err != nil {
 		return err
 	}
-	err = writer.Write(resp.RdbString(string(emptyRdp)))
+	out := &replicaWriter{conns: []net.Conn{conn}, errs: make([]error, 1), timeout: timeout}
+	_, err = fmt.Fprintf(out, "$%d\r\n", info.Size())
 	if err == nil {
-		master.AddReplica(writer.(connectionWriter).conn.(net.Conn))
+		_, err = io.Copy(out, file)
 	}
+	out.done()
 	return err
 }
 
-func info(_ []resp.RespDataType, _ resp.RespDataType, writer writer, context *Context) error {
-	return writer.Write(replicationInfo(context))
+// keepAlive writes a newline to the connections every second until stop is
+// closed, so replicas waiting for a snapshot don't time out. Replicas skip
+// newlines before the reply to PSYNC and before the snapshot, like in Redis.
+func keepAlive(conns func() []net.Conn, stop <-chan struct{}) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			for _, conn := range conns() {
+				// A broken connection fails the transfer later.
+				conn.Write([]byte("\n"))
+			}
+		}
+	}
 }
 
-func wait(args []resp.RespDataType, _ resp.RespDataType, writer writer, context *Context) error {
-	if len(args) != 2 {
-		return fmt.Errorf("numreplicas and timeout must be specified")
+// replicaWriter writes the same bytes to the connections of replicas, each
+// write must complete within the timeout. A replica that fails is left out
+// of later writes, writing fails only once every replica failed.
+type replicaWriter struct {
+	conns   []net.Conn
+	errs    []error
+	timeout time.Duration
+}
+
+func (w *replicaWriter) Write(p []byte) (int, error) {
+	failed := 0
+	for i, conn := range w.conns {
+		if w.errs[i] == nil {
+			if w.timeout > 0 {
+				conn.SetWriteDeadline(time.Now().Add(w.timeout))
+			}
+			_, w.errs[i] = conn.Write(p)
+		}
+		if w.errs[i] != nil {
+			failed += 1
+		}
+	}
+	if failed == len(w.conns) {
+		return 0, w.errs[0]
+	}
+	return len(p), nil
+}
+
+// done clears the write deadlines.
+func (w *replicaWriter) done() {
+	for _, conn := range w.conns {
+		conn.SetWriteDeadline(time.Time{})
 	}
-	numOfReplicas, err := strconv.Atoi(string(args[0].(BulkString)))
+}
+
+// fullSync is a diskless transfer of one snapshot to every replica that
+// asked for a full resynchronization within repl-diskless-sync-delay. The
+// snapshot is encoded once, straight to the connections of the replicas.
+type fullSync struct {
+	conns    []net.Conn
+	ports    []uint16
+	replicas []*replication.Replica
+	// master is nil when the snapshot couldn't be taken because this
+	// server is not connected with its master anymore.
+	master *replication.MasterRole
+	// errs holds the error of the transfer to each replica.
+	errs []error
+	// done is closed once the transfer is over.
+	done chan struct{}
+}
+
+func disklessSync(conn net.Conn, port uint16, writer writer, context *Context) error {
+	// The transfer writes to the connection directly.
+	err := flush(writer)
 	if err != nil {
 		return err
 	}
-	timeout, err := strconv.Atoi(string(args[1].(BulkString)))
+	transfer, i := context.joinFullSync(conn, port)
+	<-transfer.done
+	if transfer.master == nil {
+		return writer.Write(resp.Error("ERR Can't SYNC while not connected with my master"))
+	}
+	replica := transfer.replicas[i]
+	if transfer.errs[i] != nil {
+		transfer.master.DetachReplica(replica)
+		return transfer.errs[i]
+	}
+	if !transfer.master.ReplicaOnline(replica) {
+		return fmt.Errorf("replica %v disconnected before coming online", conn.RemoteAddr())
+	}
+	return nil
+}
+
+// joinFullSync adds the replica to the next diskless transfer, which starts
+// repl-diskless-sync-delay seconds after the first replica joined it. It
+// returns the transfer and the index of the replica in it.
+func (c *Context) joinFullSync(conn net.Conn, port uint16) (*fullSync, int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.fullSync == nil {
+		transfer := &fullSync{done: make(chan struct{})}
+		delay := time.Duration(c.args.ReplDisklessSyncDelay) * time.Second
+		go c.runFullSync(transfer, delay)
+		c.fullSync = transfer
+	}
+	c.fullSync.conns = append(c.fullSync.conns, conn)
+	c.fullSync.ports = append(c.fullSync.ports, port)
+	return c.fullSync, len(c.fullSync.conns) - 1
+}
+
+// runFullSync keeps the replicas joining the transfer alive until the delay
+// passes, then starts it.
+func (c *Context) runFullSync(transfer *fullSync, delay time.Duration) {
+	stop := make(chan struct{})
+	time.AfterFunc(delay, func() { close(stop) })
+	keepAlive(func() []net.Conn {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		return slices.Clone(transfer.conns)
+	}, stop)
+	c.startFullSync(transfer)
+}
+
+// startFullSync takes the snapshot and attaches every replica of the
+// transfer under the write mutex, so they all continue from its offset.
+// Then the snapshot is encoded to the replicas.
+func (c *Context) startFullSync(transfer *fullSync) {
+	defer close(transfer.done)
+	c.writeMutex.Lock()
+	master, ok := replicationStream(c)
+	c.mutex.Lock()
+	c.fullSync = nil
+	var entries []rdb.DbEntry
+	var id string
+	var offset uint64
+	if ok {
+		entries = c.snapshot()
+		for i, conn := range transfer.conns {
+			var replica *replication.Replica
+			replica, id, offset = master.AttachReplica(conn, transfer.ports[i])
+			transfer.replicas = append(transfer.replicas, replica)
+		}
+	}
+	c.mutex.Unlock()
+	c.writeMutex.Unlock()
+	if !ok {
+		return
+	}
+	transfer.master = master
+	out := &replicaWriter{
+		conns:   transfer.conns,
+		errs:    make([]error, len(transfer.conns)),
+		timeout: c.replicationTimeout(),
+	}
+	defer out.done()
+	_, err := out.Write(SimpleString(fmt.Sprintf("FULLRESYNC %v %d", id, offset)).Bytes())
+	if err == nil {
+		snapshot := resp.NewEofRdbWriter(out, eofMark())
+		buffered := bufio.NewWriterSize(snapshot, 64*1024)
+		err = rdb.Write(buffered, entries)
+		if err == nil {
+			err = buffered.Flush()
+		}
+		if err == nil {
+			err = snapshot.Close()
+		}
+	}
+	transfer.errs = out.errs
+	for i := range transfer.errs {
+		if transfer.errs[i] == nil && err != nil {
+			transfer.errs[i] = err
+		}
+	}
+}
+
+// replicationTimeout is how long a write to a replica may block.
+func (c *Context) replicationTimeout() time.Duration {
+	return time.Duration(c.args.ReplTimeout) * time.Second
+}
+
+// eofMark returns a random mark ending a diskless transfer.
+func eofMark() string {
+	mark := make([]byte, resp.EofMarkLength/2)
+	rand.Read(mark)
+	return hex.EncodeToString(mark)
+}
+
+// replicaof makes this server a replica of another one, or promotes it to
+// master with REPLICAOF NO ONE keeping the dataset and the replication id of
+// the old master, so sibling replicas can continue from their offsets.
+func replicaof(args []resp.RespDataType, _ *execution, writer writer, context *Context) error {
+	if len(args) != 2 {
+		return writer.Write(resp.Error("ERR wrong number of arguments for 'replicaof' command"))
+	}
+	host := resp.String(args[0])
+	context.writeMutex.Lock()
+	defer context.writeMutex.Unlock()
+	current := context.ReplicationRole()
+	if strings.EqualFold(host, "no") && strings.EqualFold(resp.String(args[1]), "one") {
+		slave, ok := current.(*replication.SlaveRole)
+		if ok {
+			slave.Stop()
+			context.setReplicationRole(slave.Promote())
+			fmt.Println("replica promoted to master")
+		}
+		return writer.Write(SimpleString("OK"))
+	}
+	port, err := strconv.ParseUint(resp.String(args[1]), 10, 16)
 	if err != nil {
-		return err
+		return writer.Write(resp.Error("ERR Invalid master port"))
+	}
+	address := replication.ReplicaAddress{Host: host, Port: uint16(port)}
+	switch role := current.(type) {
+	case *replication.SlaveRole:
+		if role.MasterAddress() == address {
+			return writer.Write(SimpleString("OK Already connected to specified master"))
+		}
+		role.SetMaster(address)
+	case *replication.MasterRole:
+		slave := role.Demote(address, replicationConfig(context.args))
+		context.setReplicationRole(slave)
+		if context.Replicate != nil {
+			context.Replicate(slave)
+		}
+	}
+	fmt.Printf("replicating from %v:%d\n", address.Host, address.Port)
+	return writer.Write(SimpleString("OK"))
+}
+
+// States of FAILOVER, named as INFO reports them.
+const (
+	failoverNone       = "no-failover"
+	failoverWaiting    = "waiting-for-sync"
+	failoverInProgress = "failover-in-progress"
+)
+
+type failover struct {
+	state string
+	// abort is closed by FAILOVER ABORT.
+	abort chan struct{}
+}
+
+// failoverCommand starts a failover in the background: client writes are
+// paused until a replica acknowledges the whole replication stream, then
+// this server becomes a replica of it and asks it to take over. With FORCE
+// the target replica takes over when the timeout elapses, otherwise the
+// failover is aborted.
+func failoverCommand(args []resp.RespDataType, _ *execution, writer writer, context *Context) error {
+	var target *replication.ReplicaAddress
+	var force, abort bool
+	var timeout time.Duration
+	for i := 0; i < len(args); i++ {
+		switch strings.ToLower(resp.String(args[i])) {
+		case "to":
+			if i+2 >= len(args) {
+				return writer.Write(resp.Error("ERR syntax error"))
+			}
+			port, err := strconv.ParseUint(resp.String(args[i+2]), 10, 16)
+			if err != nil {
+				return writer.Write(resp.Error("ERR value is not an integer or out of range"))
+			}
+			target = &replication.ReplicaAddress{Host: resp.String(args[i+1]), Port: uint16(port)}
+			i += 2
+		case "force":
+			force = true
+		case "abort":
+			abort = true
+		case "timeout":
+			if i+1 >= len(args) {
+				return writer.Write(resp.Error("ERR syntax error"))
+			}
+			ms, err := strconv.ParseInt(resp.String(args[i+1]), 10, 64)
+			if err != nil {
+				return writer.Write(resp.Error("ERR value is not an integer or out of range"))
+			}
+			if ms <= 0 {
+				return writer.Write(resp.Error("ERR FAILOVER timeout must be greater than 0"))
+			}
+			timeout = time.Duration(ms) * time.Millisecond
+			i += 1
+		default:
+			return writer.Write(resp.Error("ERR syntax error"))
+		}
+	}
+	if abort {
+		if force || target != nil || timeout > 0 {
+			return writer.Write(resp.Error("ERR syntax error"))
+		}
+		if !context.abortFailover() {
+			return writer.Write(resp.Error("ERR No failover in progress."))
+		}
+		return writer.Write(SimpleString("OK"))
+	}
+	if force && (target == nil || timeout == 0) {
+		return writer.Write(resp.Error("ERR FAILOVER with force option requires both a timeout and target HOST and IP."))
+	}
+	master, ok := context.ReplicationRole().(*replication.MasterRole)
+	if !ok {
+		return writer.Write(resp.Error("ERR FAILOVER is not valid when server is a replica."))
+	}
+	if master.OnlineReplicas() == 0 {
+		return writer.Write(resp.Error("ERR FAILOVER requires connected replicas."))
+	}
+	if target != nil {
+		found, online := master.ReplicaStatus(*target)
+		if !found {
+			return writer.Write(resp.Error("ERR FAILOVER target HOST and PORT is not a replica."))
+		}
+		if !online {
+			return writer.Write(resp.Error("ERR FAILOVER target replica is not online."))
+		}
+	}
+	f := &failover{state: failoverWaiting, abort: make(chan struct{})}
+	context.mutex.Lock()
+	if context.failover != nil {
+		context.mutex.Unlock()
+		return writer.Write(resp.Error("ERR FAILOVER already in progress."))
+	}
+	context.failover = f
+	context.mutex.Unlock()
+	context.pauseWrites()
+	go context.runFailover(f, master, target, force, timeout)
+	return writer.Write(SimpleString("OK"))
+}
+
+// runFailover waits for a replica to catch up with the paused master and
+// demotes the master into a replica of it. The replica promotes itself when
+// the demoted master asks it to with PSYNC FAILOVER. When that fails, takes
+// longer than repl-timeout or is aborted, this server is promoted back.
+func (c *Context) runFailover(f *failover, master *replication.MasterRole, target *replication.ReplicaAddress, force bool, timeout time.Duration) {
+	defer c.resumeWrites()
+	defer func() {
+		c.mutex.Lock()
+		c.failover = nil
+		c.mutex.Unlock()
+	}()
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	address, ok := master.WaitCaughtUp(target, deadline, f.abort)
+	if !ok {
+		select {
+		case <-f.abort:
+			fmt.Println("failover aborted")
+			return
+		default:
+		}
+		if !force {
+			fmt.Println("failover timed out waiting for a replica to catch up, aborted")
+			return
+		}
+		address = *target
+	}
+
+	c.writeMutex.Lock()
+	if c.ReplicationRole() != master {
+		c.writeMutex.Unlock()
+		fmt.Println("failover aborted, the role changed")
+		return
+	}
+	c.mutex.Lock()
+	f.state = failoverInProgress
+	c.mutex.Unlock()
+	slave := master.Demote(address, replicationConfig(c.args))
+	result := slave.RequestFailover()
+	c.setReplicationRole(slave)
+	if c.Replicate != nil {
+		c.Replicate(slave)
+	}
+	c.writeMutex.Unlock()
+	fmt.Printf("failing over to %v:%d\n", address.Host, address.Port)
+
+	handover := time.NewTimer(time.Duration(c.args.ReplTimeout) * time.Second)
+	defer handover.Stop()
+	var err error
+	select {
+	case err = <-result:
+	case <-handover.C:
+		err = errors.New("timed out")
+	case <-f.abort:
+		err = errors.New("aborted")
+	}
+	if err == nil {
+		fmt.Printf("failover to %v:%d completed\n", address.Host, address.Port)
+		return
+	}
+	fmt.Printf("failover to %v:%d failed: %v\n", address.Host, address.Port, err)
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	if c.ReplicationRole() == replication.Role(slave) {
+		slave.Stop()
+		c.setReplicationRole(slave.Promote())
+	}
+}
+
+// abortFailover stops the failover in progress and reports whether there
+// was one.
+func (c *Context) abortFailover() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.failover == nil {
+		return false
+	}
+	select {
+	case <-c.failover.abort:
+	default:
+		close(c.failover.abort)
+	}
+	return true
+}
+
+func (c *Context) failoverState() string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.failover == nil {
+		return failoverNone
+	}
+	return c.failover.state
+}
+
+// wait blocks until the given number of replicas acknowledged the last write
+// of the client.
+func wait(args []resp.RespDataType, _ *execution, writer writer, context *Context) error {
+	if len(args) != 2 {
+		return writer.Write(resp.Error("ERR wrong number of arguments for 'wait' command"))
+	}
+	numOfReplicas, err := strconv.Atoi(resp.String(args[0]))
+	if err != nil {
+		return writer.Write(resp.Error("ERR value is not an integer or out of range"))
 	}
-	master := context.ReplicationRole.(*replication.MasterRole)
-	numOfReplicas = master.Wait(numOfReplicas, time.Duration(timeout)*time.Millisecond)
+	timeout, err := strconv.ParseInt(resp.String(args[1]), 10, 64)
+	if err != nil {
+		return writer.Write(resp.Error("ERR timeout is not an integer or out of range"))
+	}
+	if timeout < 0 {
+		return writer.Write(resp.Error("ERR timeout is negative"))
+	}
+	master, ok := context.ReplicationRole().(*replication.MasterRole)
+	if !ok {
+		return writer.Write(resp.Error("ERR WAIT cannot be used with replica instances. Please also note that since Redis 4.0 if a replica is configured to be writable (which is not the default) writes to replicas are just local and are not propagated."))
+	}
+	var offset uint64
+	if conn, ok := connection(writer).(net.Conn); ok {
+		context.mutex.Lock()
+		offset = context.writeOffsets[conn.RemoteAddr().String()]
+		context.mutex.Unlock()
+	}
+	flush(writer)
+	numOfReplicas = master.Wait(offset, numOfReplicas, time.Duration(timeout)*time.Millisecond)
 	return writer.Write(resp.Integer(numOfReplicas))
 }
 
-func config(args []resp.RespDataType, _ resp.RespDataType, writer writer, context *Context) error {
+func config(args []resp.RespDataType, _ *execution, writer writer, context *Context) error {
 	if len(args) < 2 {
 		return fmt.Errorf("parameters must be specified")
 	}
-	if args[0].(BulkString) != "get" {
+	if !strings.EqualFold(resp.String(args[0]), "get") {
 		return nil
 	}
 	response := make([]resp.RespDataType, 0, len(args[1:])*2)
 	for _, parameter := range args[1:] {
-		key := parameter.(BulkString)
+		key := BulkString(strings.ToLower(resp.String(parameter)))
 		value, ok := context.args.Raw[string(key)]
 		if ok {
 			response = append(response, key, BulkString(value))
 		}
 	}
-	return writer.Write(resp.Array{Content: response})
+	return writer.Write(resp.Map{Content: response})
 }
 
-func keys(args []resp.RespDataType, _ resp.RespDataType, writer writer, context *Context) error {
+func keys(args []resp.RespDataType, _ *execution, writer writer, context *Context) error {
 	if len(args) == 0 {
 		return fmt.Errorf("pattern mus be specified")
 	}
@@ -587,8 +1650,93 @@ func keys(args []resp.RespDataType, _ resp.RespDataType, writer writer, context
 	return writer.Write(resp.Array{Content: keys})
 }
 
+// feedAppendOnly logs an executed write command. Commands are not logged
+// while the append only file itself is replayed, as it is opened afterwards.
+// Caller must hold the write mutex.
+func (c *Context) feedAppendOnly(request resp.RespDataType) {
+	if c.AppendOnly == nil {
+		return
+	}
+	err := c.AppendOnly.Append(request)
+	if err != nil {
+		fmt.Printf("failed to write to append only file: %v\n", err)
+		return
+	}
+	if c.AppendOnly.ShouldRewrite() {
+		c.mutex.Lock()
+		entries := c.snapshot()
+		c.mutex.Unlock()
+		err = c.AppendOnly.Rewrite(entries)
+		if err != nil {
+			fmt.Printf("failed to start automatic append only file rewrite: %v\n", err)
+		}
+	}
+}
+
+func bgrewriteaof(_ []resp.RespDataType, _ *execution, writer writer, context *Context) error {
+	if context.AppendOnly == nil {
+		return writer.Write(resp.Error("ERR Append only file is not enabled"))
+	}
+	context.writeMutex.Lock()
+	context.mutex.Lock()
+	err := context.AppendOnly.Rewrite(context.snapshot())
+	context.mutex.Unlock()
+	context.writeMutex.Unlock()
+	if err != nil {
+		return writer.Write(resp.Error(fmt.Sprintf("ERR %v", err)))
+	}
+	return writer.Write(SimpleString("Background append only file rewriting started"))
+}
+
+func save(_ []resp.RespDataType, _ *execution, writer writer, context *Context) error {
+	context.mutex.Lock()
+	defer context.mutex.Unlock()
+	file, err := writeRdb(context.RdbFilePath(), context.snapshot())
+	if err == nil {
+		err = file.Close()
+	}
+	context.stats.recordSave(err != nil)
+	if err != nil {
+		return writer.Write(resp.Error(fmt.Sprintf("ERR %v", err)))
+	}
+	return writer.Write(SimpleString("OK"))
+}
+
+// writeRdb replaces the RDB file at path with the entries and returns the new
+// file open for reading from the start. A concurrent save replacing the file
+// again doesn't affect what is read from it.
+func writeRdb(path string, entries []rdb.DbEntry) (*os.File, error) {
+	tmp := fmt.Sprintf("%s.tmp-%d", path, time.Now().UnixNano())
+	file, err := os.Create(tmp)
+	if err != nil {
+		return nil, err
+	}
+	writer := bufio.NewWriter(file)
+	err = rdb.Write(writer, entries)
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return nil, err
+	}
+	return file, nil
+}
+
 func multi(_ bool, key string, w writer, c *Context) error {
+	c.mutex.Lock()
 	c.queue[key] = make([]resp.RespDataType, 0)
+	c.mutex.Unlock()
 	return w.Write(resp.SimpleString("OK"))
 }
 
@@ -596,38 +1744,197 @@ func exec(started bool, key string, w writer, c *Context) error {
 	if !started {
 		return w.Write(resp.Error("ERR EXEC without MULTI"))
 	}
+	c.mutex.Lock()
 	queue := c.queue[key]
 	delete(c.queue, key)
+	c.mutex.Unlock()
 	writer := execWriter{
-		buf: make([]resp.RespDataType, 0, len(c.queue)),
+		buf:    make([]resp.RespDataType, 0, len(queue)),
+		client: clientOf(w),
+	}
+	// The write mutex is held for the whole transaction, so its writes are
+	// propagated together, wrapped in MULTI and EXEC.
+	defer c.lockWrites(w)()
+	// The role and the replicas may have changed since the commands were
+	// queued.
+	if isClient(w) && slices.ContainsFunc(queue, func(request resp.RespDataType) bool {
+		r, ok := request.(resp.Array)
+		return ok && len(r.Content) > 0 && c.readOnly(r)
+	}) {
+		return w.Write(resp.Error("READONLY You can't write against a read only replica."))
 	}
+	if isClient(w) && slices.ContainsFunc(queue, func(request resp.RespDataType) bool {
+		r, ok := request.(resp.Array)
+		return ok && len(r.Content) > 0 && c.notEnoughReplicas(r)
+	}) {
+		return w.Write(resp.Error("NOREPLICAS Not enough good replicas to write."))
+	}
+	var propagate []resp.RespDataType
 	for _, comm := range queue {
-		handle(comm, &writer, c)
+		spec, ok := lookup(comm)
+		if !ok {
+			continue
+		}
+		request := execute(spec, comm.(resp.Array), &writer, c)
+		if request != nil {
+			propagate = append(propagate, request)
+		}
+	}
+	if len(propagate) > 0 {
+		c.propagate(resp.Array{Content: []resp.RespDataType{resp.BulkString("MULTI")}})
+		for _, request := range propagate {
+			c.propagate(request)
+		}
+		offset := c.propagate(resp.Array{Content: []resp.RespDataType{resp.BulkString("EXEC")}})
+		if offset > 0 {
+			c.recordWrite(key, offset)
+		}
 	}
 	return w.Write(resp.Array{Content: writer.buf})
 }
 
 func discard(started bool, key string, w writer, c *Context) error {
 	if started {
+		c.mutex.Lock()
 		delete(c.queue, key)
+		c.mutex.Unlock()
 		return w.Write(resp.SimpleString("OK"))
 	} else {
 		return w.Write(resp.Error("ERR DISCARD without MULTI"))
 	}
 }
 
-func replicationInfo(context *Context) BulkString {
-	var builder strings.Builder
-	builder.WriteString("# Replication\r\n")
-	info := make(map[string]string)
-	context.ReplicationRole.CollectInfo(info)
+// subscribedCommands are the commands a client can run once it subscribed
+// to a channel.
+var subscribedCommands = map[string]bool{
+	"subscribe":   true,
+	"unsubscribe": true,
+	"ping":        true,
+}
+
+func (c *Context) subscribed(conn net.Conn) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.subscriptions[conn]) > 0
+}
 
-	for key, value := range info {
-		builder.WriteString(key)
-		builder.WriteByte(':')
-		builder.WriteString(value)
-		builder.WriteByte('\r')
-		builder.WriteByte('\n')
+// subscribe adds the connection to the channels, each one is confirmed with
+// the number of channels the connection is subscribed to.
+func subscribe(args []resp.RespDataType, _ *execution, writer writer, context *Context) error {
+	if len(args) == 0 {
+		return writer.Write(resp.Error("ERR wrong number of arguments for 'subscribe' command"))
+	}
+	conn, ok := connection(writer).(net.Conn)
+	if !ok {
+		return fmt.Errorf("SUBSCRIBE received from a non client connection")
+	}
+	for _, arg := range args {
+		channel := resp.String(arg)
+		context.mutex.Lock()
+		if context.channels[channel] == nil {
+			context.channels[channel] = make(map[net.Conn]bool)
+		}
+		context.channels[channel][conn] = true
+		if context.subscriptions[conn] == nil {
+			context.subscriptions[conn] = make(map[string]bool)
+		}
+		context.subscriptions[conn][channel] = true
+		count := len(context.subscriptions[conn])
+		context.mutex.Unlock()
+		err := writer.Write(subscription("subscribe", channel, count))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unsubscribe removes the connection from the channels, from all of them
+// when none is given.
+func unsubscribe(args []resp.RespDataType, _ *execution, writer writer, context *Context) error {
+	conn, ok := connection(writer).(net.Conn)
+	if !ok {
+		return fmt.Errorf("UNSUBSCRIBE received from a non client connection")
+	}
+	context.mutex.Lock()
+	var channels []string
+	for _, arg := range args {
+		channels = append(channels, resp.String(arg))
+	}
+	if len(channels) == 0 {
+		for channel := range context.subscriptions[conn] {
+			channels = append(channels, channel)
+		}
+	}
+	context.mutex.Unlock()
+	if len(channels) == 0 {
+		return writer.Write(resp.Push{Content: []resp.RespDataType{
+			BulkString("unsubscribe"),
+			NullBulkString{},
+			resp.Integer(0),
+		}})
+	}
+	for _, channel := range channels {
+		context.mutex.Lock()
+		context.unsubscribe(conn, channel)
+		count := len(context.subscriptions[conn])
+		context.mutex.Unlock()
+		err := writer.Write(subscription("unsubscribe", channel, count))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unsubscribe removes the connection from the channel. Caller must hold the
+// mutex.
+func (c *Context) unsubscribe(conn net.Conn, channel string) {
+	delete(c.channels[channel], conn)
+	if len(c.channels[channel]) == 0 {
+		delete(c.channels, channel)
+	}
+	delete(c.subscriptions[conn], channel)
+	if len(c.subscriptions[conn]) == 0 {
+		delete(c.subscriptions, conn)
+	}
+}
+
+func subscription(kind string, channel string, count int) resp.Push {
+	return resp.Push{Content: []resp.RespDataType{
+		BulkString(kind),
+		BulkString(channel),
+		resp.Integer(count),
+	}}
+}
+
+// publish sends the message to the connections subscribed to the channel
+// and replies with their number.
+func publish(args []resp.RespDataType, _ *execution, writer writer, context *Context) error {
+	if len(args) != 2 {
+		return writer.Write(resp.Error("ERR wrong number of arguments for 'publish' command"))
+	}
+	channel := resp.String(args[0])
+	message := resp.Push{Content: []resp.RespDataType{
+		BulkString("message"),
+		BulkString(channel),
+		args[1],
+	}}
+	context.mutex.Lock()
+	subscribers := make([]connectionWriter, 0, len(context.channels[channel]))
+	for conn := range context.channels[channel] {
+		client := context.clients[conn.RemoteAddr().String()]
+		subscribers = append(subscribers, connectionWriter{conn: conn, client: client})
+	}
+	context.mutex.Unlock()
+	for _, subscriber := range subscribers {
+		err := subscriber.Write(message)
+		if err == nil {
+			err = flush(subscriber)
+		}
+		if err != nil {
+			fmt.Printf("failed to publish to %v: %v\n", subscriber.conn.(net.Conn).RemoteAddr(), err)
+		}
 	}
-	return resp.BulkString(builder.String())
+	return writer.Write(resp.Integer(len(subscribers)))
 }
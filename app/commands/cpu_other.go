@@ -0,0 +1,10 @@
+//go:build !unix
+
+package commands
+
+import "time"
+
+// cpuTimes is not available on this platform.
+func cpuTimes() (time.Duration, time.Duration) {
+	return 0, 0
+}
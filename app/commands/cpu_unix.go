@@ -0,0 +1,17 @@
+//go:build unix
+
+package commands
+
+import (
+	"syscall"
+	"time"
+)
+
+// cpuTimes returns the system and user CPU time used by the process.
+func cpuTimes() (time.Duration, time.Duration) {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		return 0, 0
+	}
+	return time.Duration(usage.Stime.Nano()), time.Duration(usage.Utime.Nano())
+}
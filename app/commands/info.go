@@ -0,0 +1,400 @@
+package commands
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/replication"
+	"github.com/codecrafters-io/redis-starter-go/app/resp"
+)
+
+// version is the Redis version whose commands and replies are implemented.
+const version = "7.2.0"
+
+// stats are the counters reported by INFO.
+type stats struct {
+	mutex   sync.Mutex
+	started time.Time
+	// runId identifies this run of the server, unlike the replication id it
+	// doesn't change with the role.
+	runId               string
+	connectionsReceived int64
+	connectedClients    int
+	commandsProcessed   int64
+	commands            map[string]*commandStats
+	// errors counts error replies by their code, the first word of the
+	// message.
+	errors       map[string]int64
+	errorReplies int64
+	// changes counts the writes since the last SAVE.
+	changes        int64
+	lastSave       time.Time
+	lastSaveFailed bool
+}
+
+type commandStats struct {
+	calls int64
+	usec  int64
+	// rejected calls were refused before execution, failed ones replied
+	// with an error.
+	rejected int64
+	failed   int64
+}
+
+func newStats() stats {
+	now := time.Now()
+	return stats{
+		started:  now,
+		runId:    runId(),
+		commands: make(map[string]*commandStats),
+		errors:   make(map[string]int64),
+		lastSave: now,
+	}
+}
+
+func runId() string {
+	id := make([]byte, 20)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// command returns the counters of the command. Caller must hold the mutex.
+func (s *stats) command(name string) *commandStats {
+	name = strings.ToLower(name)
+	stats, ok := s.commands[name]
+	if !ok {
+		stats = &commandStats{}
+		s.commands[name] = stats
+	}
+	return stats
+}
+
+func (s *stats) recordCall(name string, duration time.Duration, failed bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.commandsProcessed += 1
+	stats := s.command(name)
+	stats.calls += 1
+	stats.usec += duration.Microseconds()
+	if failed {
+		stats.failed += 1
+	}
+}
+
+func (s *stats) recordRejected(name string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.command(name).rejected += 1
+}
+
+func (s *stats) recordError(reply resp.Error) {
+	code, _, _ := strings.Cut(string(reply), " ")
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.errors[code] += 1
+	s.errorReplies += 1
+}
+
+func (s *stats) recordChange() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.changes += 1
+}
+
+func (s *stats) recordSave(failed bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.lastSaveFailed = failed
+	if !failed {
+		s.changes = 0
+		s.lastSave = time.Now()
+	}
+}
+
+// reject replies with the error to a command refused before execution.
+func (c *Context) reject(w writer, command string, reply resp.Error) {
+	c.stats.recordRejected(command)
+	c.stats.recordError(reply)
+	_ = w.Write(reply)
+}
+
+type infoSection struct {
+	name string
+	// included in INFO without arguments, commandstats is only returned
+	// when asked for.
+	byDefault bool
+	write     func(*strings.Builder, *Context)
+}
+
+var infoSections = []infoSection{
+	{"server", true, serverInfo},
+	{"clients", true, clientsInfo},
+	{"memory", true, memoryInfo},
+	{"persistence", true, persistenceInfo},
+	{"stats", true, statsInfo},
+	{"replication", true, replicationInfo},
+	{"cpu", true, cpuInfo},
+	{"commandstats", false, commandstatsInfo},
+	{"errorstats", true, errorstatsInfo},
+	{"keyspace", true, keyspaceInfo},
+}
+
+// info replies with the sections asked for, default ones when there are no
+// arguments. all and everything include every section.
+func info(args []resp.RespDataType, _ *execution, writer writer, context *Context) error {
+	requested := make(map[string]bool)
+	for _, arg := range args {
+		requested[strings.ToLower(resp.String(arg))] = true
+	}
+	if len(requested) == 0 {
+		requested["default"] = true
+	}
+	all := requested["all"] || requested["everything"]
+	var builder strings.Builder
+	for _, section := range infoSections {
+		if !all && !requested[section.name] && !(requested["default"] && section.byDefault) {
+			continue
+		}
+		if builder.Len() > 0 {
+			builder.WriteString("\r\n")
+		}
+		section.write(&builder, context)
+	}
+	return writer.Write(resp.VerbatimString{Format: "txt", Content: builder.String()})
+}
+
+func serverInfo(builder *strings.Builder, context *Context) {
+	context.stats.mutex.Lock()
+	started, runId := context.stats.started, context.stats.runId
+	context.stats.mutex.Unlock()
+	executable, _ := os.Executable()
+	uptime := time.Since(started)
+	builder.WriteString("# Server\r\n")
+	writeInfoField(builder, "redis_version", version)
+	writeInfoField(builder, "redis_mode", "standalone")
+	writeInfoField(builder, "os", runtime.GOOS+" "+runtime.GOARCH)
+	writeInfoField(builder, "arch_bits", strconv.Itoa(strconv.IntSize))
+	writeInfoField(builder, "go_version", runtime.Version())
+	writeInfoField(builder, "process_id", strconv.Itoa(os.Getpid()))
+	writeInfoField(builder, "run_id", runId)
+	writeInfoField(builder, "tcp_port", strconv.Itoa(int(context.args.Port)))
+	writeInfoField(builder, "server_time_usec", strconv.FormatInt(time.Now().UnixMicro(), 10))
+	writeInfoField(builder, "uptime_in_seconds", strconv.Itoa(int(uptime.Seconds())))
+	writeInfoField(builder, "uptime_in_days", strconv.Itoa(int(uptime.Hours()/24)))
+	writeInfoField(builder, "executable", executable)
+}
+
+func clientsInfo(builder *strings.Builder, context *Context) {
+	context.stats.mutex.Lock()
+	connected := context.stats.connectedClients
+	context.stats.mutex.Unlock()
+	context.mutex.Lock()
+	pubsub := len(context.subscriptions)
+	context.mutex.Unlock()
+	builder.WriteString("# Clients\r\n")
+	writeInfoField(builder, "connected_clients", strconv.Itoa(connected))
+	writeInfoField(builder, "pubsub_clients", strconv.Itoa(pubsub))
+}
+
+func memoryInfo(builder *strings.Builder, _ *Context) {
+	var memory runtime.MemStats
+	runtime.ReadMemStats(&memory)
+	builder.WriteString("# Memory\r\n")
+	writeInfoField(builder, "used_memory", strconv.FormatUint(memory.HeapAlloc, 10))
+	writeInfoField(builder, "used_memory_human", humanBytes(memory.HeapAlloc))
+	writeInfoField(builder, "used_memory_rss", strconv.FormatUint(memory.Sys, 10))
+	writeInfoField(builder, "used_memory_rss_human", humanBytes(memory.Sys))
+	writeInfoField(builder, "mem_allocator", "go")
+}
+
+func persistenceInfo(builder *strings.Builder, context *Context) {
+	context.stats.mutex.Lock()
+	changes, lastSave, lastSaveFailed := context.stats.changes, context.stats.lastSave, context.stats.lastSaveFailed
+	context.stats.mutex.Unlock()
+	builder.WriteString("# Persistence\r\n")
+	writeInfoField(builder, "loading", "0")
+	writeInfoField(builder, "rdb_changes_since_last_save", strconv.FormatInt(changes, 10))
+	writeInfoField(builder, "rdb_last_save_time", strconv.FormatInt(lastSave.Unix(), 10))
+	if lastSaveFailed {
+		writeInfoField(builder, "rdb_last_bgsave_status", "err")
+	} else {
+		writeInfoField(builder, "rdb_last_bgsave_status", "ok")
+	}
+	if context.AppendOnly != nil {
+		writeInfoField(builder, "aof_enabled", "1")
+	} else {
+		writeInfoField(builder, "aof_enabled", "0")
+	}
+}
+
+func statsInfo(builder *strings.Builder, context *Context) {
+	context.stats.mutex.Lock()
+	connections, processed, errors := context.stats.connectionsReceived, context.stats.commandsProcessed, context.stats.errorReplies
+	context.stats.mutex.Unlock()
+	context.mutex.Lock()
+	channels := len(context.channels)
+	context.mutex.Unlock()
+	builder.WriteString("# Stats\r\n")
+	writeInfoField(builder, "total_connections_received", strconv.FormatInt(connections, 10))
+	writeInfoField(builder, "total_commands_processed", strconv.FormatInt(processed, 10))
+	writeInfoField(builder, "total_error_replies", strconv.FormatInt(errors, 10))
+	writeInfoField(builder, "pubsub_channels", strconv.Itoa(channels))
+}
+
+func cpuInfo(builder *strings.Builder, _ *Context) {
+	system, user := cpuTimes()
+	builder.WriteString("# CPU\r\n")
+	writeInfoField(builder, "used_cpu_sys", fmt.Sprintf("%.6f", system.Seconds()))
+	writeInfoField(builder, "used_cpu_user", fmt.Sprintf("%.6f", user.Seconds()))
+}
+
+func commandstatsInfo(builder *strings.Builder, context *Context) {
+	context.stats.mutex.Lock()
+	defer context.stats.mutex.Unlock()
+	builder.WriteString("# Commandstats\r\n")
+	names := make([]string, 0, len(context.stats.commands))
+	for name := range context.stats.commands {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		stats := context.stats.commands[name]
+		perCall := 0.0
+		if stats.calls > 0 {
+			perCall = float64(stats.usec) / float64(stats.calls)
+		}
+		writeInfoField(builder, "cmdstat_"+name, fmt.Sprintf("calls=%d,usec=%d,usec_per_call=%.2f,rejected_calls=%d,failed_calls=%d",
+			stats.calls, stats.usec, perCall, stats.rejected, stats.failed))
+	}
+}
+
+func errorstatsInfo(builder *strings.Builder, context *Context) {
+	context.stats.mutex.Lock()
+	defer context.stats.mutex.Unlock()
+	builder.WriteString("# Errorstats\r\n")
+	codes := make([]string, 0, len(context.stats.errors))
+	for code := range context.stats.errors {
+		codes = append(codes, code)
+	}
+	slices.Sort(codes)
+	for _, code := range codes {
+		writeInfoField(builder, "errorstat_"+code, fmt.Sprintf("count=%d", context.stats.errors[code]))
+	}
+}
+
+// keyspaceInfo reports the keys that are not expired yet, avg_ttl is the
+// average time to live of the ones with an expiry in milliseconds.
+func keyspaceInfo(builder *strings.Builder, context *Context) {
+	context.mutex.Lock()
+	now := time.Now()
+	var keys, expires int
+	var ttl time.Duration
+	for _, e := range context.storage {
+		if e.expireAt.IsZero() {
+			keys += 1
+		} else if e.expireAt.After(now) {
+			keys += 1
+			expires += 1
+			ttl += e.expireAt.Sub(now)
+		}
+	}
+	context.mutex.Unlock()
+	builder.WriteString("# Keyspace\r\n")
+	if keys == 0 {
+		return
+	}
+	avgTtl := int64(0)
+	if expires > 0 {
+		avgTtl = ttl.Milliseconds() / int64(expires)
+	}
+	writeInfoField(builder, "db0", fmt.Sprintf("keys=%d,expires=%d,avg_ttl=%d", keys, expires, avgTtl))
+}
+
+func replicationInfo(builder *strings.Builder, context *Context) {
+	builder.WriteString("# Replication\r\n")
+	info := make(map[string]string)
+	role := context.ReplicationRole()
+	role.CollectInfo(info)
+	master, ok := role.(*replication.MasterRole)
+	if ok && context.args.MinReplicasToWrite > 0 {
+		info["min_slaves_good_slaves"] = strconv.Itoa(master.GoodReplicas(context.minReplicasMaxLag()))
+	}
+	info["master_failover_state"] = context.failoverState()
+	if _, ok := role.(*replication.SlaveRole); ok {
+		if context.args.ReplicaReadOnly {
+			info["slave_read_only"] = "1"
+		} else {
+			info["slave_read_only"] = "0"
+		}
+	}
+
+	for _, key := range replicationFields {
+		if key == "master_failover_state" {
+			for i := 0; ; i++ {
+				replica := fmt.Sprintf("slave%d", i)
+				if _, ok := info[replica]; !ok {
+					break
+				}
+				writeInfoField(builder, replica, info[replica])
+			}
+		}
+		if value, ok := info[key]; ok {
+			writeInfoField(builder, key, value)
+		}
+	}
+}
+
+// replicationFields lists the fields of INFO replication in the order Redis
+// reports them, the slaveN lines go before master_failover_state.
+var replicationFields = []string{
+	"role",
+	"master_host",
+	"master_port",
+	"master_link_status",
+	"master_last_io_seconds_ago",
+	"master_sync_in_progress",
+	"slave_read_repl_offset",
+	"slave_repl_offset",
+	"master_link_down_since_seconds",
+	"slave_read_only",
+	"connected_slaves",
+	"min_slaves_good_slaves",
+	"master_failover_state",
+	"master_replid",
+	"master_replid2",
+	"master_repl_offset",
+	"second_repl_offset",
+	"repl_backlog_active",
+	"repl_backlog_size",
+	"repl_backlog_first_byte_offset",
+	"repl_backlog_histlen",
+}
+
+func writeInfoField(builder *strings.Builder, key string, value string) {
+	builder.WriteString(key)
+	builder.WriteByte(':')
+	builder.WriteString(value)
+	builder.WriteString("\r\n")
+}
+
+func humanBytes(bytes uint64) string {
+	units := []string{"B", "K", "M", "G", "T"}
+	value := float64(bytes)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit += 1
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%dB", bytes)
+	}
+	return fmt.Sprintf("%.2f%v", value, units[unit])
+}
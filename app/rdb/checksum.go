@@ -0,0 +1,95 @@
+package rdb
+
+import (
+	"bufio"
+	"io"
+)
+
+// Redis uses the reflected Jones polynomial with zero init and no final xor,
+// which hash/crc64 can't express because it always inverts the crc.
+const crc64JonesPolynomial = 0x95ac9329ac4bc9b5
+
+var crc64Table = func() [256]uint64 {
+	var table [256]uint64
+	for i := range table {
+		crc := uint64(i)
+		for range 8 {
+			if crc&1 == 1 {
+				crc = crc>>1 ^ crc64JonesPolynomial
+			} else {
+				crc >>= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+func crc64(crc uint64, p []byte) uint64 {
+	for _, b := range p {
+		crc = crc64Table[byte(crc)^b] ^ crc>>8
+	}
+	return crc
+}
+
+// checksumReader computes the checksum of everything read so far. The last
+// read byte is kept aside until the next read so that UnreadByte can drop it.
+type checksumReader struct {
+	reader     *bufio.Reader
+	crc        uint64
+	pending    byte
+	hasPending bool
+}
+
+func (r *checksumReader) Read(p []byte) (int, error) {
+	r.commit()
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		r.crc = crc64(r.crc, p[:n-1])
+		r.pending = p[n-1]
+		r.hasPending = true
+	}
+	return n, err
+}
+
+func (r *checksumReader) ReadByte() (byte, error) {
+	r.commit()
+	b, err := r.reader.ReadByte()
+	if err == nil {
+		r.pending = b
+		r.hasPending = true
+	}
+	return b, err
+}
+
+func (r *checksumReader) UnreadByte() error {
+	err := r.reader.UnreadByte()
+	if err == nil {
+		r.hasPending = false
+	}
+	return err
+}
+
+func (r *checksumReader) sum() uint64 {
+	r.commit()
+	return r.crc
+}
+
+func (r *checksumReader) commit() {
+	if r.hasPending {
+		r.crc = crc64(r.crc, []byte{r.pending})
+		r.hasPending = false
+	}
+}
+
+// checksumWriter computes the checksum of everything written so far.
+type checksumWriter struct {
+	writer io.Writer
+	crc    uint64
+}
+
+func (w *checksumWriter) Write(p []byte) (int, error) {
+	n, err := w.writer.Write(p)
+	w.crc = crc64(w.crc, p[:n])
+	return n, err
+}
@@ -0,0 +1,224 @@
+package rdb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+const (
+	listpackHeaderSize    = 6
+	listpackEndByte       = 0xff
+	listpackUnknownLength = 65535
+)
+
+type listpackWriter struct {
+	entries []byte
+	count   int
+}
+
+func (l *listpackWriter) appendInt(v int64) {
+	var encoded []byte
+	switch {
+	case v >= 0 && v <= 127:
+		encoded = []byte{byte(v)}
+	case v >= -4096 && v <= 4095:
+		u := uint64(v) & 0x1fff
+		encoded = []byte{0xc0 | byte(u>>8), byte(u)}
+	case v >= math.MinInt16 && v <= math.MaxInt16:
+		encoded = binary.LittleEndian.AppendUint16([]byte{0xf1}, uint16(v))
+	case v >= -(1<<23) && v < 1<<23:
+		u := uint32(v)
+		encoded = []byte{0xf2, byte(u), byte(u >> 8), byte(u >> 16)}
+	case v >= math.MinInt32 && v <= math.MaxInt32:
+		encoded = binary.LittleEndian.AppendUint32([]byte{0xf3}, uint32(v))
+	default:
+		encoded = binary.LittleEndian.AppendUint64([]byte{0xf4}, uint64(v))
+	}
+	l.append(encoded)
+}
+
+// appendString stores integer looking strings as integers the same way
+// Redis does, so the encoded listpack matches the one Redis would produce.
+func (l *listpackWriter) appendString(s string) {
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err == nil && strconv.FormatInt(v, 10) == s {
+		l.appendInt(v)
+		return
+	}
+	var encoded []byte
+	switch length := len(s); {
+	case length < 64:
+		encoded = []byte{0x80 | byte(length)}
+	case length < 4096:
+		encoded = []byte{0xe0 | byte(length>>8), byte(length)}
+	default:
+		encoded = binary.LittleEndian.AppendUint32([]byte{0xf0}, uint32(length))
+	}
+	l.append(append(encoded, s...))
+}
+
+func (l *listpackWriter) append(encoded []byte) {
+	l.entries = append(l.entries, encoded...)
+	l.entries = appendBacklen(l.entries, uint64(len(encoded)))
+	l.count += 1
+}
+
+func (l *listpackWriter) bytes() []byte {
+	total := listpackHeaderSize + len(l.entries) + 1
+	bytes := make([]byte, 0, total)
+	bytes = binary.LittleEndian.AppendUint32(bytes, uint32(total))
+	count := l.count
+	if count >= listpackUnknownLength {
+		count = listpackUnknownLength
+	}
+	bytes = binary.LittleEndian.AppendUint16(bytes, uint16(count))
+	bytes = append(bytes, l.entries...)
+	return append(bytes, listpackEndByte)
+}
+
+// appendBacklen writes the entry length so that it can be decoded right to
+// left: the most significant 7 bits come first and every byte but the
+// first one has the high bit set.
+func appendBacklen(bytes []byte, length uint64) []byte {
+	size := backlenSize(length)
+	for i := size - 1; i >= 0; i-- {
+		b := byte(length>>(7*i)) & 127
+		if i != size-1 {
+			b |= 128
+		}
+		bytes = append(bytes, b)
+	}
+	return bytes
+}
+
+func backlenSize(length uint64) int {
+	switch {
+	case length <= 127:
+		return 1
+	case length < 16383:
+		return 2
+	case length < 2097151:
+		return 3
+	case length < 268435455:
+		return 4
+	default:
+		return 5
+	}
+}
+
+type listpackReader struct {
+	data []byte
+	pos  int
+}
+
+type listpackValue struct {
+	str   []byte
+	num   int64
+	isInt bool
+}
+
+func (v listpackValue) String() string {
+	if v.isInt {
+		return strconv.FormatInt(v.num, 10)
+	}
+	return string(v.str)
+}
+
+func newListpackReader(data []byte) (*listpackReader, error) {
+	if len(data) < listpackHeaderSize+1 {
+		return nil, fmt.Errorf("listpack is too short: %d bytes", len(data))
+	}
+	total := binary.LittleEndian.Uint32(data)
+	if int(total) != len(data) {
+		return nil, fmt.Errorf("listpack size mismatch: header %d, actual %d", total, len(data))
+	}
+	if data[len(data)-1] != listpackEndByte {
+		return nil, fmt.Errorf("listpack end byte is missing")
+	}
+	return &listpackReader{data: data, pos: listpackHeaderSize}, nil
+}
+
+func (r *listpackReader) next() (listpackValue, error) {
+	var value listpackValue
+	if r.pos >= len(r.data) || r.data[r.pos] == listpackEndByte {
+		return value, fmt.Errorf("unexpected end of listpack")
+	}
+	start := r.pos
+	first := r.data[start]
+	header := 1
+	var length int
+	switch {
+	case first&0x80 == 0:
+		value = listpackValue{num: int64(first & 0x7f), isInt: true}
+	case first&0xc0 == 0x80:
+		length = int(first & 0x3f)
+	case first&0xe0 == 0xc0:
+		if err := r.require(start, 2); err != nil {
+			return value, err
+		}
+		u := int64(first&0x1f)<<8 | int64(r.data[start+1])
+		if u >= 1<<12 {
+			u -= 1 << 13
+		}
+		value = listpackValue{num: u, isInt: true}
+		header = 2
+	case first&0xf0 == 0xe0:
+		if err := r.require(start, 2); err != nil {
+			return value, err
+		}
+		length = int(first&0x0f)<<8 | int(r.data[start+1])
+		header = 2
+	case first == 0xf0:
+		if err := r.require(start, 5); err != nil {
+			return value, err
+		}
+		length = int(binary.LittleEndian.Uint32(r.data[start+1:]))
+		header = 5
+	case first >= 0xf1 && first <= 0xf4:
+		size := map[byte]int{0xf1: 2, 0xf2: 3, 0xf3: 4, 0xf4: 8}[first]
+		if err := r.require(start, 1+size); err != nil {
+			return value, err
+		}
+		var u uint64
+		for i := size - 1; i >= 0; i-- {
+			u = u<<8 | uint64(r.data[start+1+i])
+		}
+		shift := 64 - 8*size
+		value = listpackValue{num: int64(u<<shift) >> shift, isInt: true}
+		header = 1 + size
+	default:
+		return value, fmt.Errorf("unknown listpack encoding: %x", first)
+	}
+	if !value.isInt {
+		if err := r.require(start, header+length); err != nil {
+			return value, err
+		}
+		value.str = r.data[start+header : start+header+length]
+	}
+	entryLen := header + length
+	r.pos = start + entryLen + backlenSize(uint64(entryLen))
+	if r.pos >= len(r.data) {
+		return value, fmt.Errorf("listpack entry overflows the listpack")
+	}
+	return value, nil
+}
+
+func (r *listpackReader) nextInt() (int64, error) {
+	value, err := r.next()
+	if err != nil {
+		return 0, err
+	}
+	if value.isInt {
+		return value.num, nil
+	}
+	return strconv.ParseInt(string(value.str), 10, 64)
+}
+
+func (r *listpackReader) require(start int, size int) error {
+	if start+size > len(r.data)-1 {
+		return fmt.Errorf("listpack entry overflows the listpack")
+	}
+	return nil
+}
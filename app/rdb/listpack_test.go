@@ -0,0 +1,79 @@
+package rdb
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestListpackRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []string
+	}{
+		{"empty", nil},
+		{"7 bit uint", []string{"0", "1", "127"}},
+		{"13 bit int", []string{"128", "-1", "-4096", "4095"}},
+		{"16 bit int", []string{"4096", "-4097", "32767", "-32768"}},
+		{"24 bit int", []string{"32768", "-32769", "8388607", "-8388608"}},
+		{"32 bit int", []string{"8388608", "-8388609", "2147483647", "-2147483648"}},
+		{"64 bit int", []string{"2147483648", "-2147483649", "9223372036854775807", "-9223372036854775808"}},
+		{"integer lookalikes", []string{"007", "-0", "+1", "1.5", " 1", "9223372036854775808"}},
+		{"short strings", []string{"", "a", "field", strings.Repeat("x", 63)}},
+		{"12 bit strings", []string{strings.Repeat("x", 64), strings.Repeat("y", 4095)}},
+		{"32 bit strings", []string{strings.Repeat("z", 4096), strings.Repeat("w", 70000)}},
+		{"binary", []string{"\x00\xff\r\n", "\xc3\x28"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var lp listpackWriter
+			for _, value := range test.values {
+				lp.appendString(value)
+			}
+			// The terminator check needs at least one entry after the values.
+			lp.appendInt(math.MinInt64)
+			reader, err := newListpackReader(lp.bytes())
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, want := range test.values {
+				got, err := reader.next()
+				if err != nil {
+					t.Fatalf("next() #%d failed: %v", i, err)
+				}
+				if got.String() != want {
+					t.Errorf("next() #%d = %q, want %q", i, got.String(), want)
+				}
+			}
+			last, err := reader.nextInt()
+			if err != nil || last != math.MinInt64 {
+				t.Errorf("nextInt() = %d, %v, want %d", last, err, int64(math.MinInt64))
+			}
+			if _, err := reader.next(); err == nil {
+				t.Errorf("next() past the end succeeded")
+			}
+		})
+	}
+}
+
+func TestListpackRejectsCorruption(t *testing.T) {
+	var lp listpackWriter
+	lp.appendString("value")
+	lp.appendInt(1)
+	valid := lp.bytes()
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"too short", valid[:4]},
+		{"size mismatch", valid[:len(valid)-1]},
+		{"missing end byte", append(valid[:len(valid)-1:len(valid)-1], 0)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := newListpackReader(test.data); err == nil {
+				t.Errorf("newListpackReader(%x) succeeded", test.data)
+			}
+		})
+	}
+}
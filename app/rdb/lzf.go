@@ -0,0 +1,59 @@
+package rdb
+
+import "fmt"
+
+// lzfMaxExpansion is the most output a byte of LZF input can produce: a
+// long back reference takes 3 bytes and copies up to 264.
+const lzfMaxExpansion = 88
+
+// lzfDecompress expands strings compressed by Redis with LZF. The length
+// stored in the file is only trusted once it's possible for the input.
+func lzfDecompress(in []byte, length int) ([]byte, error) {
+	if length > len(in)*lzfMaxExpansion {
+		return nil, fmt.Errorf("lzf decompressed length %d is impossible for %d compressed bytes", length, len(in))
+	}
+	out := make([]byte, 0, length)
+	for i := 0; i < len(in); {
+		ctrl := int(in[i])
+		i += 1
+		if ctrl < 1<<5 {
+			ctrl += 1
+			if i+ctrl > len(in) {
+				return nil, fmt.Errorf("lzf literal run overflows input")
+			}
+			if len(out)+ctrl > length {
+				return nil, fmt.Errorf("lzf output overflows the decompressed length %d", length)
+			}
+			out = append(out, in[i:i+ctrl]...)
+			i += ctrl
+			continue
+		}
+		backrefLen := ctrl >> 5
+		ref := len(out) - ((ctrl & 0x1f) << 8) - 1
+		if backrefLen == 7 {
+			if i >= len(in) {
+				return nil, fmt.Errorf("lzf back reference overflows input")
+			}
+			backrefLen += int(in[i])
+			i += 1
+		}
+		if i >= len(in) {
+			return nil, fmt.Errorf("lzf back reference overflows input")
+		}
+		ref -= int(in[i])
+		i += 1
+		if ref < 0 {
+			return nil, fmt.Errorf("lzf back reference points before output")
+		}
+		if len(out)+backrefLen+2 > length {
+			return nil, fmt.Errorf("lzf output overflows the decompressed length %d", length)
+		}
+		for j := 0; j < backrefLen+2; j++ {
+			out = append(out, out[ref+j])
+		}
+	}
+	if len(out) != length {
+		return nil, fmt.Errorf("lzf decompressed length mismatch: expected %d, got %d", length, len(out))
+	}
+	return out, nil
+}
@@ -0,0 +1,44 @@
+package rdb
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLzfDecompress(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		length  int
+		want    string
+		wantErr bool
+	}{
+		{name: "literal", in: "\x02abc", length: 3, want: "abc"},
+		{name: "short back reference", in: "\x02abc\x80\x02", length: 9, want: "abcabcabc"},
+		{name: "long back reference", in: "\x00a\xe0\xbf\x00", length: 201, want: strings.Repeat("a", 201)},
+		{name: "shorter than length", in: "\x02abc", length: 4, wantErr: true},
+		{name: "literal past length", in: "\x02abc", length: 2, wantErr: true},
+		{name: "back reference past length", in: "\x02abc\x80\x02", length: 8, wantErr: true},
+		{name: "impossible length", in: "\x02abc", length: 1 << 30, wantErr: true},
+		{name: "literal past input", in: "\x05abc", length: 6, wantErr: true},
+		{name: "back reference before output", in: "\x00a\x20\x05", length: 4, wantErr: true},
+		{name: "back reference past input", in: "\x00a\xe0", length: 12, wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := lzfDecompress([]byte(test.in), test.length)
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("lzfDecompress(%q, %d) = %q, want an error", test.in, test.length, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("lzfDecompress(%q, %d) failed: %v", test.in, test.length, err)
+			}
+			if string(got) != test.want {
+				t.Errorf("lzfDecompress(%q, %d) = %q, want %q", test.in, test.length, got, test.want)
+			}
+		})
+	}
+}
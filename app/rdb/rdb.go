@@ -5,12 +5,13 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
-	"hash/crc64"
 	"io"
+	"math"
 	"strconv"
 	"time"
 
 	"github.com/codecrafters-io/redis-starter-go/app/resp"
+	"github.com/codecrafters-io/redis-starter-go/app/stream"
 )
 
 const (
@@ -23,6 +24,9 @@ const (
 	int8Mask            = 0b11000000
 	int16Mask           = 0b11000001
 	int32Mask           = 0b11000010
+	lzfMask             = 0b11000011
+	int32LenByte        = 0x80
+	int64LenByte        = 0x81
 )
 
 const (
@@ -31,38 +35,86 @@ const (
 	auxSectionByte       = 0xfa
 	dbSectionByte        = 0xfe
 	resizedbByte         = 0xfb
+	freqByte             = 0xf9
+	idleByte             = 0xf8
 	eofByte              = 0xff
 )
 
+const (
+	magicString     = "REDIS"
+	minVersion      = 1
+	maxVersion      = 11
+	checksumVersion = 5
+)
+
 const (
 	stringValueTypeByte = 0x0
 )
 
+const (
+	// maxStringLength is the longest string accepted, like the default
+	// proto-max-bulk-len, longer lengths are taken as corruption.
+	maxStringLength = 512 * 1024 * 1024
+	// stringChunkSize is how much of a string is allocated at a time, so a
+	// corrupted length fails at the end of the file rather than allocating.
+	stringChunkSize = 64 * 1024
+)
+
 func Empty() ([]byte, error) {
+	return Encode(nil)
+}
+
+// Write encodes the entries as an RDB snapshot to w. Entries are encoded
+// one at a time, so only the largest one is held in memory.
+func Write(w io.Writer, entries []DbEntry) error {
+	out := &checksumWriter{writer: w}
 	buffer := bytes.NewBuffer([]byte{})
-	_, err := buffer.Write([]byte("REDIS0011"))
+	_, err := buffer.Write([]byte(fmt.Sprintf("%s%04d", magicString, maxVersion)))
 	if err != nil {
-		return nil, err
+		return err
 	}
 	err = writeAUX(buffer, map[string]interface{}{
 		"redis-ver":  "7.2.0",
 		"redis-bits": 64,
-		"ctime":      1829289061,
+		"ctime":      int(time.Now().Unix()),
 		"used-mem":   2965639168,
 		"aof-base":   0,
 	})
 	if err != nil {
-		return nil, err
+		return err
+	}
+	if len(entries) > 0 {
+		writeDBHeader(buffer, entries)
+	}
+	for _, entry := range entries {
+		_, err = buffer.WriteTo(out)
+		if err != nil {
+			return err
+		}
+		err = writeEntry(buffer, entry)
+		if err != nil {
+			return err
+		}
 	}
-	err = buffer.WriteByte(0xFF)
+	err = buffer.WriteByte(eofByte)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	_, err = buffer.WriteTo(out)
+	if err != nil {
+		return err
 	}
-	bytes, err := appendChecksum(buffer)
+	_, err = w.Write(binary.LittleEndian.AppendUint64(nil, out.crc))
+	return err
+}
+
+func Encode(entries []DbEntry) ([]byte, error) {
+	var buffer bytes.Buffer
+	err := Write(&buffer, entries)
 	if err != nil {
 		return nil, err
 	}
-	return bytes, nil
+	return buffer.Bytes(), nil
 }
 
 func writeAUX(buffer *bytes.Buffer, fields map[string]interface{}) error {
@@ -77,7 +129,11 @@ func writeAUX(buffer *bytes.Buffer, fields map[string]interface{}) error {
 		}
 		switch v := value.(type) {
 		case int:
-			_, err = buffer.Write(encodeUInt32(uint32(v)))
+			if v >= 0 && v <= math.MaxInt32 {
+				_, err = buffer.Write(encodeUInt32(uint32(v)))
+			} else {
+				err = writeString(strconv.Itoa(v), buffer)
+			}
 		case string:
 			err = writeString(v, buffer)
 		default:
@@ -90,8 +146,53 @@ func writeAUX(buffer *bytes.Buffer, fields map[string]interface{}) error {
 	return nil
 }
 
+func writeDBHeader(buffer *bytes.Buffer, entries []DbEntry) {
+	var expires uint64
+	for _, entry := range entries {
+		if !entry.ExpireAt.IsZero() {
+			expires += 1
+		}
+	}
+	buffer.WriteByte(dbSectionByte)
+	buffer.Write(encodeLen(0))
+	buffer.WriteByte(resizedbByte)
+	buffer.Write(encodeLen(uint64(len(entries))))
+	buffer.Write(encodeLen(expires))
+}
+
+func writeEntry(buffer *bytes.Buffer, entry DbEntry) error {
+	if !entry.ExpireAt.IsZero() {
+		buffer.WriteByte(unixTimestampMsByte)
+		buffer.Write(binary.LittleEndian.AppendUint64(nil, uint64(entry.ExpireAt.UnixMilli())))
+	}
+	var err error
+	switch v := entry.Value.(type) {
+	case *stream.Stream:
+		buffer.WriteByte(streamListpacks3TypeByte)
+		err = writeString(string(entry.Key), buffer)
+		if err == nil {
+			err = writeStream(v, streamListpacks3TypeByte, buffer)
+		}
+	case string:
+		buffer.WriteByte(stringValueTypeByte)
+		err = writeString(string(entry.Key), buffer)
+		if err == nil {
+			err = writeString(v, buffer)
+		}
+	case resp.RespDataType:
+		buffer.WriteByte(stringValueTypeByte)
+		err = writeString(string(entry.Key), buffer)
+		if err == nil {
+			err = writeString(resp.String(v), buffer)
+		}
+	default:
+		err = fmt.Errorf("unexpected db entry value type: %T", entry.Value)
+	}
+	return err
+}
+
 func writeString(s string, buffer *bytes.Buffer) error {
-	_, err := buffer.Write(encodeLen(int32(len(s))))
+	_, err := buffer.Write(encodeLen(uint64(len(s))))
 	if err != nil {
 		return err
 	}
@@ -99,136 +200,125 @@ func writeString(s string, buffer *bytes.Buffer) error {
 	return err
 }
 
-func encodeLen(len int32) []byte {
+func encodeLen(len uint64) []byte {
 	if len <= 63 {
 		return []byte{byte(len)}
 	} else if len <= 16383 {
 		return []byte{twoByteIntMask | byte(len>>8), byte(len & 0b11111111)}
-	} else {
+	} else if len <= 0xffffffff {
 		var bytes [5]byte
-		bytes[0] = fourByteIntMask
+		bytes[0] = int32LenByte
 		binary.BigEndian.PutUint32(bytes[1:], uint32(len))
 		return bytes[:]
+	} else {
+		var bytes [9]byte
+		bytes[0] = int64LenByte
+		binary.BigEndian.PutUint64(bytes[1:], len)
+		return bytes[:]
 	}
 }
 
 func encodeUInt32(num uint32) []byte {
-	if num <= 255 {
-		return []byte{specialFormatMask, byte(num)}
-	} else if num <= 65535 {
+	if num <= 127 {
+		return []byte{int8Mask, byte(num)}
+	} else if num <= 32767 {
 		var bytes [3]byte
-		bytes[0] = specialFormatMask | 1
-		binary.BigEndian.PutUint16(bytes[1:], uint16(num))
+		bytes[0] = int16Mask
+		binary.LittleEndian.PutUint16(bytes[1:], uint16(num))
 		return bytes[:]
 	} else {
 		var bytes [5]byte
-		bytes[0] = specialFormatMask | 2
-		binary.BigEndian.PutUint32(bytes[1:], num)
+		bytes[0] = int32Mask
+		binary.LittleEndian.PutUint32(bytes[1:], num)
 		return bytes[:]
 	}
 }
 
-func appendChecksum(buf *bytes.Buffer) ([]byte, error) {
-	checksum := crc64.Checksum(buf.Bytes(), crc64.MakeTable(crc64.ECMA))
-	bytes := binary.BigEndian.AppendUint64(buf.Bytes(), checksum)
-	return bytes, nil
-}
-
 type ReadStrategy interface {
 	AddDbEntry(DbEntry)
 	AddAux(key string, value resp.RespDataType)
 }
 
+// DbEntry value is either a string encoded resp.RespDataType or a *stream.Stream.
 type DbEntry struct {
 	Key      resp.BulkString
-	Value    resp.RespDataType
+	Value    interface{}
 	ExpireAt time.Time
 }
 
-func Read(reader *bufio.Reader, strategy ReadStrategy) error {
+// Read decodes the whole RDB file before returning, so a truncated file or
+// a file with a wrong checksum is reported as an error instead of io.EOF.
+func Read(reader *bufio.Reader, strategy ReadStrategy, verifyChecksum bool) error {
+	r := &checksumReader{reader: reader}
 	var header [9]byte
-	_, err := io.ReadFull(reader, header[:])
+	_, err := io.ReadFull(r, header[:])
 	if err != nil {
-		return err
+		return unexpectedEOF(err)
 	}
-	fmt.Printf("reading RDB file version: %s\n", string(header[5:]))
-	err = decodeMetadata(reader, strategy)
-	if err != nil {
-		return err
+	if string(header[:5]) != magicString {
+		return fmt.Errorf("wrong signature trying to load DB from file: %q", header[:5])
 	}
-	for {
-		err = decodeDBSection(reader, strategy)
-		if err == io.EOF {
-			return nil
-		}
-		if err != nil {
-			return err
-		}
+	version, err := strconv.Atoi(string(header[5:]))
+	if err != nil || version < minVersion || version > maxVersion {
+		return fmt.Errorf("can't handle RDB format version %s", header[5:])
 	}
-}
-
-func decodeMetadata(reader *bufio.Reader, strategy ReadStrategy) error {
-	for {
-		firstByte, err := reader.ReadByte()
-		if err != nil {
-			return err
-		}
-		if firstByte != auxSectionByte {
-			reader.UnreadByte()
-			fmt.Printf("Metadata section ended\n")
-			return nil
-		}
-		fmt.Printf("Reading metadata\n")
-		key, err := decodeString(reader)
-		if err != nil {
-			return err
-		}
-		value, err := decodeString(reader)
-		if err != nil {
-			return err
-		}
-		fmt.Printf("AUX key: %v, value: %v\n", key, value)
-		strategy.AddAux(string(key.(resp.BulkString)), value)
-	}
-}
-
-func decodeDBSection(reader *bufio.Reader, strategy ReadStrategy) error {
-	sectionByte, err := reader.ReadByte()
+	err = decodeSections(r, strategy)
 	if err != nil {
-		return err
+		return unexpectedEOF(err)
 	}
-	if sectionByte != dbSectionByte {
-		return fmt.Errorf("expect db section byte %x, got: %x", dbSectionByte, sectionByte)
+	if version < checksumVersion {
+		return nil
 	}
-	index, err := reader.ReadByte()
+	expected := r.sum()
+	var checksum [8]byte
+	_, err = io.ReadFull(reader, checksum[:])
 	if err != nil {
-		return err
+		return unexpectedEOF(err)
 	}
-	fmt.Printf("Decodig db at index %d\n", index)
-	field, err := reader.ReadByte()
-	if err != nil {
-		return err
-	}
-	if field != resizedbByte {
-		return fmt.Errorf("resizedb field expected")
-	}
-	keyValueTableSize, err := decodeLenEncoded(reader)
-	if err != nil {
-		return err
+	stored := binary.LittleEndian.Uint64(checksum[:])
+	if !verifyChecksum || stored == 0 {
+		return nil
 	}
-	expireTableSize, err := decodeLenEncoded(reader)
-	if err != nil {
-		return err
+	if stored != expected {
+		return fmt.Errorf("wrong RDB checksum expected: %016x got: %016x", stored, expected)
 	}
-	fmt.Printf("Key-value table size: %v, expire table size %v\n", keyValueTableSize, expireTableSize)
+	return nil
+}
 
+func decodeSections(reader *checksumReader, strategy ReadStrategy) error {
 	var expireAt time.Time
 	for {
-		firstByte, err := reader.ReadByte()
+		opcode, err := reader.ReadByte()
 		if err != nil {
 			return err
 		}
-		switch firstByte {
+		switch opcode {
+		case auxSectionByte:
+			key, err := decodeString(reader)
+			if err != nil {
+				return err
+			}
+			value, err := decodeString(reader)
+			if err != nil {
+				return err
+			}
+			strategy.AddAux(resp.String(key), value)
+		case dbSectionByte:
+			// Only one database is supported, the index is skipped.
+			_, err := decodeLen(reader)
+			if err != nil {
+				return err
+			}
+		case resizedbByte:
+			// The table sizes are only hints.
+			_, err := decodeLen(reader)
+			if err != nil {
+				return err
+			}
+			_, err = decodeLen(reader)
+			if err != nil {
+				return err
+			}
 		case unixTimestampSecByte:
 			var bytes [4]byte
 			_, err := io.ReadFull(reader, bytes[:])
@@ -245,33 +335,52 @@ func decodeDBSection(reader *bufio.Reader, strategy ReadStrategy) error {
 			}
 			ms := binary.LittleEndian.Uint64(bytes[:])
 			expireAt = time.UnixMilli(int64(ms))
-		case stringValueTypeByte:
+		case idleByte:
+			_, err := decodeLen(reader)
+			if err != nil {
+				return err
+			}
+		case freqByte:
+			_, err := reader.ReadByte()
+			if err != nil {
+				return err
+			}
+		case stringValueTypeByte, streamListpacksTypeByte, streamListpacks2TypeByte, streamListpacks3TypeByte:
 			key, err := decodeString(reader)
 			if err != nil {
 				return err
 			}
-			value, err := decodeString(reader)
+			var value interface{}
+			if opcode == stringValueTypeByte {
+				value, err = decodeString(reader)
+			} else {
+				value, err = decodeStream(reader, opcode)
+			}
 			if err != nil {
 				return err
 			}
-			fmt.Printf("DB entity key: %v, value: %v, expires: %v\n", key, value, expireAt)
 			strategy.AddDbEntry(DbEntry{
-				Key:      key.(resp.BulkString),
+				Key:      resp.BulkString(resp.String(key)),
 				Value:    value,
 				ExpireAt: expireAt,
 			})
-		case dbSectionByte:
-			reader.UnreadByte()
-			return nil
+			expireAt = time.Time{}
 		case eofByte:
-			return io.EOF
+			return nil
 		default:
-			return fmt.Errorf("unsupported value type: %d", firstByte)
+			return fmt.Errorf("unsupported value type: %d", opcode)
 		}
 	}
 }
 
-func decodeString(reader *bufio.Reader) (resp.RespDataType, error) {
+func unexpectedEOF(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("unexpected end of RDB file")
+	}
+	return err
+}
+
+func decodeString(reader *checksumReader) (resp.RespDataType, error) {
 	length, err := decodeLenEncoded(reader)
 	_, ok := err.(specialFormatEncoding)
 	if ok {
@@ -279,8 +388,7 @@ func decodeString(reader *bufio.Reader) (resp.RespDataType, error) {
 	} else if err != nil {
 		return nil, err
 	} else {
-		bytes := make([]byte, length.(resp.Integer))
-		_, err = io.ReadFull(reader, bytes)
+		bytes, err := readString(reader, uint64(length.(resp.Integer)))
 		if err != nil {
 			return nil, err
 		}
@@ -288,7 +396,27 @@ func decodeString(reader *bufio.Reader) (resp.RespDataType, error) {
 	}
 }
 
-func decodeLenEncoded(reader *bufio.Reader) (resp.RespDataType, error) {
+// readString reads a string of the length, failing when the length is not
+// sane or the input ends before the string does.
+func readString(reader *checksumReader, length uint64) ([]byte, error) {
+	if length > maxStringLength {
+		return nil, fmt.Errorf("invalid string length: %d", length)
+	}
+	var buf bytes.Buffer
+	buf.Grow(int(min(length, stringChunkSize)))
+	for uint64(buf.Len()) < length {
+		_, err := io.CopyN(&buf, reader, int64(min(length-uint64(buf.Len()), stringChunkSize)))
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeLenEncoded(reader *checksumReader) (resp.RespDataType, error) {
 	firstByte, err := reader.ReadByte()
 	if err != nil {
 		return nil, err
@@ -304,12 +432,24 @@ func decodeLenEncoded(reader *bufio.Reader) (resp.RespDataType, error) {
 		i := int32(secondByte) + ((int32(firstByte) & firstBytePrefixMask) << 8)
 		return resp.Integer(i), nil
 	case fourByteIntMask:
-		var lengthBytes [4]byte
-		_, err := io.ReadFull(reader, lengthBytes[:])
-		if err != nil {
-			return nil, nil
+		switch firstByte {
+		case int32LenByte:
+			var lengthBytes [4]byte
+			_, err := io.ReadFull(reader, lengthBytes[:])
+			if err != nil {
+				return nil, err
+			}
+			return resp.Integer(binary.BigEndian.Uint32(lengthBytes[:])), nil
+		case int64LenByte:
+			var lengthBytes [8]byte
+			_, err := io.ReadFull(reader, lengthBytes[:])
+			if err != nil {
+				return nil, err
+			}
+			return resp.Integer(binary.BigEndian.Uint64(lengthBytes[:])), nil
+		default:
+			return nil, fmt.Errorf("unknown length encoding: %x", firstByte)
 		}
-		return resp.Integer(int32(binary.BigEndian.Uint32(lengthBytes[:]))), nil
 	case specialFormatMask:
 		err := reader.UnreadByte()
 		if err != nil {
@@ -321,7 +461,16 @@ func decodeLenEncoded(reader *bufio.Reader) (resp.RespDataType, error) {
 	}
 }
 
-func decodeSpecialFormat(reader *bufio.Reader) (resp.RespDataType, error) {
+// decodeLen reads a length that must not use a special format encoding.
+func decodeLen(reader *checksumReader) (uint64, error) {
+	length, err := decodeLenEncoded(reader)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(length.(resp.Integer)), nil
+}
+
+func decodeSpecialFormat(reader *checksumReader) (resp.RespDataType, error) {
 	firstByte, err := reader.ReadByte()
 	if err != nil {
 		return nil, err
@@ -332,21 +481,42 @@ func decodeSpecialFormat(reader *bufio.Reader) (resp.RespDataType, error) {
 		if err != nil {
 			return nil, err
 		}
-		return resp.Integer(int32(next)), nil
+		return resp.Integer(int8(next)), nil
 	case int16Mask:
 		var bytes [2]byte
 		_, err := io.ReadFull(reader, bytes[:])
 		if err != nil {
 			return nil, err
 		}
-		return resp.Integer(int32(binary.BigEndian.Uint16(bytes[:]))), nil
+		return resp.Integer(int16(binary.LittleEndian.Uint16(bytes[:]))), nil
 	case int32Mask:
 		var bytes [4]byte
 		_, err := io.ReadFull(reader, bytes[:])
 		if err != nil {
 			return nil, err
 		}
-		return resp.Integer(int32(binary.BigEndian.Uint32(bytes[:]))), nil
+		return resp.Integer(int32(binary.LittleEndian.Uint32(bytes[:]))), nil
+	case lzfMask:
+		compressedLen, err := decodeLen(reader)
+		if err != nil {
+			return nil, err
+		}
+		len, err := decodeLen(reader)
+		if err != nil {
+			return nil, err
+		}
+		if len > maxStringLength {
+			return nil, fmt.Errorf("invalid string length: %d", len)
+		}
+		compressed, err := readString(reader, compressedLen)
+		if err != nil {
+			return nil, err
+		}
+		bytes, err := lzfDecompress(compressed, int(len))
+		if err != nil {
+			return nil, err
+		}
+		return resp.BulkString(bytes), nil
 	default:
 		return nil, fmt.Errorf("unsupported string encoding: %d", firstByte)
 	}
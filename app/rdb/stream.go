@@ -0,0 +1,417 @@
+package rdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"slices"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/resp"
+	"github.com/codecrafters-io/redis-starter-go/app/stream"
+)
+
+const (
+	streamListpacksTypeByte  = 15
+	streamListpacks2TypeByte = 19
+	streamListpacks3TypeByte = 21
+)
+
+const (
+	streamItemFlagDeleted    = 1
+	streamItemFlagSameFields = 2
+	streamNodeMaxEntries     = 100
+)
+
+// writeStream encodes the stream as the given type, leaving out what older
+// types don't store.
+func writeStream(s *stream.Stream, typeByte byte, buffer *bytes.Buffer) error {
+	entries := s.Entries()
+	var nodes [][]stream.Entry
+	for start := 0; start < len(entries); start += streamNodeMaxEntries {
+		nodes = append(nodes, entries[start:min(start+streamNodeMaxEntries, len(entries))])
+	}
+	buffer.Write(encodeLen(uint64(len(nodes))))
+	for _, node := range nodes {
+		err := writeString(string(encodeStreamID(node[0].ID)), buffer)
+		if err != nil {
+			return err
+		}
+		err = writeString(string(encodeStreamNode(node)), buffer)
+		if err != nil {
+			return err
+		}
+	}
+	metadata := s.Metadata()
+	buffer.Write(encodeLen(metadata.Length))
+	writeStreamID(metadata.LastID, buffer)
+	if typeByte >= streamListpacks2TypeByte {
+		writeStreamID(metadata.FirstID, buffer)
+		writeStreamID(metadata.MaxDeletedID, buffer)
+		buffer.Write(encodeLen(metadata.EntriesAdded))
+	}
+
+	groups := s.Groups()
+	buffer.Write(encodeLen(uint64(len(groups))))
+	for _, group := range groups {
+		err := writeString(group.Name, buffer)
+		if err != nil {
+			return err
+		}
+		writeStreamID(group.LastID, buffer)
+		if typeByte >= streamListpacks2TypeByte {
+			buffer.Write(encodeLen(uint64(group.EntriesRead)))
+		}
+		buffer.Write(encodeLen(uint64(len(group.Pending))))
+		for _, pending := range group.Pending {
+			buffer.Write(encodeStreamID(pending.ID))
+			buffer.Write(encodeMillisecondTime(pending.DeliveryTime))
+			buffer.Write(encodeLen(pending.DeliveryCount))
+		}
+		buffer.Write(encodeLen(uint64(len(group.Consumers))))
+		for _, consumer := range group.Consumers {
+			err := writeString(consumer.Name, buffer)
+			if err != nil {
+				return err
+			}
+			buffer.Write(encodeMillisecondTime(consumer.SeenTime))
+			if typeByte >= streamListpacks3TypeByte {
+				buffer.Write(encodeMillisecondTime(consumer.ActiveTime))
+			}
+			buffer.Write(encodeLen(uint64(len(consumer.Pending))))
+			for _, id := range consumer.Pending {
+				buffer.Write(encodeStreamID(id))
+			}
+		}
+	}
+	return nil
+}
+
+// encodeStreamNode packs entries into a listpack using the first entry as
+// the master entry, so entries with the same fields store only values.
+func encodeStreamNode(entries []stream.Entry) []byte {
+	var lp listpackWriter
+	master := entries[0]
+	lp.appendInt(int64(len(entries)))
+	lp.appendInt(0)
+	lp.appendInt(int64(len(master.Payload)))
+	for _, pair := range master.Payload {
+		lp.appendString(pair.Field)
+	}
+	lp.appendInt(0)
+	for _, entry := range entries {
+		sameFields := slices.EqualFunc(entry.Payload, master.Payload, func(a, b stream.Pair) bool {
+			return a.Field == b.Field
+		})
+		var flags int64
+		if sameFields {
+			flags = streamItemFlagSameFields
+		}
+		lp.appendInt(flags)
+		lp.appendInt(int64(entry.ID.Ms() - master.ID.Ms()))
+		lp.appendInt(int64(entry.ID.Sequence() - master.ID.Sequence()))
+		if sameFields {
+			for _, pair := range entry.Payload {
+				lp.appendString(pair.Value)
+			}
+			lp.appendInt(int64(len(entry.Payload) + 3))
+		} else {
+			lp.appendInt(int64(len(entry.Payload)))
+			for _, pair := range entry.Payload {
+				lp.appendString(pair.Field)
+				lp.appendString(pair.Value)
+			}
+			lp.appendInt(int64(len(entry.Payload)*2 + 4))
+		}
+	}
+	return lp.bytes()
+}
+
+func writeStreamID(id stream.StreamID, buffer *bytes.Buffer) {
+	buffer.Write(encodeLen(id.Ms()))
+	buffer.Write(encodeLen(id.Sequence()))
+}
+
+func encodeStreamID(id stream.StreamID) []byte {
+	bytes := binary.BigEndian.AppendUint64(nil, id.Ms())
+	return binary.BigEndian.AppendUint64(bytes, id.Sequence())
+}
+
+func encodeMillisecondTime(t time.Time) []byte {
+	return binary.LittleEndian.AppendUint64(nil, uint64(t.UnixMilli()))
+}
+
+func decodeStream(reader *checksumReader, typeByte byte) (*stream.Stream, error) {
+	nodesCount, err := decodeLen(reader)
+	if err != nil {
+		return nil, err
+	}
+	var entries []stream.Entry
+	for range nodesCount {
+		key, err := decodeString(reader)
+		if err != nil {
+			return nil, err
+		}
+		masterID, err := decodeStreamID([]byte(resp.String(key)))
+		if err != nil {
+			return nil, err
+		}
+		node, err := decodeString(reader)
+		if err != nil {
+			return nil, err
+		}
+		entries, err = decodeStreamNode([]byte(resp.String(node)), masterID, entries)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var metadata stream.Metadata
+	metadata.Length, err = decodeLen(reader)
+	if err != nil {
+		return nil, err
+	}
+	metadata.LastID, err = readStreamID(reader)
+	if err != nil {
+		return nil, err
+	}
+	if typeByte >= streamListpacks2TypeByte {
+		metadata.FirstID, err = readStreamID(reader)
+		if err != nil {
+			return nil, err
+		}
+		metadata.MaxDeletedID, err = readStreamID(reader)
+		if err != nil {
+			return nil, err
+		}
+		metadata.EntriesAdded, err = decodeLen(reader)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		metadata.EntriesAdded = metadata.Length
+	}
+	if metadata.Length != uint64(len(entries)) {
+		return nil, fmt.Errorf("stream length mismatch: expected %d, got %d", metadata.Length, len(entries))
+	}
+
+	groupsCount, err := decodeLen(reader)
+	if err != nil {
+		return nil, err
+	}
+	var groups []*stream.ConsumerGroup
+	for range groupsCount {
+		group, err := decodeConsumerGroup(reader, typeByte)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, group)
+	}
+	return stream.Restore(entries, metadata, groups), nil
+}
+
+func decodeStreamNode(data []byte, masterID stream.StreamID, entries []stream.Entry) ([]stream.Entry, error) {
+	lp, err := newListpackReader(data)
+	if err != nil {
+		return nil, err
+	}
+	count, err := lp.nextInt()
+	if err != nil {
+		return nil, err
+	}
+	deleted, err := lp.nextInt()
+	if err != nil {
+		return nil, err
+	}
+	masterFieldsCount, err := lp.nextInt()
+	if err != nil {
+		return nil, err
+	}
+	var masterFields []string
+	for range masterFieldsCount {
+		field, err := lp.next()
+		if err != nil {
+			return nil, err
+		}
+		masterFields = append(masterFields, field.String())
+	}
+	if _, err = lp.next(); err != nil {
+		return nil, err
+	}
+	for range count + deleted {
+		flags, err := lp.nextInt()
+		if err != nil {
+			return nil, err
+		}
+		msDiff, err := lp.nextInt()
+		if err != nil {
+			return nil, err
+		}
+		seqDiff, err := lp.nextInt()
+		if err != nil {
+			return nil, err
+		}
+		var payload []stream.Pair
+		if flags&streamItemFlagSameFields != 0 {
+			for _, field := range masterFields {
+				value, err := lp.next()
+				if err != nil {
+					return nil, err
+				}
+				payload = append(payload, stream.Pair{Field: field, Value: value.String()})
+			}
+		} else {
+			fieldsCount, err := lp.nextInt()
+			if err != nil {
+				return nil, err
+			}
+			for range fieldsCount {
+				field, err := lp.next()
+				if err != nil {
+					return nil, err
+				}
+				value, err := lp.next()
+				if err != nil {
+					return nil, err
+				}
+				payload = append(payload, stream.Pair{Field: field.String(), Value: value.String()})
+			}
+		}
+		if _, err = lp.next(); err != nil {
+			return nil, err
+		}
+		if flags&streamItemFlagDeleted != 0 {
+			continue
+		}
+		entries = append(entries, stream.Entry{
+			ID: stream.NewID(
+				masterID.Ms()+uint64(msDiff),
+				masterID.Sequence()+uint64(seqDiff),
+			),
+			Payload: payload,
+		})
+	}
+	return entries, nil
+}
+
+func decodeConsumerGroup(reader *checksumReader, typeByte byte) (*stream.ConsumerGroup, error) {
+	name, err := decodeString(reader)
+	if err != nil {
+		return nil, err
+	}
+	group := &stream.ConsumerGroup{Name: resp.String(name), EntriesRead: -1}
+	group.LastID, err = readStreamID(reader)
+	if err != nil {
+		return nil, err
+	}
+	if typeByte >= streamListpacks2TypeByte {
+		entriesRead, err := decodeLen(reader)
+		if err != nil {
+			return nil, err
+		}
+		group.EntriesRead = int64(entriesRead)
+	}
+
+	pendingCount, err := decodeLen(reader)
+	if err != nil {
+		return nil, err
+	}
+	for range pendingCount {
+		var pending stream.PendingEntry
+		pending.ID, err = readRawStreamID(reader)
+		if err != nil {
+			return nil, err
+		}
+		pending.DeliveryTime, err = readMillisecondTime(reader)
+		if err != nil {
+			return nil, err
+		}
+		pending.DeliveryCount, err = decodeLen(reader)
+		if err != nil {
+			return nil, err
+		}
+		group.Pending = append(group.Pending, pending)
+	}
+
+	consumersCount, err := decodeLen(reader)
+	if err != nil {
+		return nil, err
+	}
+	for range consumersCount {
+		var consumer stream.Consumer
+		name, err := decodeString(reader)
+		if err != nil {
+			return nil, err
+		}
+		consumer.Name = resp.String(name)
+		consumer.SeenTime, err = readMillisecondTime(reader)
+		if err != nil {
+			return nil, err
+		}
+		if typeByte >= streamListpacks3TypeByte {
+			consumer.ActiveTime, err = readMillisecondTime(reader)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			consumer.ActiveTime = consumer.SeenTime
+		}
+		pendingCount, err := decodeLen(reader)
+		if err != nil {
+			return nil, err
+		}
+		for range pendingCount {
+			id, err := readRawStreamID(reader)
+			if err != nil {
+				return nil, err
+			}
+			owned := slices.ContainsFunc(group.Pending, func(p stream.PendingEntry) bool {
+				return p.ID == id
+			})
+			if !owned {
+				return nil, fmt.Errorf("consumer %s pending entry %v is missing in group PEL", consumer.Name, id)
+			}
+			consumer.Pending = append(consumer.Pending, id)
+		}
+		group.Consumers = append(group.Consumers, consumer)
+	}
+	return group, nil
+}
+
+func readStreamID(reader *checksumReader) (stream.StreamID, error) {
+	ms, err := decodeLen(reader)
+	if err != nil {
+		return stream.StreamID{}, err
+	}
+	sequence, err := decodeLen(reader)
+	if err != nil {
+		return stream.StreamID{}, err
+	}
+	return stream.NewID(ms, sequence), nil
+}
+
+func readRawStreamID(reader *checksumReader) (stream.StreamID, error) {
+	var bytes [16]byte
+	_, err := io.ReadFull(reader, bytes[:])
+	if err != nil {
+		return stream.StreamID{}, err
+	}
+	return decodeStreamID(bytes[:])
+}
+
+func decodeStreamID(bytes []byte) (stream.StreamID, error) {
+	if len(bytes) != 16 {
+		return stream.StreamID{}, fmt.Errorf("stream ID must be 16 bytes long, got %d", len(bytes))
+	}
+	return stream.NewID(binary.BigEndian.Uint64(bytes), binary.BigEndian.Uint64(bytes[8:])), nil
+}
+
+func readMillisecondTime(reader *checksumReader) (time.Time, error) {
+	var bytes [8]byte
+	_, err := io.ReadFull(reader, bytes[:])
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.UnixMilli(int64(binary.LittleEndian.Uint64(bytes[:]))), nil
+}
@@ -0,0 +1,169 @@
+package rdb
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/resp"
+	"github.com/codecrafters-io/redis-starter-go/app/stream"
+)
+
+type collectStrategy struct {
+	entries []DbEntry
+}
+
+func (c *collectStrategy) AddDbEntry(entry DbEntry) {
+	c.entries = append(c.entries, entry)
+}
+
+func (c *collectStrategy) AddAux(key string, value resp.RespDataType) {}
+
+func testStream() *stream.Stream {
+	var entries []stream.Entry
+	// More entries than fit in a node, with both same and different fields.
+	for i := range streamNodeMaxEntries + 5 {
+		payload := []stream.Pair{{Field: "n", Value: fmt.Sprint(i)}, {Field: "name", Value: "entry"}}
+		if i%7 == 3 {
+			payload = []stream.Pair{{Field: "other", Value: "\x00\xff" + strings.Repeat("v", i*50)}}
+		}
+		entries = append(entries, stream.Entry{ID: stream.NewID(1000+uint64(i/3), uint64(i%3)), Payload: payload})
+	}
+	metadata := stream.Metadata{
+		Length:       uint64(len(entries)),
+		LastID:       stream.NewID(2000, 5),
+		FirstID:      entries[0].ID,
+		MaxDeletedID: stream.NewID(1500, 0),
+		EntriesAdded: uint64(len(entries)) + 3,
+	}
+	delivered := time.UnixMilli(1700000000123)
+	groups := []*stream.ConsumerGroup{
+		{
+			Name:        "readers",
+			LastID:      entries[4].ID,
+			EntriesRead: 5,
+			Pending: []stream.PendingEntry{
+				{ID: entries[1].ID, DeliveryTime: delivered, DeliveryCount: 1},
+				{ID: entries[4].ID, DeliveryTime: delivered.Add(time.Second), DeliveryCount: 300},
+			},
+			Consumers: []stream.Consumer{
+				{Name: "alice", SeenTime: delivered, ActiveTime: delivered.Add(-time.Second), Pending: []stream.StreamID{entries[1].ID}},
+				{Name: "bob", SeenTime: delivered.Add(time.Minute), ActiveTime: delivered, Pending: []stream.StreamID{entries[4].ID}},
+				{Name: "idle", SeenTime: delivered, ActiveTime: delivered},
+			},
+		},
+		{Name: "empty", LastID: stream.NewID(0, 0), EntriesRead: 0},
+	}
+	return stream.Restore(entries, metadata, groups)
+}
+
+// legacy returns what the test stream looks like once decoded from an older
+// type, which doesn't store some of the metadata.
+func legacy(typeByte byte) (stream.Metadata, []*stream.ConsumerGroup) {
+	s := testStream()
+	metadata := s.Metadata()
+	groups := s.Groups()
+	if typeByte < streamListpacks2TypeByte {
+		metadata.MaxDeletedID = stream.StreamID{}
+		metadata.EntriesAdded = metadata.Length
+		for _, group := range groups {
+			group.EntriesRead = -1
+		}
+	}
+	if typeByte < streamListpacks3TypeByte {
+		for _, group := range groups {
+			for i := range group.Consumers {
+				group.Consumers[i].ActiveTime = group.Consumers[i].SeenTime
+			}
+		}
+	}
+	return metadata, groups
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	tests := []struct {
+		name     string
+		typeByte byte
+	}{
+		{"listpacks", streamListpacksTypeByte},
+		{"listpacks 2", streamListpacks2TypeByte},
+		{"listpacks 3", streamListpacks3TypeByte},
+	}
+	original := testStream()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var buffer bytes.Buffer
+			if err := writeStream(original, test.typeByte, &buffer); err != nil {
+				t.Fatal(err)
+			}
+			reader := &checksumReader{reader: bufio.NewReader(&buffer)}
+			decoded, err := decodeStream(reader, test.typeByte)
+			if err != nil {
+				t.Fatalf("decodeStream failed: %v", err)
+			}
+			if buffer.Len() != 0 {
+				t.Errorf("%d bytes left after decoding", buffer.Len())
+			}
+			wantMetadata, wantGroups := legacy(test.typeByte)
+			if !reflect.DeepEqual(decoded.Entries(), original.Entries()) {
+				t.Errorf("entries differ after round trip")
+			}
+			if !reflect.DeepEqual(decoded.Metadata(), wantMetadata) {
+				t.Errorf("Metadata() = %+v, want %+v", decoded.Metadata(), wantMetadata)
+			}
+			if !reflect.DeepEqual(decoded.Groups(), wantGroups) {
+				t.Errorf("Groups() = %+v, want %+v", decoded.Groups(), wantGroups)
+			}
+		})
+	}
+}
+
+func TestEncodeReadRoundTrip(t *testing.T) {
+	expireAt := time.UnixMilli(4102444800000)
+	entries := []DbEntry{
+		{Key: "string", Value: resp.BulkString("value")},
+		{Key: "binary\x00key", Value: resp.BulkString("\xff\xfe\r\n"), ExpireAt: expireAt},
+		{Key: "stream", Value: testStream()},
+		{Key: "empty stream", Value: stream.Restore(nil, stream.Metadata{LastID: stream.NewID(5, 1), EntriesAdded: 1}, nil)},
+	}
+	encoded, err := Encode(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var strategy collectStrategy
+	if err := Read(bufio.NewReader(bytes.NewReader(encoded)), &strategy, true); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if len(strategy.entries) != len(entries) {
+		t.Fatalf("read %d entries, want %d", len(strategy.entries), len(entries))
+	}
+	for i, got := range strategy.entries {
+		want := entries[i]
+		if got.Key != want.Key || !got.ExpireAt.Equal(want.ExpireAt) {
+			t.Errorf("entry %d = %q expiring at %v, want %q expiring at %v", i, got.Key, got.ExpireAt, want.Key, want.ExpireAt)
+		}
+		switch w := want.Value.(type) {
+		case *stream.Stream:
+			g, ok := got.Value.(*stream.Stream)
+			if !ok {
+				t.Fatalf("entry %q = %T, want a stream", got.Key, got.Value)
+			}
+			if !reflect.DeepEqual(g.Entries(), w.Entries()) || !reflect.DeepEqual(g.Metadata(), w.Metadata()) || !reflect.DeepEqual(g.Groups(), w.Groups()) {
+				t.Errorf("stream %q differs after round trip", got.Key)
+			}
+		default:
+			if resp.String(got.Value.(resp.RespDataType)) != resp.String(w.(resp.RespDataType)) {
+				t.Errorf("entry %q = %#v, want %#v", got.Key, got.Value, w)
+			}
+		}
+	}
+
+	encoded[len(encoded)-1] ^= 0xff
+	if err := Read(bufio.NewReader(bytes.NewReader(encoded)), &collectStrategy{}, true); err == nil {
+		t.Errorf("Read with a wrong checksum succeeded")
+	}
+}
@@ -0,0 +1,58 @@
+package replication
+
+// backlog is a circular buffer with the last bytes of the replication
+// stream, so a replica that lost the connection can continue from its
+// offset instead of performing a full resynchronization.
+type backlog struct {
+	buf []byte
+	// next is the position in buf the next byte is written to.
+	next int
+	// length is the number of valid bytes in buf.
+	length int
+	// offset is the replication offset right after the last written byte.
+	offset uint64
+}
+
+func newBacklog(size int, offset uint64) *backlog {
+	return &backlog{
+		buf:    make([]byte, max(size, 1)),
+		offset: offset,
+	}
+}
+
+func (b *backlog) write(bytes []byte) {
+	b.offset += uint64(len(bytes))
+	if len(bytes) >= len(b.buf) {
+		copy(b.buf, bytes[len(bytes)-len(b.buf):])
+		b.next = 0
+		b.length = len(b.buf)
+		return
+	}
+	n := copy(b.buf[b.next:], bytes)
+	copy(b.buf, bytes[n:])
+	b.next = (b.next + len(bytes)) % len(b.buf)
+	b.length = min(b.length+len(bytes), len(b.buf))
+}
+
+// firstOffset is the replication offset of the oldest byte in the backlog.
+func (b *backlog) firstOffset() uint64 {
+	return b.offset - uint64(b.length)
+}
+
+// readFrom returns the bytes from offset up to the end of the stream, or
+// false when offset is not in the backlog anymore.
+func (b *backlog) readFrom(offset uint64) ([]byte, bool) {
+	if offset < b.firstOffset() || offset > b.offset {
+		return nil, false
+	}
+	n := int(b.offset - offset)
+	start := (b.next - n + len(b.buf)) % len(b.buf)
+	bytes := make([]byte, 0, n)
+	if start+n <= len(b.buf) {
+		bytes = append(bytes, b.buf[start:start+n]...)
+	} else {
+		bytes = append(bytes, b.buf[start:]...)
+		bytes = append(bytes, b.buf[:start+n-len(b.buf)]...)
+	}
+	return bytes, true
+}
@@ -0,0 +1,60 @@
+package replication
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestBacklogReadFrom(t *testing.T) {
+	tests := []struct {
+		name   string
+		size   int
+		offset uint64
+		writes []string
+	}{
+		{"empty", 8, 100, nil},
+		{"not full", 8, 0, []string{"abc", "de"}},
+		{"exactly full", 8, 0, []string{"abcd", "efgh"}},
+		{"wraps", 8, 0, []string{"abcdef", "ghij"}},
+		{"wraps several times", 5, 42, []string{"ab", "cde", "f", "ghij", "klm", "nopq"}},
+		{"write larger than buffer", 4, 7, []string{"ab", "cdefghij", "k"}},
+		{"write of buffer size", 4, 0, []string{"a", "bcde", "fg"}},
+		{"single byte buffer", 1, 0, []string{"ab", "c"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := newBacklog(test.size, test.offset)
+			stream := strings.Join(test.writes, "")
+			for _, write := range test.writes {
+				b.write([]byte(write))
+			}
+			end := test.offset + uint64(len(stream))
+			if b.offset != end {
+				t.Errorf("offset = %d, want %d", b.offset, end)
+			}
+			first := end - uint64(min(len(stream), test.size))
+			if b.firstOffset() != first {
+				t.Errorf("firstOffset() = %d, want %d", b.firstOffset(), first)
+			}
+			for offset := test.offset; offset <= end+1; offset++ {
+				got, ok := b.readFrom(offset)
+				if offset < first || offset > end {
+					if ok {
+						t.Errorf("readFrom(%d) = %q, want not found", offset, got)
+					}
+					continue
+				}
+				want := stream[offset-test.offset:]
+				if !ok || !bytes.Equal(got, []byte(want)) {
+					t.Errorf("readFrom(%d) = %q, %v, want %q", offset, got, ok, want)
+				}
+			}
+			if test.offset > 0 {
+				if got, ok := b.readFrom(test.offset - 1); ok {
+					t.Errorf("readFrom(%d) = %q before the stream start", test.offset-1, got)
+				}
+			}
+		})
+	}
+}
@@ -1,10 +1,11 @@
 package replication
 
 import (
+	"bytes"
 	"fmt"
-	"io"
 	"math/rand"
 	"net"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -17,235 +18,504 @@ type Role interface {
 	CollectInfo(map[string]string)
 }
 
+type Config struct {
+	BacklogSize int
+	// PingPeriod is how often master pings its replicas.
+	PingPeriod time.Duration
+	// Timeout is how long a replication link may stay silent before it's
+	// considered broken, on both sides.
+	Timeout time.Duration
+	// DisklessLoad tells replicas whether to load the snapshot from master
+	// straight from the socket or to store it as the RDB file at RdbPath
+	// first.
+	DisklessLoad string
+	RdbPath      string
+}
+
+// Values of repl-diskless-load. The dataset is replaced only once the
+// snapshot was loaded completely, so on-empty-db behaves like swapdb.
+const (
+	DisklessLoadDisabled  = "disabled"
+	DisklessLoadOnEmptyDb = "on-empty-db"
+	DisklessLoadSwapDb    = "swapdb"
+)
+
 type MasterRole struct {
-	Id               string
-	Offset           uint64
-	mutex            sync.Mutex
-	replicas         []net.Conn
-	hasPendingWrites bool
-	ack              chan uint64
+	Id     string
+	Offset uint64
+	// secondaryId is the replication id of the master this server was a
+	// replica of before being promoted. Replicas of the old master can
+	// continue with it up to secondaryOffset.
+	secondaryId     string
+	secondaryOffset uint64
+	config          Config
+	backlog         *backlog
+	mutex           sync.Mutex
+	replicas        []*Replica
+	// acked is closed and replaced whenever a replica acknowledges an
+	// offset, waking up every WAIT.
+	acked chan struct{}
+	// proxy is set while this server is a replica itself. The stream then
+	// comes from its master, including the pings, and is forwarded to
+	// sub-replicas as is.
+	proxy bool
 }
 
-func (m *MasterRole) AddReplica(conn net.Conn) {
-	m.mutex.Lock()
-	m.replicas = append(m.replicas, conn)
-	m.mutex.Unlock()
+// Replica is a connection that completed PSYNC. Commands propagated while
+// the snapshot is transferred are buffered and sent once it comes online,
+// after that every command is written in order by a dedicated goroutine.
+type Replica struct {
+	conn net.Conn
+	// address is where the replica accepts connections, its IP and the
+	// port announced with REPLCONF listening-port.
+	address  ReplicaAddress
+	online   bool
+	buffered [][]byte
+	// bufferedSize is the number of bytes in buffered.
+	bufferedSize int
+	queue        chan []byte
+	ackOffset    uint64
+	ackTime      time.Time
 }
 
-func (m *MasterRole) Propagate(request resp.RespDataType) {
+// replicaQueueSize limits the writes waiting to be sent to a replica, a
+// replica that falls further behind is disconnected.
+const replicaQueueSize = 1024
+
+// replicaBufferLimit limits the bytes buffered for a replica while it
+// receives the snapshot, like the hard limit of the default Redis
+// client-output-buffer-limit for replicas.
+const replicaBufferLimit = 256 * 1024 * 1024
+
+// AttachReplica registers a replica that is about to receive a snapshot and
+// returns the replication id and offset the snapshot corresponds to. It
+// must be called together with taking the snapshot, so that every command
+// not included in the snapshot is buffered for the replica.
+func (m *MasterRole) AttachReplica(conn net.Conn, port uint16) (*Replica, string, uint64) {
+	replica := newReplica(conn, port)
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
-	if len(m.replicas) == 0 {
-		return
-	}
-	m.hasPendingWrites = true
-	bytes := request.Bytes()
-	for _, c := range m.replicas {
-		go c.Write(bytes)
-	}
+	m.createBacklog()
+	m.replicas = append(m.replicas, replica)
+	return replica, m.Id, m.Offset
 }
 
-func (r *MasterRole) Wait(numOfReplicas int, timeout time.Duration) int {
-	if len(r.replicas) == 0 {
-		return 0
+// ContinueReplica registers a replica that asked to continue replication
+// from offset, the offset of the first byte it's missing. It fails when the
+// replication id is unknown or the offset is not in the backlog anymore,
+// otherwise the missing bytes are buffered for the replica. The current
+// replication id is returned, the replica switches to it.
+func (m *MasterRole) ContinueReplica(conn net.Conn, port uint16, replId string, offset uint64) (*Replica, string, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.backlog == nil || offset == 0 {
+		return nil, "", false
 	}
-	if !r.hasPendingWrites {
-		return len(r.replicas)
+	if replId != m.Id && (replId != m.secondaryId || offset > m.secondaryOffset) {
+		return nil, "", false
 	}
-	r.hasPendingWrites = false
-	done := make(chan struct{})
-	if timeout > 0 {
-		go func() {
-			time.Sleep(timeout)
-			fmt.Printf("Timeout\n")
-			done <- struct{}{}
-		}()
+	missing, ok := m.backlog.readFrom(offset - 1)
+	if !ok {
+		return nil, "", false
 	}
-	r.ack = make(chan uint64)
-	for _, replica := range r.replicas {
-		ack := resp.Array{
-			Content: []resp.RespDataType{
-				resp.BulkString("REPLCONF"),
-				resp.BulkString("GETACK"),
-				resp.BulkString("*"),
-			},
-		}
-		replica.Write(ack.Bytes())
-	}
-	numOfReceivedAcks := 0
-	for {
-		select {
-		case <-done:
-			return numOfReceivedAcks
-		case <-r.ack:
-			numOfReceivedAcks += 1
-			if numOfReceivedAcks == numOfReplicas || numOfReceivedAcks == len(r.replicas) {
-				return numOfReceivedAcks
-			}
-		}
+	replica := newReplica(conn, port)
+	if len(missing) > 0 {
+		replica.send(missing)
 	}
+	m.replicas = append(m.replicas, replica)
+	return replica, m.Id, true
 }
 
-func (r *MasterRole) AckReceived(offset uint64) {
-	fmt.Printf("Ack received\n")
-	r.ack <- offset
+func newReplica(conn net.Conn, port uint16) *Replica {
+	host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	return &Replica{
+		conn:    conn,
+		address: ReplicaAddress{Host: host, Port: port},
+	}
 }
 
-func NewMaster() *MasterRole {
-	return &MasterRole{
-		Id:     generateRepId(),
-		Offset: 0,
+// createBacklog starts recording the replication stream. Caller must hold
+// the mutex.
+func (m *MasterRole) createBacklog() {
+	if m.backlog != nil {
+		return
 	}
+	m.backlog = newBacklog(m.config.BacklogSize, m.Offset)
 }
 
-type SlaveRole struct {
-	Address      ReplicaAddress
-	masterReplId string
-	Offset       uint64
+// ReplicaOnline starts streaming commands to a replica that received the
+// snapshot, beginning with the ones buffered during the transfer. It
+// returns false when the replica was disconnected in the meantime, e.g. as
+// too much was buffered for it.
+func (m *MasterRole) ReplicaOnline(replica *Replica) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if !slices.Contains(m.replicas, replica) {
+		return false
+	}
+	replica.queue = make(chan []byte, replicaQueueSize)
+	replica.online = true
+	replica.ackTime = time.Now()
+	go m.writeLoop(replica)
+	if len(replica.buffered) > 0 {
+		replica.queue <- bytes.Join(replica.buffered, nil)
+	}
+	replica.buffered = nil
+	replica.bufferedSize = 0
+	return true
 }
 
-type ReplicaAddress struct {
-	Host string
-	Port uint16
+func (m *MasterRole) DetachReplica(replica *Replica) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.detach(replica)
 }
 
-type Connection interface {
-	io.Writer
-	Reader() *resp.BufReader
-	Handshake(port uint16) error
-	Ack() error
+// detach removes the replica and stops its write loop. Caller must hold the
+// mutex.
+func (m *MasterRole) detach(replica *Replica) {
+	for i, r := range m.replicas {
+		if r == replica {
+			m.replicas = append(m.replicas[:i], m.replicas[i+1:]...)
+			if r.online {
+				close(r.queue)
+			}
+			return
+		}
+	}
 }
 
-type SlaveConnection struct {
-	conn   net.Conn
-	reader *resp.BufReader
-	slave  *SlaveRole
+// send queues bytes for the replica and reports false when its queue or
+// buffer is full.
+func (r *Replica) send(bytes []byte) bool {
+	if !r.online {
+		if r.bufferedSize+len(bytes) > replicaBufferLimit {
+			return false
+		}
+		r.buffered = append(r.buffered, bytes)
+		r.bufferedSize += len(bytes)
+		return true
+	}
+	select {
+	case r.queue <- bytes:
+		return true
+	default:
+		return false
+	}
 }
 
-func ConnectToMaster(slave *SlaveRole) (Connection, error) {
-	conn, err := net.Dial("tcp", fmt.Sprintf("%v:%d", slave.Address.Host, slave.Address.Port))
-	if err != nil {
-		return nil, err
+func (m *MasterRole) writeLoop(r *Replica) {
+	for bytes := range r.queue {
+		_, err := r.conn.Write(bytes)
+		if err != nil {
+			fmt.Printf("failed to write to replica %v: %v\n", r.conn.RemoteAddr(), err)
+			r.conn.Close()
+			go m.DetachReplica(r)
+			for range r.queue {
+			}
+			return
+		}
 	}
-	return &SlaveConnection{
-		conn:   conn,
-		reader: resp.NewReader(conn),
-		slave:  slave,
-	}, nil
 }
 
-func (c *SlaveConnection) Reader() *resp.BufReader {
-	return c.reader
+// Propagate sends the command to replicas and returns the replication offset
+// right after it.
+func (m *MasterRole) Propagate(request resp.RespDataType) uint64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.feed(request.Bytes())
+	return m.Offset
 }
 
-func (c *SlaveConnection) Handshake(port uint16) error {
-	ping := resp.Array{
-		Content: []resp.RespDataType{resp.BulkString("ping")},
-	}
-	_, err := c.conn.Write(ping.Bytes())
-	if err != nil {
-		return err
-	}
-	response, err := resp.Parse(c.reader)
-	if err != nil {
-		return err
+// feed appends bytes to the replication stream. Nothing is recorded until
+// the first replica attaches and the backlog is created. Caller must hold
+// the mutex.
+func (m *MasterRole) feed(bytes []byte) {
+	if m.backlog == nil {
+		return
 	}
-	command := response.(resp.SimpleString)
-	if command != "pong" {
-		return fmt.Errorf("unexpected response: %v", command)
+	m.backlog.write(bytes)
+	m.Offset = m.backlog.offset
+	for _, r := range append([]*Replica(nil), m.replicas...) {
+		if !r.send(bytes) {
+			fmt.Printf("replica %v can't keep up with writes, disconnecting\n", r.conn.RemoteAddr())
+			m.detach(r)
+			r.conn.Close()
+		}
 	}
+}
 
-	lisneningPort := resp.Array{
-		Content: []resp.RespDataType{
-			resp.BulkString("REPLCONF"),
-			resp.BulkString("listening-port"),
-			resp.BulkString(strconv.Itoa(int(port))),
-		},
-	}
-	_, err = c.conn.Write(lisneningPort.Bytes())
-	if err != nil {
-		return err
-	}
-	response, err = resp.Parse(c.reader)
-	if err != nil {
-		return err
+// cron pings the replicas every ping period, so they can detect a broken
+// link, and disconnects replicas that didn't acknowledge anything within
+// the timeout.
+func (m *MasterRole) cron() {
+	ping := resp.Array{Content: []resp.RespDataType{resp.BulkString("PING")}}
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	lastPing := time.Now()
+	for now := range ticker.C {
+		m.mutex.Lock()
+		if !m.proxy && now.Sub(lastPing) >= m.config.PingPeriod {
+			lastPing = now
+			if len(m.replicas) > 0 {
+				m.feed(ping.Bytes())
+			}
+		}
+		for _, r := range append([]*Replica(nil), m.replicas...) {
+			if r.online && m.config.Timeout > 0 && now.Sub(r.ackTime) > m.config.Timeout {
+				fmt.Printf("replica %v timed out, disconnecting\n", r.conn.RemoteAddr())
+				m.detach(r)
+				r.conn.Close()
+			}
+		}
+		m.mutex.Unlock()
 	}
-	command = response.(resp.SimpleString)
-	if command != "ok" {
-		return fmt.Errorf("unexpected response: %v", command)
+}
+
+// Wait blocks until numOfReplicas replicas acknowledged the offset or the
+// timeout elapses, zero timeout waits forever. It returns the number of
+// replicas that acknowledged the offset. Replicas that are behind are asked
+// for an acknowledgement right away instead of waiting for their periodic
+// one.
+func (r *MasterRole) Wait(offset uint64, numOfReplicas int, timeout time.Duration) int {
+	r.mutex.Lock()
+	acked, _ := r.countAcked(offset)
+	if acked < numOfReplicas {
+		r.feed(getAck.Bytes())
 	}
+	r.mutex.Unlock()
 
-	capabilities := resp.Array{
-		Content: []resp.RespDataType{
-			resp.BulkString("REPLCONF"),
-			resp.BulkString("capa"),
-			resp.BulkString("psync2"),
-		},
+	var done <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		done = timer.C
 	}
-	_, err = c.conn.Write(capabilities.Bytes())
-	if err != nil {
-		return err
+	for {
+		r.mutex.Lock()
+		acked, signal := r.countAcked(offset)
+		r.mutex.Unlock()
+		if acked >= numOfReplicas {
+			return acked
+		}
+		select {
+		case <-done:
+			return acked
+		case <-signal:
+		}
 	}
-	response, err = resp.Parse(c.reader)
-	if err != nil {
-		return err
+}
+
+var getAck = resp.Array{
+	Content: []resp.RespDataType{
+		resp.BulkString("REPLCONF"),
+		resp.BulkString("GETACK"),
+		resp.BulkString("*"),
+	},
+}
+
+// WaitCaughtUp blocks until an online replica, the target one when given,
+// acknowledged the whole replication stream and returns its address. Writes
+// must be paused, so that replicas can catch up. It returns false when the
+// deadline passes or cancel is closed first.
+func (m *MasterRole) WaitCaughtUp(target *ReplicaAddress, deadline <-chan time.Time, cancel <-chan struct{}) (ReplicaAddress, bool) {
+	m.mutex.Lock()
+	m.feed(getAck.Bytes())
+	m.mutex.Unlock()
+	for {
+		m.mutex.Lock()
+		signal := m.acked
+		for _, r := range m.replicas {
+			if r.online && r.ackOffset >= m.Offset && (target == nil || r.address == *target) {
+				m.mutex.Unlock()
+				return r.address, true
+			}
+		}
+		m.mutex.Unlock()
+		select {
+		case <-deadline:
+			return ReplicaAddress{}, false
+		case <-cancel:
+			return ReplicaAddress{}, false
+		case <-signal:
+		}
 	}
-	command = response.(resp.SimpleString)
-	if command != "ok" {
-		return fmt.Errorf("unexpected response: %v", command)
+}
+
+// ReplicaStatus reports whether a replica listens on address and whether it
+// is online.
+func (m *MasterRole) ReplicaStatus(address ReplicaAddress) (found bool, online bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, r := range m.replicas {
+		if r.address == address {
+			found = true
+			online = online || r.online
+		}
 	}
+	return found, online
+}
 
-	_, err = c.conn.Write(c.slave.Psync().Bytes())
-	if err != nil {
-		return err
+// OnlineReplicas returns the number of replicas that completed
+// synchronization.
+func (m *MasterRole) OnlineReplicas() int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	online := 0
+	for _, r := range m.replicas {
+		if r.online {
+			online += 1
+		}
 	}
+	return online
+}
 
-	response, err = resp.Parse(c.reader)
-	if err != nil {
-		return err
+// countAcked returns the number of online replicas that acknowledged the
+// offset and the channel closed on the next acknowledgement. Caller must
+// hold the mutex.
+func (r *MasterRole) countAcked(offset uint64) (int, <-chan struct{}) {
+	acked := 0
+	for _, replica := range r.replicas {
+		if replica.online && replica.ackOffset >= offset {
+			acked += 1
+		}
 	}
-	command = response.(resp.SimpleString)
-	if strings.HasPrefix(string(command), "FULLRESYNC") {
-		return fmt.Errorf("unexpected response: %v", command)
+	return acked, r.acked
+}
+
+// GoodReplicas returns the number of online replicas that acknowledged
+// something within maxLag.
+func (r *MasterRole) GoodReplicas(maxLag time.Duration) int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	now := time.Now()
+	good := 0
+	for _, replica := range r.replicas {
+		if replica.online && now.Sub(replica.ackTime) <= maxLag {
+			good += 1
+		}
 	}
+	return good
+}
 
-	response, err = resp.Parse(c.reader)
-	if err != nil {
-		return err
+// AckReceived records the offset acknowledged by the replica on conn.
+func (r *MasterRole) AckReceived(conn net.Conn, offset uint64) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, replica := range r.replicas {
+		if replica.conn == conn {
+			replica.ackOffset = max(replica.ackOffset, offset)
+			replica.ackTime = time.Now()
+		}
 	}
-	rdpCommand := response.(resp.BulkString)
-	if strings.HasPrefix(string(rdpCommand), "REDIS") {
-		return fmt.Errorf("unexpected response: %v", command)
+	close(r.acked)
+	r.acked = make(chan struct{})
+}
+
+func NewMaster(config Config) *MasterRole {
+	master := &MasterRole{
+		Id:     generateRepId(),
+		Offset: 0,
+		config: config,
+		acked:  make(chan struct{}),
 	}
-	c.reader.BytesRead = 0
-	return nil
+	go master.cron()
+	return master
 }
 
-func (c *SlaveConnection) Write(_ []byte) (int, error) {
-	c.slave.Offset = c.reader.BytesRead
-	return 0, nil
+func (m *MasterRole) ReplId() string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.Id
 }
 
-func (c *SlaveConnection) Ack() error {
-	response := resp.Array{
-		Content: []resp.RespDataType{
-			resp.BulkString("REPLCONF"),
-			resp.BulkString("ACK"),
-			resp.BulkString(strconv.Itoa(int(c.slave.Offset))),
-		},
+// Demote turns the master into a replica of address. The replica asks to
+// continue from the current replication id and offset, which succeeds when
+// the new master used to be a replica of this server. The replicas are
+// disconnected and can continue as sub-replicas once they reconnect.
+func (m *MasterRole) Demote(address ReplicaAddress, config Config) *SlaveRole {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.proxy = true
+	m.disconnectReplicas()
+	m.createBacklog()
+	slave := newSlave(address, config, m)
+	slave.masterReplId = m.Id
+	slave.offset = m.Offset
+	return slave
+}
+
+// resetStream continues with the stream of a master the replica fully
+// resynchronized with. Sub-replicas are disconnected, as they have to
+// resynchronize too. Caller must hold the mutex.
+func (m *MasterRole) resetStream(id string, offset uint64) {
+	m.disconnectReplicas()
+	m.Id = id
+	m.Offset = offset
+	m.secondaryId = ""
+	m.secondaryOffset = 0
+	m.backlog = newBacklog(m.config.BacklogSize, offset)
+}
+
+// shiftId switches to a new replication id and keeps the current one as
+// the secondary id. Replicas are disconnected to learn about the new id,
+// they can continue from their offsets after reconnecting. Caller must hold
+// the mutex.
+func (m *MasterRole) shiftId(id string) {
+	m.disconnectReplicas()
+	m.secondaryId = m.Id
+	m.secondaryOffset = m.Offset + 1
+	m.Id = id
+}
+
+// disconnectReplicas closes the connections of all replicas. Caller must
+// hold the mutex.
+func (m *MasterRole) disconnectReplicas() {
+	for _, r := range append([]*Replica(nil), m.replicas...) {
+		m.detach(r)
+		r.conn.Close()
 	}
-	_, err := c.conn.Write(response.Bytes())
-	return err
 }
 
 func (r *MasterRole) CollectInfo(info map[string]string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
 	info["role"] = "master"
-	info["master_replid"] = r.Id
-	info["master_repl_offset"] = strconv.FormatUint(r.Offset, 10)
+	r.collectStreamInfo(info)
 }
 
-func (r SlaveRole) CollectInfo(info map[string]string) {
-	info["role"] = "slave"
+// collectStreamInfo reports the replicas and the backlog, which replicas
+// serving sub-replicas have as well. Caller must hold the mutex.
+func (r *MasterRole) collectStreamInfo(info map[string]string) {
+	info["connected_slaves"] = strconv.Itoa(len(r.replicas))
+	now := time.Now()
+	for i, replica := range r.replicas {
+		state, lag := "wait_bgsave", 0
+		if replica.online {
+			state, lag = "online", int(now.Sub(replica.ackTime).Seconds())
+		}
+		info[fmt.Sprintf("slave%d", i)] = fmt.Sprintf("ip=%v,port=%d,state=%v,offset=%d,lag=%d",
+			replica.address.Host, replica.address.Port, state, replica.ackOffset, lag)
+	}
+	info["master_replid"] = r.Id
+	info["master_repl_offset"] = strconv.FormatUint(r.Offset, 10)
+	if r.secondaryId != "" {
+		info["master_replid2"] = r.secondaryId
+		info["second_repl_offset"] = strconv.FormatUint(r.secondaryOffset, 10)
+	} else {
+		info["master_replid2"] = strings.Repeat("0", 40)
+		info["second_repl_offset"] = "-1"
+	}
+	info["repl_backlog_size"] = strconv.Itoa(r.config.BacklogSize)
+	if r.backlog != nil {
+		info["repl_backlog_active"] = "1"
+		info["repl_backlog_first_byte_offset"] = strconv.FormatUint(r.backlog.firstOffset()+1, 10)
+		info["repl_backlog_histlen"] = strconv.Itoa(r.backlog.length)
+	} else {
+		info["repl_backlog_active"] = "0"
+		info["repl_backlog_first_byte_offset"] = "0"
+		info["repl_backlog_histlen"] = "0"
+	}
 }
 
 func generateRepId() string {
@@ -257,25 +527,3 @@ func generateRepId() string {
 	}
 	return builder.String()
 }
-
-func (s SlaveRole) Psync() resp.RespDataType {
-	var masterReplId string
-	if s.masterReplId != "" {
-		masterReplId = s.masterReplId
-	} else {
-		masterReplId = "?"
-	}
-	var offset int
-	if s.Offset == 0 {
-		offset = -1
-	} else {
-		offset = int(s.Offset)
-	}
-	return resp.Array{
-		Content: []resp.RespDataType{
-			resp.BulkString("PSYNC"),
-			resp.BulkString(masterReplId),
-			resp.BulkString(strconv.Itoa(offset)),
-		},
-	}
-}
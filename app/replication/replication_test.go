@@ -0,0 +1,56 @@
+package replication
+
+import (
+	"net"
+	"testing"
+
+	"github.com/codecrafters-io/redis-starter-go/app/resp"
+)
+
+var set = resp.Array{Content: []resp.RespDataType{resp.BulkString("SET"), resp.BulkString("k"), resp.BulkString("v")}}
+
+func TestReplicaOnline(t *testing.T) {
+	tests := []struct {
+		name string
+		// buffered is how much is already buffered for the replica.
+		buffered   int
+		detach     bool
+		wantOnline bool
+	}{
+		{name: "attached", wantOnline: true},
+		{name: "detached during transfer", detach: true},
+		{name: "buffer limit reached", buffered: replicaBufferLimit - len(set.Bytes()) + 1},
+		{name: "buffer limit not reached", buffered: replicaBufferLimit - len(set.Bytes()), wantOnline: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			master := &MasterRole{config: Config{BacklogSize: 64}, acked: make(chan struct{})}
+			conn, peer := net.Pipe()
+			defer peer.Close()
+			replica, _, _ := master.AttachReplica(conn, 6380)
+			replica.bufferedSize = test.buffered
+			master.Propagate(set)
+			if test.detach {
+				master.DetachReplica(replica)
+			}
+			if got := master.ReplicaOnline(replica); got != test.wantOnline {
+				t.Errorf("ReplicaOnline() = %v, want %v", got, test.wantOnline)
+			}
+			if got := master.OnlineReplicas(); got != len(master.replicas) || replica.online != test.wantOnline {
+				t.Errorf("OnlineReplicas() = %d with %d replicas, replica online %v", got, len(master.replicas), replica.online)
+			}
+			if !test.wantOnline {
+				return
+			}
+			buf := make([]byte, 64)
+			n, err := peer.Read(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(buf[:n]) != string(set.Bytes()) {
+				t.Errorf("replica received %q, want %q", buf[:n], set.Bytes())
+			}
+			master.DetachReplica(replica)
+		})
+	}
+}
@@ -0,0 +1,583 @@
+package replication
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/rdb"
+	"github.com/codecrafters-io/redis-starter-go/app/resp"
+)
+
+// States of the link with master, named as ROLE reports them.
+const (
+	StateConnect    = "connect"
+	StateConnecting = "connecting"
+	StateSync       = "sync"
+	StateConnected  = "connected"
+)
+
+type SlaveRole struct {
+	Address       ReplicaAddress
+	config        Config
+	mutex         sync.Mutex
+	state         string
+	masterReplId  string
+	offset        uint64
+	lastIO        time.Time
+	linkDownSince time.Time
+	conn          *SlaveConnection
+	// downstream forwards the stream received from master to sub-replicas,
+	// with the same replication id and offsets.
+	downstream *MasterRole
+	// failover receives the outcome of the next PSYNC when this server was
+	// demoted by FAILOVER and asks the new master to take over.
+	failover chan error
+	done     chan struct{}
+}
+
+var errStopped = errors.New("replication stopped")
+
+type ReplicaAddress struct {
+	Host string
+	Port uint16
+}
+
+func NewSlave(address ReplicaAddress, config Config) *SlaveRole {
+	downstream := NewMaster(config)
+	downstream.Id = ""
+	downstream.proxy = true
+	return newSlave(address, config, downstream)
+}
+
+func newSlave(address ReplicaAddress, config Config, downstream *MasterRole) *SlaveRole {
+	return &SlaveRole{
+		Address:    address,
+		config:     config,
+		state:      StateConnect,
+		downstream: downstream,
+		done:       make(chan struct{}),
+	}
+}
+
+// Done is closed once the replica stops replicating.
+func (s *SlaveRole) Done() <-chan struct{} {
+	return s.done
+}
+
+// Stop breaks the link with master for good, it's called when this server
+// stops being a replica of it.
+func (s *SlaveRole) Stop() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	close(s.done)
+	if s.conn != nil {
+		s.conn.conn.Close()
+	}
+}
+
+// SetMaster switches replication to another master. The current link is
+// broken and the replica asks the new master to continue from its offset.
+func (s *SlaveRole) SetMaster(address ReplicaAddress) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.Address = address
+	if s.conn != nil {
+		s.conn.conn.Close()
+	}
+}
+
+func (s *SlaveRole) MasterAddress() ReplicaAddress {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.Address
+}
+
+// Promote turns the replica into a master with a new replication id. The
+// id of the old master is kept as the secondary one, so the other replicas
+// of the old master and the sub-replicas can continue from the same offset
+// without a full resynchronization.
+func (s *SlaveRole) Promote() *MasterRole {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	master := s.downstream
+	master.mutex.Lock()
+	defer master.mutex.Unlock()
+	master.proxy = false
+	master.Offset = s.offset
+	master.shiftId(generateRepId())
+	master.createBacklog()
+	return master
+}
+
+// Downstream returns the stream served to sub-replicas. It's available only
+// while the link with master is up, so sub-replicas don't synchronize with
+// a dataset that is about to be replaced.
+func (s *SlaveRole) Downstream() (*MasterRole, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.downstream, s.state == StateConnected
+}
+
+// MasterReplId returns the replication id of the master, empty before the
+// first synchronization.
+func (s *SlaveRole) MasterReplId() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.masterReplId
+}
+
+// RequestFailover makes the next PSYNC ask master to promote itself, which
+// it does when it's a replica of the same stream. The returned channel
+// receives whether the request succeeded.
+func (s *SlaveRole) RequestFailover() <-chan error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.failover = make(chan error, 1)
+	return s.failover
+}
+
+func (s *SlaveRole) failoverDone(err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.failover != nil {
+		s.failover <- err
+		s.failover = nil
+	}
+}
+
+func (s *SlaveRole) setState(state string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if state == StateConnect && s.state == StateConnected {
+		s.linkDownSince = time.Now()
+	}
+	s.state = state
+}
+
+type Connection interface {
+	io.Writer
+	Reader() *resp.BufReader
+	// Handshake reports whether the master sent a snapshot that replaces the
+	// dataset, or replication continues where it stopped.
+	Handshake(port uint16, strategy rdb.ReadStrategy) (bool, error)
+	// Connected marks the link as up once the dataset matches the stream.
+	Connected()
+	// Processed is called after applying each command read from master.
+	Processed()
+	Ack() error
+	Close() error
+}
+
+type SlaveConnection struct {
+	conn          net.Conn
+	reader        *resp.BufReader
+	slave         *SlaveRole
+	initialOffset uint64
+	// pending holds the stream bytes received from master that were not
+	// processed yet, processed is the number of stream bytes processed so
+	// far. Bytes are recorded once the stream starts, the handshake and the
+	// snapshot are not kept.
+	pending   []byte
+	recording bool
+	processed uint64
+	done      chan struct{}
+}
+
+// linkReader fails reads when master stays silent for longer than the
+// timeout, records when data was received last and keeps the received
+// stream bytes until they are forwarded to sub-replicas.
+type linkReader struct {
+	link *SlaveConnection
+}
+
+func (l linkReader) Read(p []byte) (int, error) {
+	slave := l.link.slave
+	if slave.config.Timeout > 0 {
+		l.link.conn.SetReadDeadline(time.Now().Add(slave.config.Timeout))
+	}
+	n, err := l.link.conn.Read(p)
+	if n > 0 {
+		if l.link.recording {
+			l.link.pending = append(l.link.pending, p[:n]...)
+		}
+		slave.mutex.Lock()
+		slave.lastIO = time.Now()
+		slave.mutex.Unlock()
+	}
+	return n, err
+}
+
+func ConnectToMaster(slave *SlaveRole) (Connection, error) {
+	slave.setState(StateConnecting)
+	master := slave.MasterAddress()
+	address := net.JoinHostPort(master.Host, strconv.Itoa(int(master.Port)))
+	conn, err := net.DialTimeout("tcp", address, slave.config.Timeout)
+	if err != nil {
+		slave.setState(StateConnect)
+		return nil, err
+	}
+	connection := &SlaveConnection{
+		conn:  conn,
+		slave: slave,
+		done:  make(chan struct{}),
+	}
+	connection.reader = resp.NewReader(linkReader{link: connection})
+	slave.mutex.Lock()
+	defer slave.mutex.Unlock()
+	select {
+	case <-slave.done:
+		conn.Close()
+		return nil, errStopped
+	default:
+	}
+	slave.conn = connection
+	return connection, nil
+}
+
+func (c *SlaveConnection) Reader() *resp.BufReader {
+	return c.reader
+}
+
+func (c *SlaveConnection) Handshake(port uint16, strategy rdb.ReadStrategy) (bool, error) {
+	response, err := c.call(resp.BulkString("PING"))
+	if err != nil {
+		return false, err
+	}
+	if !isSimpleString(response, "pong") {
+		return false, fmt.Errorf("unexpected response to PING: %q", response.Bytes())
+	}
+
+	// Like Redis, errors are tolerated, masters that don't support
+	// REPLCONF just can't report the replica or send diskless snapshots.
+	for _, replconf := range [][]resp.RespDataType{
+		{resp.BulkString("REPLCONF"), resp.BulkString("listening-port"), resp.BulkString(strconv.Itoa(int(port)))},
+		{resp.BulkString("REPLCONF"), resp.BulkString("capa"), resp.BulkString("eof"), resp.BulkString("capa"), resp.BulkString("psync2")},
+	} {
+		response, err = c.call(replconf...)
+		if e, ok := err.(masterError); ok {
+			fmt.Printf("master does not understand %v %v: %v\n", replconf[0], replconf[1], e)
+		} else if err != nil {
+			return false, err
+		} else if !isSimpleString(response, "ok") {
+			return false, fmt.Errorf("unexpected response to REPLCONF: %q", response.Bytes())
+		}
+	}
+
+	c.slave.setState(StateSync)
+	_, err = c.conn.Write(c.slave.Psync().Bytes())
+	if err != nil {
+		return false, err
+	}
+
+	err = skipKeepAlives(c.reader)
+	if err == nil {
+		response, err = resp.Parse(c.reader)
+	}
+	if e, ok := response.(resp.Error); ok {
+		err = masterError(e)
+	}
+	if err != nil {
+		c.slave.failoverDone(err)
+		return false, err
+	}
+	command, ok := response.(resp.SimpleString)
+	parts := strings.Fields(string(command))
+	if ok && len(parts) > 0 && strings.EqualFold(parts[0], "CONTINUE") {
+		c.slave.failoverDone(nil)
+		c.slave.mutex.Lock()
+		// The master may have been promoted since the last sync, then
+		// it sends its new replication id.
+		if len(parts) == 2 && parts[1] != c.slave.masterReplId {
+			c.slave.masterReplId = parts[1]
+			c.slave.downstream.mutex.Lock()
+			c.slave.downstream.shiftId(parts[1])
+			c.slave.downstream.mutex.Unlock()
+		}
+		offset := c.slave.offset
+		c.slave.mutex.Unlock()
+		c.startStream(offset)
+		return false, nil
+	}
+	if !ok || len(parts) != 3 || !strings.EqualFold(parts[0], "FULLRESYNC") {
+		err = fmt.Errorf("unexpected response to PSYNC: %q", response.Bytes())
+		c.slave.failoverDone(err)
+		return false, err
+	}
+	offset, err := strconv.ParseUint(parts[2], 10, 64)
+	if err != nil {
+		err = fmt.Errorf("unexpected response to PSYNC: %q", response.Bytes())
+		c.slave.failoverDone(err)
+		return false, err
+	}
+	c.slave.failoverDone(nil)
+
+	err = skipKeepAlives(c.reader)
+	if err != nil {
+		return false, err
+	}
+	snapshot, err := resp.OpenRdb(c.reader)
+	if err != nil {
+		return false, err
+	}
+	if c.slave.config.DisklessLoad == DisklessLoadDisabled {
+		err = c.loadFromDisk(snapshot, strategy)
+	} else {
+		err = rdb.Read(bufio.NewReader(snapshot), strategy, true)
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to load snapshot received from master: %w", err)
+	}
+	// Whatever follows the snapshot content, like the EOF mark, must be
+	// consumed before the stream starts.
+	_, err = io.Copy(io.Discard, snapshot)
+	if err != nil {
+		return false, err
+	}
+	c.slave.mutex.Lock()
+	c.slave.masterReplId = parts[1]
+	c.slave.offset = offset
+	c.slave.downstream.mutex.Lock()
+	c.slave.downstream.resetStream(parts[1], offset)
+	c.slave.downstream.mutex.Unlock()
+	c.slave.mutex.Unlock()
+	c.startStream(offset)
+	return true, nil
+}
+
+// skipKeepAlives drops the newlines master sends to keep the link alive
+// while the replica waits for the reply to PSYNC and for the snapshot.
+func skipKeepAlives(reader *resp.BufReader) error {
+	for {
+		next, err := reader.Peek(1)
+		if err != nil {
+			return err
+		}
+		if next[0] != '\n' {
+			return nil
+		}
+		_, err = reader.ReadByte()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// masterError is an error reply of master during the handshake.
+type masterError resp.Error
+
+func (e masterError) Error() string {
+	return "master replied with an error: " + string(e)
+}
+
+// call sends a command of the handshake to master and returns its reply, an
+// error reply is returned as a masterError.
+func (c *SlaveConnection) call(args ...resp.RespDataType) (resp.RespDataType, error) {
+	_, err := c.conn.Write(resp.Array{Content: args}.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	response, err := resp.Parse(c.reader)
+	if err != nil {
+		return nil, err
+	}
+	if e, ok := response.(resp.Error); ok {
+		return nil, masterError(e)
+	}
+	return response, nil
+}
+
+func isSimpleString(response resp.RespDataType, expected string) bool {
+	s, ok := response.(resp.SimpleString)
+	return ok && strings.EqualFold(string(s), expected)
+}
+
+// loadFromDisk stores the snapshot as the RDB file first and loads it from
+// there, the file is replaced only once the whole snapshot was received.
+func (c *SlaveConnection) loadFromDisk(snapshot io.Reader, strategy rdb.ReadStrategy) error {
+	path := c.slave.config.RdbPath
+	tmp := fmt.Sprintf("%s.tmp-%d", path, time.Now().UnixNano())
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, snapshot)
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	file, err = os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return rdb.Read(bufio.NewReader(file), strategy, true)
+}
+
+// startStream starts recording the replication stream, which starts at
+// offset right after the handshake. Its first bytes may have been received
+// along with the end of the handshake, then they are buffered by the
+// reader already.
+func (c *SlaveConnection) startStream(offset uint64) {
+	buffered, _ := c.reader.Peek(c.reader.Buffered())
+	c.pending = bytes.Clone(buffered)
+	c.recording = true
+	c.reader.BytesRead = 0
+	c.processed = 0
+	c.initialOffset = offset
+}
+
+// Processed advances the replication offset past the command applied last
+// and forwards its bytes to sub-replicas exactly as they were received.
+func (c *SlaveConnection) Processed() {
+	n := c.reader.BytesRead - c.processed
+	command := bytes.Clone(c.pending[:n])
+	c.pending = c.pending[n:]
+	c.processed = c.reader.BytesRead
+	c.slave.mutex.Lock()
+	defer c.slave.mutex.Unlock()
+	c.slave.offset = c.initialOffset + c.processed
+	c.slave.downstream.mutex.Lock()
+	defer c.slave.downstream.mutex.Unlock()
+	c.slave.downstream.feed(command)
+}
+
+// Connected marks the link as up and starts acknowledging the processed
+// offset every second, which lets master detect a broken link.
+func (c *SlaveConnection) Connected() {
+	c.slave.setState(StateConnected)
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-c.done:
+				return
+			case <-ticker.C:
+				err := c.Ack()
+				if err != nil {
+					fmt.Printf("failed to send ACK to master: %v\n", err)
+				}
+			}
+		}
+	}()
+}
+
+// Write discards replies, master doesn't expect them.
+func (c *SlaveConnection) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (c *SlaveConnection) Ack() error {
+	c.slave.mutex.Lock()
+	offset := c.slave.offset
+	c.slave.mutex.Unlock()
+	response := resp.Array{
+		Content: []resp.RespDataType{
+			resp.BulkString("REPLCONF"),
+			resp.BulkString("ACK"),
+			resp.BulkString(strconv.FormatUint(offset, 10)),
+		},
+	}
+	_, err := c.conn.Write(response.Bytes())
+	return err
+}
+
+// Close breaks the link with master, replication continues from the same
+// offset after reconnecting.
+func (c *SlaveConnection) Close() error {
+	close(c.done)
+	c.slave.setState(StateConnect)
+	c.slave.mutex.Lock()
+	if c.slave.conn == c {
+		c.slave.conn = nil
+	}
+	c.slave.mutex.Unlock()
+	return c.conn.Close()
+}
+
+func (r *SlaveRole) CollectInfo(info map[string]string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	now := time.Now()
+	info["role"] = "slave"
+	info["master_host"] = r.Address.Host
+	info["master_port"] = strconv.Itoa(int(r.Address.Port))
+	if r.state == StateConnected {
+		info["master_link_status"] = "up"
+	} else {
+		info["master_link_status"] = "down"
+	}
+	if r.lastIO.IsZero() {
+		info["master_last_io_seconds_ago"] = "-1"
+	} else {
+		info["master_last_io_seconds_ago"] = strconv.Itoa(int(now.Sub(r.lastIO).Seconds()))
+	}
+	if r.state == StateSync {
+		info["master_sync_in_progress"] = "1"
+	} else {
+		info["master_sync_in_progress"] = "0"
+	}
+	info["slave_read_repl_offset"] = strconv.FormatUint(r.offset, 10)
+	info["slave_repl_offset"] = strconv.FormatUint(r.offset, 10)
+	if r.state != StateConnected {
+		if r.linkDownSince.IsZero() {
+			info["master_link_down_since_seconds"] = "-1"
+		} else {
+			info["master_link_down_since_seconds"] = strconv.Itoa(int(now.Sub(r.linkDownSince).Seconds()))
+		}
+	}
+	r.downstream.mutex.Lock()
+	r.downstream.collectStreamInfo(info)
+	r.downstream.mutex.Unlock()
+	// There is no replication id until the first synchronization.
+	if r.masterReplId != "" {
+		info["master_replid"] = r.masterReplId
+	} else {
+		delete(info, "master_replid")
+	}
+	info["master_repl_offset"] = strconv.FormatUint(r.offset, 10)
+}
+
+// Psync asks to continue from the first byte not processed yet when the
+// replica already synchronized with a master, and for a full
+// resynchronization otherwise.
+func (s *SlaveRole) Psync() resp.RespDataType {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	masterReplId := "?"
+	offset := "-1"
+	if s.masterReplId != "" {
+		masterReplId = s.masterReplId
+		offset = strconv.FormatUint(s.offset+1, 10)
+	}
+	psync := resp.Array{
+		Content: []resp.RespDataType{
+			resp.BulkString("PSYNC"),
+			resp.BulkString(masterReplId),
+			resp.BulkString(offset),
+		},
+	}
+	if s.failover != nil {
+		psync.Content = append(psync.Content, resp.BulkString("FAILOVER"))
+	}
+	return psync
+}
@@ -0,0 +1,151 @@
+package resp
+
+import (
+	"bytes"
+	"encoding/hex"
+)
+
+// ParseRequest reads a request of a client. Besides RESP arrays, clients
+// like telnet can send inline commands: arguments separated by spaces on a
+// line ending with LF or CRLF.
+func ParseRequest(reader *BufReader) (RespDataType, error) {
+	for {
+		reader.requestStart = reader.BytesRead
+		firstByte, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		reader.UnreadByte()
+		if firstByte == ArrayByte {
+			return Parse(reader)
+		}
+		line, err := reader.readLine(errTooBigInline)
+		if err != nil {
+			return nil, err
+		}
+		if reader.limited() && len(line) > maxLineLength {
+			return nil, errTooBigInline
+		}
+		args, err := splitArgs(bytes.TrimSuffix(line[:len(line)-1], []byte{'\r'}))
+		if err != nil {
+			return nil, err
+		}
+		// Empty lines are skipped, like the newlines telnet sends.
+		if len(args) == 0 {
+			continue
+		}
+		request := Array{Content: make([]RespDataType, 0, len(args))}
+		for _, arg := range args {
+			request.Content = append(request.Content, BulkString(arg))
+		}
+		return request, nil
+	}
+}
+
+var (
+	errUnbalancedQuotes = ProtocolError("unbalanced quotes in request")
+	errTooBigInline     = ProtocolError("too big inline request")
+)
+
+// splitArgs splits an inline command into its arguments. Double quoted
+// arguments can contain escape sequences like \n and \xff, single quoted
+// ones only \'. A closing quote must be followed by a space.
+func splitArgs(line []byte) ([]string, error) {
+	var args []string
+	i := 0
+	for {
+		for i < len(line) && isSpace(line[i]) {
+			i += 1
+		}
+		if i == len(line) {
+			return args, nil
+		}
+		// Quotes may start in the middle of an argument, like in
+		// key"with space", which is a single argument.
+		start := i
+		for i < len(line) && !isSpace(line[i]) && line[i] != '"' && line[i] != '\'' {
+			i += 1
+		}
+		arg := bytes.Clone(line[start:i])
+		if i < len(line) && !isSpace(line[i]) {
+			var quoted []byte
+			var err error
+			if line[i] == '"' {
+				quoted, i, err = splitDoubleQuoted(line, i+1)
+			} else {
+				quoted, i, err = splitSingleQuoted(line, i+1)
+			}
+			if err != nil {
+				return nil, err
+			}
+			arg = append(arg, quoted...)
+		}
+		args = append(args, string(arg))
+	}
+}
+
+// splitDoubleQuoted reads a double quoted argument from start, right after
+// the opening quote, and returns it with the index after the closing quote.
+func splitDoubleQuoted(line []byte, start int) ([]byte, int, error) {
+	var arg []byte
+	for i := start; i < len(line); i++ {
+		switch {
+		case line[i] == '\\' && i+3 < len(line) && line[i+1] == 'x' && isHex(line[i+2]) && isHex(line[i+3]):
+			decoded, _ := hex.DecodeString(string(line[i+2 : i+4]))
+			arg = append(arg, decoded...)
+			i += 3
+		case line[i] == '\\' && i+1 < len(line):
+			i += 1
+			switch line[i] {
+			case 'n':
+				arg = append(arg, '\n')
+			case 'r':
+				arg = append(arg, '\r')
+			case 't':
+				arg = append(arg, '\t')
+			case 'b':
+				arg = append(arg, '\b')
+			case 'a':
+				arg = append(arg, '\a')
+			default:
+				arg = append(arg, line[i])
+			}
+		case line[i] == '"':
+			if i+1 < len(line) && !isSpace(line[i+1]) {
+				return nil, 0, errUnbalancedQuotes
+			}
+			return arg, i + 1, nil
+		default:
+			arg = append(arg, line[i])
+		}
+	}
+	return nil, 0, errUnbalancedQuotes
+}
+
+// splitSingleQuoted is splitDoubleQuoted for single quotes.
+func splitSingleQuoted(line []byte, start int) ([]byte, int, error) {
+	var arg []byte
+	for i := start; i < len(line); i++ {
+		switch {
+		case line[i] == '\\' && i+1 < len(line) && line[i+1] == '\'':
+			arg = append(arg, '\'')
+			i += 1
+		case line[i] == '\'':
+			if i+1 < len(line) && !isSpace(line[i+1]) {
+				return nil, 0, errUnbalancedQuotes
+			}
+			return arg, i + 1, nil
+		default:
+			arg = append(arg, line[i])
+		}
+	}
+	return nil, 0, errUnbalancedQuotes
+}
+
+func isSpace(b byte) bool {
+	return b == ' ' || b == '\t' || b == '\r' || b == '\n' || b == '\v' || b == '\f'
+}
+
+func isHex(b byte) bool {
+	return (b >= '0' && b <= '9') || (b >= 'a' && b <= 'f') || (b >= 'A' && b <= 'F')
+}
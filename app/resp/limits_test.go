@@ -0,0 +1,54 @@
+package resp
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestParseLimits(t *testing.T) {
+	limits := Limits{MaxBulkLength: 16, MaxMultibulkLength: 4, MaxQueryBuffer: 64}
+	tests := []struct {
+		name   string
+		input  string
+		limits Limits
+		// err is the expected error, nil when the input is accepted.
+		err error
+	}{
+		{"within limits", "*2\r\n$4\r\nECHO\r\n$5\r\nhello\r\n", limits, nil},
+		{"multibulk at the limit", "*4\r\n$1\r\na\r\n$1\r\nb\r\n$1\r\nc\r\n$1\r\nd\r\n", limits, nil},
+		{"multibulk over the limit", "*5\r\n", limits, ProtocolError("invalid multibulk length")},
+		{"huge multibulk", "*2147483647\r\n", limits, ProtocolError("invalid multibulk length")},
+		{"multibulk over int32", "*2147483648\r\n", Limits{}, ProtocolError("invalid multibulk length")},
+		{"map over the limit", "%3\r\n", limits, ProtocolError("invalid multibulk length")},
+		{"bulk over the limit", "*1\r\n$17\r\n", limits, ProtocolError("invalid bulk length")},
+		{"huge bulk", "*1\r\n$9999999999\r\n", limits, ProtocolError("invalid bulk length")},
+		{"query buffer exceeded", "*3\r\n$16\r\n0123456789abcdef\r\n$16\r\n0123456789abcdef\r\n$16\r\n0123456789abcdef\r\n", limits, ErrQueryBufferLimit},
+		{"unlimited reader", "*5\r\n$1\r\na\r\n$1\r\nb\r\n$1\r\nc\r\n$1\r\nd\r\n$17\r\n0123456789abcdefg\r\n", Limits{}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reader := NewReader(bytes.NewReader([]byte(test.input)))
+			reader.SetLimits(test.limits)
+			_, err := Parse(reader)
+			if err != test.err {
+				t.Errorf("Parse(%.40q) error = %v, want %v", test.input, err, test.err)
+			}
+		})
+	}
+}
+
+func TestParseRequestInlineLimit(t *testing.T) {
+	line := bytes.Repeat([]byte("a"), maxLineLength+1)
+	reader := NewReader(bytes.NewReader(append(line, "\r\n"...)))
+	reader.SetLimits(Limits{MaxQueryBuffer: 1024 * 1024})
+	_, err := ParseRequest(reader)
+	if err != errTooBigInline {
+		t.Errorf("ParseRequest of a %d bytes line error = %v, want %v", len(line), err, errTooBigInline)
+	}
+
+	reader = NewReader(bytes.NewReader(append(line, "\r\n"...)))
+	request, err := ParseRequest(reader)
+	if err != nil || len(request.(Array).Content) != 1 {
+		t.Errorf("ParseRequest of a %d bytes line without limits = %v, %v", len(line), request, err)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"strconv"
 	"strings"
 )
@@ -38,11 +39,62 @@ type SimpleString string
 type RdbString string
 type Integer int64
 type NullBulkString struct{}
+type NullArray struct{}
 type Error string
 
+// ProtocolError is data that doesn't follow the protocol. Clients sending a
+// malformed request are sent the error and disconnected.
+type ProtocolError string
+
+func (e ProtocolError) Error() string {
+	return "Protocol error: " + string(e)
+}
+
+// IsProtocolError reports whether the request failed to parse because it
+// was malformed, rather than because the connection broke.
+func IsProtocolError(err error) bool {
+	var protocolErr ProtocolError
+	return errors.As(err, &protocolErr)
+}
+
+// Limits bound how much a request can make the server allocate, zero means
+// unlimited. Only client connections are limited, the master link and the
+// AOF are trusted.
+type Limits struct {
+	// MaxBulkLength is the longest bulk string accepted.
+	MaxBulkLength int64
+	// MaxMultibulkLength is the most elements an aggregate may have.
+	MaxMultibulkLength int64
+	// MaxQueryBuffer is the most bytes a single request may span.
+	MaxQueryBuffer int64
+}
+
+const (
+	// maxMultibulkLength is the element count of aggregates no reader
+	// accepts, limited or not.
+	maxMultibulkLength = math.MaxInt32
+	// maxLineLength caps lengths, simple strings and inline requests of
+	// limited readers.
+	maxLineLength = 64 * 1024
+	// bulkChunkSize is how much of a bulk string is allocated at a time, so
+	// that declaring a large length doesn't allocate it before it arrives.
+	bulkChunkSize = 64 * 1024
+	// maxPreallocatedElements is the most elements an aggregate allocates
+	// room for before they arrive.
+	maxPreallocatedElements = 1024
+)
+
+// ErrQueryBufferLimit is returned when a request outgrows the query buffer
+// limit. Unlike protocol errors it is not replied to, the client is just
+// disconnected.
+var ErrQueryBufferLimit = errors.New("query buffer limit reached")
+
 type BufReader struct {
 	reader    *bufio.Reader
 	BytesRead uint64
+	limits    Limits
+	// requestStart is BytesRead when the current request started.
+	requestStart uint64
 }
 
 func NewReader(reader io.Reader) *BufReader {
@@ -51,6 +103,45 @@ func NewReader(reader io.Reader) *BufReader {
 	}
 }
 
+// SetLimits limits the requests read from now on.
+func (r *BufReader) SetLimits(limits Limits) {
+	r.limits = limits
+}
+
+func (r *BufReader) limited() bool {
+	return r.limits != Limits{}
+}
+
+// checkQueryBuffer fails once the current request spans more bytes than
+// the query buffer limit.
+func (r *BufReader) checkQueryBuffer() error {
+	if r.limits.MaxQueryBuffer > 0 && r.BytesRead-r.requestStart > uint64(r.limits.MaxQueryBuffer) {
+		return ErrQueryBufferLimit
+	}
+	return nil
+}
+
+// readLine reads up to and including the next LF. When the reader is
+// limited, lines longer than maxLineLength fail with tooLong instead of
+// being buffered whole.
+func (r *BufReader) readLine(tooLong error) ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := r.reader.ReadSlice('\n')
+		r.BytesRead += uint64(len(chunk))
+		line = append(line, chunk...)
+		if err != bufio.ErrBufferFull {
+			return line, err
+		}
+		if r.limited() && len(line) > maxLineLength {
+			return nil, tooLong
+		}
+		if err := r.checkQueryBuffer(); err != nil {
+			return nil, err
+		}
+	}
+}
+
 func (r *BufReader) Read(p []byte) (int, error) {
 	len, err := r.reader.Read(p)
 	r.BytesRead += uint64(len)
@@ -67,12 +158,20 @@ func (r *BufReader) ReadByte() (byte, error) {
 
 func (r *BufReader) ReadBytes(delim byte) ([]byte, error) {
 	b, err := r.reader.ReadBytes(delim)
-	if err == nil {
-		r.BytesRead += uint64(len(b))
-	}
+	r.BytesRead += uint64(len(b))
 	return b, err
 }
 
+// Buffered returns the number of bytes received but not read yet.
+func (r *BufReader) Buffered() int {
+	return r.reader.Buffered()
+}
+
+// Peek returns the next n bytes without reading them.
+func (r *BufReader) Peek(n int) ([]byte, error) {
+	return r.reader.Peek(n)
+}
+
 func (r *BufReader) UnreadByte() error {
 	err := r.reader.UnreadByte()
 	if err == nil {
@@ -82,6 +181,9 @@ func (r *BufReader) UnreadByte() error {
 }
 
 func Parse(reader *BufReader) (RespDataType, error) {
+	if err := reader.checkQueryBuffer(); err != nil {
+		return nil, err
+	}
 	firstByte, err := reader.ReadByte()
 	if err != nil {
 		fmt.Printf("failed to read byte: %v", err)
@@ -89,29 +191,36 @@ func Parse(reader *BufReader) (RespDataType, error) {
 	}
 	switch firstByte {
 	case BulkStringByte:
-		length, err := readInt(reader)
+		length, err := readLength(reader)
 		if err != nil {
 			return nil, err
 		}
+		if length == -1 {
+			return NullBulkString{}, nil
+		}
+		if reader.limits.MaxBulkLength > 0 && length > reader.limits.MaxBulkLength {
+			return nil, ProtocolError("invalid bulk length")
+		}
 		bytes, err := readExact(reader, int(length))
 		if err != nil {
 			fmt.Printf("failed to read bulk string: %v\n", err)
 			return nil, err
 		}
-		return BulkString(strings.ToLower(string(bytes))), nil
+		return BulkString(bytes), nil
 	case ArrayByte:
-		length, err := readInt(reader)
+		length, err := readLength(reader)
 		if err != nil {
 			return nil, err
 		}
-		elements := make([]RespDataType, 0, length)
-		for i := int64(0); i < length; i++ {
-			nextEl, err := Parse(reader)
-			if err != nil {
-				fmt.Printf("failed to read array element: %v\n", err)
-				return nil, err
-			}
-			elements = append(elements, nextEl)
+		if length == -1 {
+			return NullArray{}, nil
+		}
+		if err := checkMultibulkLength(reader, length); err != nil {
+			return nil, err
+		}
+		elements, err := parseElements(reader, length)
+		if err != nil {
+			return nil, err
 		}
 		return Array{Content: elements}, nil
 	case IntegerByte:
@@ -144,47 +253,278 @@ func Parse(reader *BufReader) (RespDataType, error) {
 			fmt.Printf("failed to read simple string: %v\n", err)
 			return nil, err
 		}
-		return SimpleString(strings.ToLower(string(s))), nil
+		return SimpleString(s), nil
+	case ErrorByte:
+		s, err := readNext(reader)
+		if err != nil {
+			fmt.Printf("failed to read error: %v\n", err)
+			return nil, err
+		}
+		return Error(s), nil
+	case MapByte, SetByte, PushByte, AttributeByte:
+		length, err := readLength(reader)
+		if err != nil {
+			return nil, err
+		}
+		if length == -1 {
+			return nil, ProtocolError("invalid aggregate length")
+		}
+		if firstByte == MapByte || firstByte == AttributeByte {
+			length *= 2
+		}
+		if err := checkMultibulkLength(reader, length); err != nil {
+			return nil, err
+		}
+		elements, err := parseElements(reader, length)
+		if err != nil {
+			return nil, err
+		}
+		switch firstByte {
+		case MapByte:
+			return Map{Content: elements}, nil
+		case SetByte:
+			return Set{Content: elements}, nil
+		case PushByte:
+			return Push{Content: elements}, nil
+		}
+		reply, err := Parse(reader)
+		if err != nil {
+			return nil, err
+		}
+		return Attribute{Content: elements, Reply: reply}, nil
+	case DoubleByte:
+		s, err := readNext(reader)
+		if err != nil {
+			return nil, err
+		}
+		d, err := strconv.ParseFloat(string(s), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid double: %w", err)
+		}
+		return Double(d), nil
+	case BooleanByte:
+		s, err := readNext(reader)
+		if err != nil {
+			return nil, err
+		}
+		switch string(s) {
+		case "t":
+			return Boolean(true), nil
+		case "f":
+			return Boolean(false), nil
+		default:
+			return nil, fmt.Errorf("invalid boolean: %q", s)
+		}
+	case NullByte:
+		_, err := readNext(reader)
+		if err != nil {
+			return nil, err
+		}
+		return Null{}, nil
+	case BigNumberByte:
+		s, err := readNext(reader)
+		if err != nil {
+			return nil, err
+		}
+		return BigNumber(s), nil
+	case VerbatimStringByte:
+		length, err := readLength(reader)
+		if err != nil {
+			return nil, err
+		}
+		if length == -1 {
+			return nil, ProtocolError("invalid verbatim string length")
+		}
+		if reader.limits.MaxBulkLength > 0 && length > reader.limits.MaxBulkLength {
+			return nil, ProtocolError("invalid bulk length")
+		}
+		bytes, err := readExact(reader, int(length))
+		if err != nil {
+			return nil, err
+		}
+		format, content, ok := strings.Cut(string(bytes), ":")
+		if !ok || len(format) != 3 {
+			return nil, fmt.Errorf("invalid verbatim string format: %q", bytes)
+		}
+		return VerbatimString{Format: format, Content: content}, nil
 	default:
 		fmt.Printf("unexpected data type: %v\n", firstByte)
-		return nil, errors.New("unexpected data type")
+		return nil, ProtocolError(fmt.Sprintf("unexpected data type '%c'", firstByte))
+	}
+}
+
+func checkMultibulkLength(reader *BufReader, length int64) error {
+	limit := reader.limits.MaxMultibulkLength
+	if length > maxMultibulkLength || (limit > 0 && length > limit) {
+		return ProtocolError("invalid multibulk length")
+	}
+	return nil
+}
+
+func parseElements(reader *BufReader, length int64) ([]RespDataType, error) {
+	elements := make([]RespDataType, 0, min(length, maxPreallocatedElements))
+	for i := int64(0); i < length; i++ {
+		nextEl, err := Parse(reader)
+		if err != nil {
+			fmt.Printf("failed to read array element: %v\n", err)
+			return nil, err
+		}
+		elements = append(elements, nextEl)
+	}
+	return elements, nil
+}
+
+// OpenRdb starts reading a snapshot sent by the master during full
+// resynchronization and returns a reader of its content. It is encoded as a
+// bulk string without the trailing CRLF, or for diskless transfers as
+// $EOF:<mark> followed by the content and the mark again. The returned
+// reader must be read until io.EOF before reading what follows.
+func OpenRdb(reader *BufReader) (io.Reader, error) {
+	firstByte, err := reader.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	if firstByte != BulkStringByte {
+		return nil, fmt.Errorf("expected RDB bulk string, got: %q", firstByte)
+	}
+	header, err := readNext(reader)
+	if err != nil {
+		return nil, err
+	}
+	if mark, ok := bytes.CutPrefix(header, []byte("EOF:")); ok {
+		if len(mark) != EofMarkLength {
+			return nil, fmt.Errorf("invalid RDB EOF mark: %q", mark)
+		}
+		return &eofReader{reader: reader, mark: mark}, nil
+	}
+	length, err := strconv.ParseInt(string(header), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid RDB length: %q", header)
 	}
+	if length < 0 {
+		return nil, fmt.Errorf("invalid RDB length: %d", length)
+	}
+	return &exactReader{reader: io.LimitReader(reader, length)}, nil
+}
+
+// exactReader fails when the connection is closed before the whole snapshot
+// was received.
+type exactReader struct {
+	reader io.Reader
 }
 
+func (r *exactReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if err == io.EOF && n == 0 {
+		// LimitReader reports EOF both at the limit and when the
+		// connection is closed early, only the former has nothing left.
+		if l := r.reader.(*io.LimitedReader); l.N > 0 {
+			return 0, io.ErrUnexpectedEOF
+		}
+	}
+	return n, err
+}
+
+// eofReader returns the bytes up to the EOF mark. The last bytes are held
+// back until it's clear they're not the beginning of the mark.
+type eofReader struct {
+	reader *BufReader
+	mark   []byte
+	window []byte
+	done   bool
+}
+
+func (r *eofReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) && !r.done {
+		b, err := r.reader.ReadByte()
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return n, err
+		}
+		r.window = append(r.window, b)
+		if len(r.window) > len(r.mark) {
+			p[n] = r.window[0]
+			n += 1
+			r.window = append(r.window[:0], r.window[1:]...)
+		}
+		r.done = bytes.Equal(r.window, r.mark)
+	}
+	if n == 0 && r.done {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+var errTooBigLine = ProtocolError("too big line")
+
 func readNext(reader *BufReader) ([]byte, error) {
 	var bytes bytes.Buffer
 	for {
-		next, err := reader.ReadBytes('\n')
+		next, err := reader.readLine(errTooBigLine)
 		if err != nil {
 			return nil, err
 		}
 		var length = len(next)
 		if length == 1 {
 			bytes.Write(next)
-			continue
-		}
-		if next[length-2] == '\r' {
+		} else if next[length-2] == '\r' {
 			bytes.Write(next[0 : length-2])
 			return bytes.Bytes(), nil
 		}
+		if reader.limited() && bytes.Len() > maxLineLength {
+			return nil, errTooBigLine
+		}
 	}
 }
 
+// readExact reads a bulk string of count bytes and its terminator. The
+// string is allocated a chunk at a time as it arrives.
 func readExact(reader *BufReader, count int) ([]byte, error) {
-	buf := make([]byte, count)
-	_, err := io.ReadFull(reader, buf)
-	if err != nil {
-		return nil, err
+	var buf bytes.Buffer
+	buf.Grow(min(count, bulkChunkSize))
+	for buf.Len() < count {
+		_, err := io.CopyN(&buf, reader, int64(min(count-buf.Len(), bulkChunkSize)))
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := reader.checkQueryBuffer(); err != nil {
+			return nil, err
+		}
 	}
 	for _, char := range [2]byte{'\r', '\n'} {
 		next, err := reader.ReadByte()
-		if err != nil || next != char {
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		if next != char {
 			reader.UnreadByte()
 			break
 		}
 	}
 
-	return buf, nil
+	return buf.Bytes(), nil
+}
+
+// readLength reads the length of a bulk string or an aggregate, -1 stands
+// for null.
+func readLength(reader *BufReader) (int64, error) {
+	length, err := readInt(reader)
+	if err != nil {
+		return 0, err
+	}
+	if length < -1 {
+		return 0, ProtocolError(fmt.Sprintf("invalid length %d", length))
+	}
+	return length, nil
 }
 
 func readInt(reader *BufReader) (int64, error) {
@@ -196,7 +536,7 @@ func readInt(reader *BufReader) (int64, error) {
 	length, err := strconv.ParseInt(string(lengthBytes), 10, 64)
 	if err != nil {
 		fmt.Printf("failed to convert length to int: %v", err)
-		return 0, err
+		return 0, ProtocolError(fmt.Sprintf("invalid integer %q", lengthBytes))
 	}
 	return length, err
 }
@@ -231,6 +571,67 @@ func (s RdbString) Bytes() []byte {
 	return bytes.Bytes()
 }
 
+// EofMarkLength is the length of the mark that ends a diskless transfer.
+const EofMarkLength = 40
+
+// EofRdbString is a snapshot sent by a diskless master, its size is not known
+// in advance so it ends with a random mark instead.
+type EofRdbString struct {
+	Mark    string
+	Content string
+}
+
+func (s EofRdbString) Bytes() []byte {
+	var bytes bytes.Buffer
+	bytes.WriteByte(BulkStringByte)
+	bytes.WriteString("EOF:")
+	bytes.WriteString(s.Mark)
+	writeTerminator(&bytes)
+	bytes.WriteString(s.Content)
+	bytes.WriteString(s.Mark)
+	return bytes.Bytes()
+}
+
+// EofRdbWriter streams a snapshot encoded like EofRdbString, for snapshots
+// that are written while they are encoded. The header is written on the
+// first write and Close writes the mark.
+type EofRdbWriter struct {
+	writer  io.Writer
+	mark    string
+	started bool
+}
+
+func NewEofRdbWriter(w io.Writer, mark string) *EofRdbWriter {
+	return &EofRdbWriter{writer: w, mark: mark}
+}
+
+func (w *EofRdbWriter) Write(p []byte) (int, error) {
+	err := w.start()
+	if err != nil {
+		return 0, err
+	}
+	return w.writer.Write(p)
+}
+
+// Close ends the snapshot, it doesn't close the underlying writer.
+func (w *EofRdbWriter) Close() error {
+	err := w.start()
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w.writer, w.mark)
+	return err
+}
+
+func (w *EofRdbWriter) start() error {
+	if w.started {
+		return nil
+	}
+	w.started = true
+	_, err := io.WriteString(w.writer, "$EOF:"+w.mark+"\r\n")
+	return err
+}
+
 func (s NullBulkString) Bytes() []byte {
 	var bytes bytes.Buffer
 	bytes.WriteByte(BulkStringByte)
@@ -239,6 +640,14 @@ func (s NullBulkString) Bytes() []byte {
 	return bytes.Bytes()
 }
 
+func (a NullArray) Bytes() []byte {
+	var bytes bytes.Buffer
+	bytes.WriteByte(ArrayByte)
+	bytes.Write([]byte(strconv.Itoa(-1)))
+	writeTerminator(&bytes)
+	return bytes.Bytes()
+}
+
 func (s SimpleString) Bytes() []byte {
 	var bytes bytes.Buffer
 	bytes.WriteByte(SimpleStringByte)
@@ -250,10 +659,7 @@ func (s SimpleString) Bytes() []byte {
 func (i Integer) Bytes() []byte {
 	var bytes bytes.Buffer
 	bytes.WriteByte(IntegerByte)
-	if i < 0 {
-		bytes.WriteByte('-')
-	}
-	bytes.Write([]byte(strconv.Itoa(int(i))))
+	bytes.Write([]byte(strconv.FormatInt(int64(i), 10)))
 	writeTerminator(&bytes)
 	return bytes.Bytes()
 }
@@ -279,6 +685,12 @@ func String(r RespDataType) string {
 		return string(t)
 	case Integer:
 		return strconv.Itoa(int(t))
+	case VerbatimString:
+		return t.Content
+	case BigNumber:
+		return string(t)
+	case Double:
+		return formatDouble(float64(t))
 	default:
 		return ""
 	}
@@ -0,0 +1,198 @@
+package resp
+
+import (
+	"bytes"
+	"math"
+	"strconv"
+)
+
+const (
+	MapByte            = '%'
+	SetByte            = '~'
+	PushByte           = '>'
+	AttributeByte      = '|'
+	DoubleByte         = ','
+	BooleanByte        = '#'
+	NullByte           = '_'
+	BigNumberByte      = '('
+	VerbatimStringByte = '='
+)
+
+// Map holds its keys and values alternately, like the RESP2 array it is
+// sent as to clients that didn't switch to RESP3.
+type Map struct {
+	Content []RespDataType
+}
+
+type Set struct {
+	Content []RespDataType
+}
+
+// Push is an out of band message like a Pub/Sub message.
+type Push struct {
+	Content []RespDataType
+}
+
+// Attribute carries auxiliary keys and values, stored alternately, along
+// with the reply they describe.
+type Attribute struct {
+	Content []RespDataType
+	Reply   RespDataType
+}
+
+type Double float64
+type Boolean bool
+type Null struct{}
+
+// BigNumber is an integer that may not fit 64 bits, in decimal.
+type BigNumber string
+
+// VerbatimString is a string to show as is, Format is its three letter
+// type, txt or mkd.
+type VerbatimString struct {
+	Format  string
+	Content string
+}
+
+func (m Map) Bytes() []byte {
+	return aggregateBytes(MapByte, len(m.Content)/2, m.Content)
+}
+
+func (s Set) Bytes() []byte {
+	return aggregateBytes(SetByte, len(s.Content), s.Content)
+}
+
+func (p Push) Bytes() []byte {
+	return aggregateBytes(PushByte, len(p.Content), p.Content)
+}
+
+func (a Attribute) Bytes() []byte {
+	return append(aggregateBytes(AttributeByte, len(a.Content)/2, a.Content), a.Reply.Bytes()...)
+}
+
+func aggregateBytes(kind byte, length int, content []RespDataType) []byte {
+	var bytes bytes.Buffer
+	bytes.WriteByte(kind)
+	bytes.WriteString(strconv.Itoa(length))
+	writeTerminator(&bytes)
+	for _, element := range content {
+		bytes.Write(element.Bytes())
+	}
+	return bytes.Bytes()
+}
+
+func (d Double) Bytes() []byte {
+	var bytes bytes.Buffer
+	bytes.WriteByte(DoubleByte)
+	bytes.WriteString(formatDouble(float64(d)))
+	writeTerminator(&bytes)
+	return bytes.Bytes()
+}
+
+func formatDouble(d float64) string {
+	return string(appendDouble(nil, d))
+}
+
+func appendDouble(dst []byte, d float64) []byte {
+	switch {
+	case math.IsInf(d, 1):
+		return append(dst, "inf"...)
+	case math.IsInf(d, -1):
+		return append(dst, "-inf"...)
+	case math.IsNaN(d):
+		return append(dst, "nan"...)
+	default:
+		return strconv.AppendFloat(dst, d, 'g', 17, 64)
+	}
+}
+
+func (b Boolean) Bytes() []byte {
+	if b {
+		return []byte("#t\r\n")
+	}
+	return []byte("#f\r\n")
+}
+
+func (n Null) Bytes() []byte {
+	return []byte("_\r\n")
+}
+
+func (n BigNumber) Bytes() []byte {
+	var bytes bytes.Buffer
+	bytes.WriteByte(BigNumberByte)
+	bytes.WriteString(string(n))
+	writeTerminator(&bytes)
+	return bytes.Bytes()
+}
+
+func (s VerbatimString) Bytes() []byte {
+	var bytes bytes.Buffer
+	bytes.WriteByte(VerbatimStringByte)
+	bytes.WriteString(strconv.Itoa(len(s.Format) + 1 + len(s.Content)))
+	writeTerminator(&bytes)
+	bytes.WriteString(s.Format)
+	bytes.WriteByte(':')
+	bytes.WriteString(s.Content)
+	writeTerminator(&bytes)
+	return bytes.Bytes()
+}
+
+// Convert adapts a reply to the protocol version of the client. Replies are
+// built with RESP3 types, RESP2 clients get their closest RESP2 equivalent,
+// and the RESP2 nulls become the RESP3 one.
+func Convert(r RespDataType, protocol int) RespDataType {
+	if protocol >= 3 {
+		switch t := r.(type) {
+		case NullBulkString, NullArray:
+			return Null{}
+		case Array:
+			return Array{Content: convertAll(t.Content, protocol)}
+		case Map:
+			return Map{Content: convertAll(t.Content, protocol)}
+		case Set:
+			return Set{Content: convertAll(t.Content, protocol)}
+		case Push:
+			return Push{Content: convertAll(t.Content, protocol)}
+		case Attribute:
+			return Attribute{Content: convertAll(t.Content, protocol), Reply: Convert(t.Reply, protocol)}
+		default:
+			return r
+		}
+	}
+	switch t := r.(type) {
+	case Array:
+		return Array{Content: convertAll(t.Content, protocol)}
+	case Map:
+		return Array{Content: convertAll(t.Content, protocol)}
+	case Set:
+		return Array{Content: convertAll(t.Content, protocol)}
+	case Push:
+		return Array{Content: convertAll(t.Content, protocol)}
+	case Attribute:
+		// RESP2 has no way to send attributes, only the reply is kept.
+		return Convert(t.Reply, protocol)
+	case Double:
+		return BulkString(formatDouble(float64(t)))
+	case Boolean:
+		if t {
+			return Integer(1)
+		}
+		return Integer(0)
+	case Null:
+		return NullBulkString{}
+	case BigNumber:
+		return BulkString(t)
+	case VerbatimString:
+		return BulkString(t.Content)
+	default:
+		return r
+	}
+}
+
+func convertAll(content []RespDataType, protocol int) []RespDataType {
+	converted := make([]RespDataType, len(content))
+	for i, element := range content {
+		converted[i] = Convert(element, protocol)
+	}
+	return converted
+}
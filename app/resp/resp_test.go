@@ -0,0 +1,173 @@
+package resp
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func parseString(t *testing.T, input string) RespDataType {
+	t.Helper()
+	parsed, err := Parse(NewReader(bytes.NewReader([]byte(input))))
+	if err != nil {
+		t.Fatalf("Parse(%q) failed: %v", input, err)
+	}
+	return parsed
+}
+
+func TestParsePreservesCase(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    RespDataType
+		command string
+	}{
+		{
+			name:    "mixed case keyword",
+			input:   "*3\r\n$3\r\nSeT\r\n$3\r\nKey\r\n$5\r\nVaLuE\r\n",
+			want:    Array{Content: []RespDataType{BulkString("SeT"), BulkString("Key"), BulkString("VaLuE")}},
+			command: "set",
+		},
+		{
+			name:    "upper case keyword and option",
+			input:   "*5\r\n$3\r\nSET\r\n$1\r\nk\r\n$1\r\nV\r\n$2\r\nPx\r\n$3\r\n100\r\n",
+			want:    Array{Content: []RespDataType{BulkString("SET"), BulkString("k"), BulkString("V"), BulkString("Px"), BulkString("100")}},
+			command: "set",
+		},
+		{
+			name:  "simple string",
+			input: "+FullResync\r\n",
+			want:  SimpleString("FullResync"),
+		},
+		{
+			name:  "error",
+			input: "-NOAUTH Authentication Required.\r\n",
+			want:  Error("NOAUTH Authentication Required."),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := parseString(t, test.input)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("Parse(%q) = %#v, want %#v", test.input, got, test.want)
+			}
+			if array, ok := got.(Array); ok && array.Command() != test.command {
+				t.Errorf("Command() = %q, want %q", array.Command(), test.command)
+			}
+		})
+	}
+}
+
+func TestBinaryBulkStringRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		value BulkString
+	}{
+		{"empty", ""},
+		{"mixed case", "HeLLo WoRLD"},
+		{"crlf", "line one\r\nline two\r\n"},
+		{"lone cr and lf", "a\rb\nc"},
+		{"nul bytes", "\x00key\x00\x00"},
+		{"non utf-8", "\xff\xfe\xc3\x28\x80"},
+		{"resp lookalike", "*2\r\n$3\r\nSET\r\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := Array{Content: []RespDataType{BulkString("SeT"), test.value, test.value}}
+			got := parseString(t, string(request.Bytes()))
+			if !reflect.DeepEqual(got, request) {
+				t.Errorf("round trip of %q = %#v", test.value, got)
+			}
+
+			var buf bytes.Buffer
+			w := NewWriter(&buf)
+			for _, protocol := range []int{2, 3} {
+				buf.Reset()
+				if err := w.Encode(test.value, protocol); err != nil {
+					t.Fatal(err)
+				}
+				if err := w.Flush(); err != nil {
+					t.Fatal(err)
+				}
+				got := parseString(t, buf.String())
+				if got != test.value {
+					t.Errorf("RESP%d round trip of %q = %#v", protocol, test.value, got)
+				}
+			}
+		})
+	}
+}
+
+func TestParseRequestInlinePreservesCase(t *testing.T) {
+	tests := []struct {
+		input string
+		want  []string
+	}{
+		{"GeT MyKey\r\n", []string{"GeT", "MyKey"}},
+		{"set k \"A\\x00\\xffB\"\n", []string{"set", "k", "A\x00\xffB"}},
+		{"SET k 'Line\\'s'\r\n", []string{"SET", "k", "Line's"}},
+	}
+	for _, test := range tests {
+		got, err := ParseRequest(NewReader(bytes.NewReader([]byte(test.input))))
+		if err != nil {
+			t.Fatalf("ParseRequest(%q) failed: %v", test.input, err)
+		}
+		want := Array{}
+		for _, arg := range test.want {
+			want.Content = append(want.Content, BulkString(arg))
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("ParseRequest(%q) = %#v, want %#v", test.input, got, want)
+		}
+	}
+}
+
+func TestEofRdbWriterRoundTrip(t *testing.T) {
+	mark := strings.Repeat("ab", EofMarkLength/2)
+	tests := []struct {
+		name   string
+		writes []string
+	}{
+		{"empty", nil},
+		{"single write", []string{"REDIS0011\xff\x00"}},
+		{"mark prefix in content", []string{"a", "x", mark[:EofMarkLength-1], "x"}},
+		{"crlf", []string{"\r\n", "$EOF:\r\n"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			w := NewEofRdbWriter(&buf, mark)
+			for _, write := range test.writes {
+				if _, err := w.Write([]byte(write)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			want := strings.Join(test.writes, "")
+			if buf.String() != string(EofRdbString{Mark: mark, Content: want}.Bytes()) {
+				t.Errorf("EofRdbWriter wrote %q", buf.String())
+			}
+			buf.WriteString("+PING\r\n")
+			reader := NewReader(&buf)
+			snapshot, err := OpenRdb(reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(snapshot)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != want {
+				t.Errorf("OpenRdb read %q, want %q", got, want)
+			}
+			next, err := Parse(reader)
+			if err != nil || next != SimpleString("PING") {
+				t.Errorf("Parse() after the snapshot = %#v, %v", next, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,164 @@
+package resp
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"sync"
+)
+
+// Writer encodes replies into the buffered output of a connection. Replies
+// made of simple types, bulk strings and aggregates of them are written
+// element by element without building their bytes first, other types like
+// RDB payloads are still built with Bytes. Nothing is sent until Flush, so
+// the replies to pipelined requests go out together. It's safe for
+// concurrent use, e.g. by a client and the Pub/Sub messages sent to it.
+type Writer struct {
+	mutex sync.Mutex
+	out   *bufio.Writer
+	// scratch holds formatted numbers.
+	scratch [32]byte
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{out: bufio.NewWriterSize(w, 16*1024)}
+}
+
+// Encode buffers the reply in the protocol version, converted as Convert
+// does.
+func (w *Writer) Encode(r RespDataType, protocol int) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.encode(r, protocol >= 3)
+	// bufio.Writer keeps the first error and returns it on every write.
+	_, err := w.out.Write(nil)
+	return err
+}
+
+// Flush sends the buffered replies.
+func (w *Writer) Flush() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.out.Flush()
+}
+
+func (w *Writer) encode(r RespDataType, resp3 bool) {
+	switch t := r.(type) {
+	case SimpleString:
+		w.line(SimpleStringByte, string(t))
+	case Error:
+		w.line(ErrorByte, string(t))
+	case Integer:
+		w.header(IntegerByte, int64(t))
+	case BulkString:
+		w.bulk(string(t))
+	case NullBulkString, Null:
+		w.null(resp3, "$-1\r\n")
+	case NullArray:
+		w.null(resp3, "*-1\r\n")
+	case Array:
+		w.aggregate(ArrayByte, len(t.Content), t.Content, resp3)
+	case Map:
+		if resp3 {
+			w.aggregate(MapByte, len(t.Content)/2, t.Content, resp3)
+		} else {
+			w.aggregate(ArrayByte, len(t.Content), t.Content, resp3)
+		}
+	case Set:
+		w.aggregate(w.kind(resp3, SetByte), len(t.Content), t.Content, resp3)
+	case Push:
+		w.aggregate(w.kind(resp3, PushByte), len(t.Content), t.Content, resp3)
+	case Attribute:
+		// RESP2 has no way to send attributes, only the reply is kept.
+		if resp3 {
+			w.aggregate(AttributeByte, len(t.Content)/2, t.Content, resp3)
+		}
+		w.encode(t.Reply, resp3)
+	case Double:
+		// header reuses scratch, so the double is formatted apart.
+		var number [32]byte
+		formatted := appendDouble(number[:0], float64(t))
+		if resp3 {
+			w.out.WriteByte(DoubleByte)
+			w.out.Write(formatted)
+			w.out.WriteString("\r\n")
+		} else {
+			w.header(BulkStringByte, int64(len(formatted)))
+			w.out.Write(formatted)
+			w.out.WriteString("\r\n")
+		}
+	case Boolean:
+		switch {
+		case resp3 && bool(t):
+			w.out.WriteString("#t\r\n")
+		case resp3:
+			w.out.WriteString("#f\r\n")
+		case bool(t):
+			w.out.WriteString(":1\r\n")
+		default:
+			w.out.WriteString(":0\r\n")
+		}
+	case BigNumber:
+		if resp3 {
+			w.line(BigNumberByte, string(t))
+		} else {
+			w.bulk(string(t))
+		}
+	case VerbatimString:
+		if resp3 {
+			w.header(VerbatimStringByte, int64(len(t.Format)+1+len(t.Content)))
+			w.out.WriteString(t.Format)
+			w.out.WriteByte(':')
+			w.out.WriteString(t.Content)
+			w.out.WriteString("\r\n")
+		} else {
+			w.bulk(t.Content)
+		}
+	default:
+		// RDB payloads are rare and not worth encoding here.
+		w.out.Write(r.Bytes())
+	}
+}
+
+// kind returns the type byte of a RESP3 aggregate, sent as an array to RESP2
+// clients.
+func (w *Writer) kind(resp3 bool, kind byte) byte {
+	if resp3 {
+		return kind
+	}
+	return ArrayByte
+}
+
+func (w *Writer) aggregate(kind byte, length int, content []RespDataType, resp3 bool) {
+	w.header(kind, int64(length))
+	for _, element := range content {
+		w.encode(element, resp3)
+	}
+}
+
+func (w *Writer) null(resp3 bool, resp2 string) {
+	if resp3 {
+		w.out.WriteString("_\r\n")
+	} else {
+		w.out.WriteString(resp2)
+	}
+}
+
+// header writes the type byte followed by a length or an integer.
+func (w *Writer) header(kind byte, n int64) {
+	w.out.WriteByte(kind)
+	w.out.Write(strconv.AppendInt(w.scratch[:0], n, 10))
+	w.out.WriteString("\r\n")
+}
+
+func (w *Writer) line(kind byte, s string) {
+	w.out.WriteByte(kind)
+	w.out.WriteString(s)
+	w.out.WriteString("\r\n")
+}
+
+func (w *Writer) bulk(s string) {
+	w.header(BulkStringByte, int64(len(s)))
+	w.out.WriteString(s)
+	w.out.WriteString("\r\n")
+}
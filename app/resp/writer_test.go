@@ -0,0 +1,56 @@
+package resp
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWriterMatchesConvert(t *testing.T) {
+	tests := []struct {
+		name  string
+		reply RespDataType
+	}{
+		{"simple string", SimpleString("OK")},
+		{"error", Error("ERR bad")},
+		{"integer", Integer(-42)},
+		{"bulk string", BulkString("a\r\nb")},
+		{"null bulk string", NullBulkString{}},
+		{"null array", NullArray{}},
+		{"null", Null{}},
+		{"empty array", Array{Content: []RespDataType{}}},
+		{"nested array", Array{Content: []RespDataType{BulkString("x"), Array{Content: []RespDataType{Integer(1), NullBulkString{}}}}}},
+		{"map", Map{Content: []RespDataType{BulkString("k"), Integer(1), BulkString("n"), Null{}}}},
+		{"set", Set{Content: []RespDataType{BulkString("a"), BulkString("b")}}},
+		{"push", Push{Content: []RespDataType{BulkString("message"), BulkString("ch"), BulkString("hi")}}},
+		{"attribute", Attribute{Content: []RespDataType{BulkString("ttl"), Integer(3)}, Reply: BulkString("v")}},
+		{"double", Double(1.5)},
+		{"infinite double", Double(posInf())},
+		{"booleans", Array{Content: []RespDataType{Boolean(true), Boolean(false)}}},
+		{"big number", BigNumber("123456789012345678901234567890")},
+		{"verbatim string", VerbatimString{Format: "txt", Content: "some text"}},
+		{"rdb payload", RdbString("REDIS0011")},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, protocol := range []int{2, 3} {
+				var buf bytes.Buffer
+				w := NewWriter(&buf)
+				if err := w.Encode(test.reply, protocol); err != nil {
+					t.Fatal(err)
+				}
+				if err := w.Flush(); err != nil {
+					t.Fatal(err)
+				}
+				want := Convert(test.reply, protocol).Bytes()
+				if !bytes.Equal(buf.Bytes(), want) {
+					t.Errorf("RESP%d Encode(%#v) = %q, want %q", protocol, test.reply, buf.Bytes(), want)
+				}
+			}
+		})
+	}
+}
+
+func posInf() float64 {
+	var zero float64
+	return 1 / zero
+}
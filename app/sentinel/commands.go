@@ -0,0 +1,428 @@
+package sentinel
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/replication"
+	"github.com/codecrafters-io/redis-starter-go/app/resp"
+)
+
+const (
+	// outputQueueSize is how many replies and events can wait for a slow
+	// subscriber before it's disconnected.
+	outputQueueSize = 1024
+	// clientWriteTimeout limits writing to a client.
+	clientWriteTimeout = 10 * time.Second
+)
+
+func (s *Sentinel) serveClient(conn net.Conn) {
+	defer conn.Close()
+	defer s.disconnect(conn)
+	reader := resp.NewReader(conn)
+	reader.SetLimits(s.limits)
+	for {
+		req, err := resp.ParseRequest(reader)
+		if resp.IsProtocolError(err) {
+			s.reply(conn, resp.Error("ERR "+err.Error()))
+		}
+		if err != nil {
+			fmt.Printf("RESP parsing failed: %s\n", err)
+			return
+		}
+		request, ok := req.(resp.Array)
+		if !ok || len(request.Content) == 0 {
+			continue
+		}
+		reply := s.handle(request, conn)
+		if reply == nil {
+			continue
+		}
+		if !s.reply(conn, reply) {
+			return
+		}
+	}
+}
+
+// reply writes a reply to the client, through its output queue once it
+// subscribed so that replies and events stay in order. It returns false
+// when the client can't be written to.
+func (s *Sentinel) reply(conn net.Conn, reply resp.RespDataType) bool {
+	s.mutex.Lock()
+	_, queued := s.outputs[conn]
+	if queued {
+		s.send(conn, reply.Bytes())
+	}
+	s.mutex.Unlock()
+	if queued {
+		return true
+	}
+	conn.SetWriteDeadline(time.Now().Add(clientWriteTimeout))
+	_, err := conn.Write(reply.Bytes())
+	return err == nil
+}
+
+// send queues a message for the client, starting its writer on the first
+// one. A client whose queue is full is disconnected rather than blocking
+// the sentinel. Caller must hold the mutex.
+func (s *Sentinel) send(conn net.Conn, message []byte) {
+	queue, ok := s.outputs[conn]
+	if !ok {
+		queue = make(chan []byte, outputQueueSize)
+		s.outputs[conn] = queue
+		go writeOutput(conn, queue)
+	}
+	select {
+	case queue <- message:
+	default:
+		fmt.Printf("Client %v is too slow reading events, disconnecting\n", conn.RemoteAddr())
+		s.drop(conn)
+		conn.Close()
+	}
+}
+
+// writeOutput writes the queued messages until the queue is closed.
+func writeOutput(conn net.Conn, queue <-chan []byte) {
+	for message := range queue {
+		conn.SetWriteDeadline(time.Now().Add(clientWriteTimeout))
+		_, err := conn.Write(message)
+		if err != nil {
+			conn.Close()
+			for range queue {
+			}
+			return
+		}
+	}
+}
+
+// handle runs a client command and returns its reply, nil when the replies
+// were already written.
+func (s *Sentinel) handle(request resp.Array, conn net.Conn) resp.RespDataType {
+	args := request.Content[1:]
+	switch request.Command() {
+	case "ping":
+		return resp.SimpleString("PONG")
+	case "info":
+		return s.info()
+	case "role":
+		return s.role()
+	case "subscribe":
+		s.subscribe(conn, args)
+		return nil
+	case "unsubscribe":
+		s.unsubscribe(conn)
+		return resp.Array{Content: []resp.RespDataType{
+			resp.BulkString("unsubscribe"),
+			resp.NullBulkString{},
+			resp.Integer(0),
+		}}
+	case "sentinel":
+		return s.sentinel(args)
+	default:
+		return resp.Error(fmt.Sprintf("ERR unknown command '%v'", request.Command()))
+	}
+}
+
+func (s *Sentinel) sentinel(args []resp.RespDataType) resp.RespDataType {
+	if len(args) == 0 {
+		return resp.Error("ERR wrong number of arguments for 'sentinel' command")
+	}
+	subcommand := strings.ToLower(resp.String(args[0]))
+	args = args[1:]
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	switch subcommand {
+	case "myid":
+		return resp.BulkString(s.id)
+	case "masters":
+		masters := resp.Array{Content: []resp.RespDataType{}}
+		for _, m := range s.masters {
+			masters.Content = append(masters.Content, s.masterState(m))
+		}
+		return masters
+	case "is-master-down-by-addr":
+		return s.isMasterDownByAddr(args)
+	}
+
+	if len(args) != 1 {
+		return resp.Error(fmt.Sprintf("ERR wrong number of arguments for 'sentinel|%v' command", subcommand))
+	}
+	name := resp.String(args[0])
+	m := s.master(name)
+	if subcommand == "get-master-addr-by-name" {
+		if m == nil {
+			return resp.NullArray{}
+		}
+		return resp.Array{Content: []resp.RespDataType{
+			resp.BulkString(m.address.Host),
+			resp.BulkString(strconv.Itoa(int(m.address.Port))),
+		}}
+	}
+	if m == nil {
+		return resp.Error("ERR No such master with that name")
+	}
+	switch subcommand {
+	case "master":
+		return s.masterState(m)
+	case "replicas", "slaves":
+		replicas := resp.Array{Content: []resp.RespDataType{}}
+		for _, r := range sortedInstances(m.replicas) {
+			replicas.Content = append(replicas.Content, s.replicaState(m, r))
+		}
+		return replicas
+	case "sentinels":
+		sentinels := resp.Array{Content: []resp.RespDataType{}}
+		for _, p := range m.sentinels {
+			sentinels.Content = append(sentinels.Content, fields(
+				"name", p.runId,
+				"ip", p.address.Host,
+				"port", strconv.Itoa(int(p.address.Port)),
+				"runid", p.runId,
+				"flags", "sentinel",
+				"last-hello-message", milliseconds(time.Since(p.lastHello)),
+				"voted-leader", p.leader,
+				"voted-leader-epoch", strconv.FormatUint(p.leaderEpoch, 10),
+			))
+		}
+		return sentinels
+	case "failover":
+		if m.failover != nil {
+			return resp.Error("INPROG Failover already in progress")
+		}
+		if s.selectReplica(m, time.Now()) == nil {
+			return resp.Error("NOGOODSLAVE No suitable replica to promote")
+		}
+		s.startFailover(m, time.Now(), true)
+		return resp.SimpleString("OK")
+	case "ckquorum":
+		usable := 1
+		for _, p := range m.sentinels {
+			if time.Since(p.lastHello) < 5*helloPeriod {
+				usable += 1
+			}
+		}
+		majority := (len(m.sentinels)+1)/2 + 1
+		if usable < m.quorum {
+			return resp.Error(fmt.Sprintf("NOQUORUM %d usable Sentinels. Not enough available Sentinels to reach the specified quorum for this master", usable))
+		}
+		if usable < majority {
+			return resp.Error(fmt.Sprintf("NOQUORUM %d usable Sentinels. Not enough available Sentinels to reach the majority and authorize a failover", usable))
+		}
+		return resp.SimpleString(fmt.Sprintf("OK %d usable Sentinels. Quorum and failover authorization can be reached", usable))
+	default:
+		return resp.Error(fmt.Sprintf("ERR unknown subcommand '%v'", subcommand))
+	}
+}
+
+// isMasterDownByAddr replies whether this sentinel considers the master down
+// and, when the caller is a candidate rather than *, which sentinel it voted
+// for in the epoch. Caller must hold the mutex.
+func (s *Sentinel) isMasterDownByAddr(args []resp.RespDataType) resp.RespDataType {
+	if len(args) != 4 {
+		return resp.Error("ERR wrong number of arguments for 'sentinel|is-master-down-by-addr' command")
+	}
+	port, err1 := strconv.ParseUint(resp.String(args[1]), 10, 16)
+	epoch, err2 := strconv.ParseUint(resp.String(args[2]), 10, 64)
+	if err1 != nil || err2 != nil {
+		return resp.Error("ERR value is not an integer or out of range")
+	}
+	address := replication.ReplicaAddress{Host: resp.String(args[0]), Port: uint16(port)}
+	down := 0
+	leader, leaderEpoch := "*", uint64(0)
+	for _, m := range s.masters {
+		if m.address != address {
+			continue
+		}
+		if !m.sdownSince.IsZero() {
+			down = 1
+		}
+		if candidate := resp.String(args[3]); candidate != "*" {
+			s.vote(m, candidate, epoch)
+			leader, leaderEpoch = m.leader, m.leaderEpoch
+		}
+	}
+	return resp.Array{Content: []resp.RespDataType{
+		resp.Integer(down),
+		resp.BulkString(leader),
+		resp.Integer(leaderEpoch),
+	}}
+}
+
+// masterState describes the master as a list of field names and values.
+// Caller must hold the mutex.
+func (s *Sentinel) masterState(m *master) resp.Array {
+	flags := []string{"master"}
+	if !m.sdownSince.IsZero() {
+		flags = append(flags, "s_down")
+	}
+	if m.odown {
+		flags = append(flags, "o_down")
+	}
+	if m.failover != nil {
+		flags = append(flags, "failover_in_progress")
+	}
+	state := fields(
+		"name", m.name,
+		"ip", m.address.Host,
+		"port", strconv.Itoa(int(m.address.Port)),
+		"runid", m.info["run_id"],
+		"flags", strings.Join(flags, ","),
+		"last-ping-reply", milliseconds(time.Since(m.lastPong)),
+		"down-after-milliseconds", milliseconds(m.downAfter),
+		"role-reported", m.role(),
+		"config-epoch", strconv.FormatUint(m.configEpoch, 10),
+		"num-slaves", strconv.Itoa(len(m.replicas)),
+		"num-other-sentinels", strconv.Itoa(len(m.sentinels)),
+		"quorum", strconv.Itoa(m.quorum),
+		"failover-timeout", milliseconds(m.failoverTimeout),
+	)
+	if m.failover != nil {
+		state.Content = append(state.Content, fields("failover-state", m.failover.state).Content...)
+	}
+	return state
+}
+
+// replicaState describes the replica as a list of field names and values.
+// Caller must hold the mutex.
+func (s *Sentinel) replicaState(m *master, r *instance) resp.Array {
+	flags := []string{"slave"}
+	if !r.sdownSince.IsZero() {
+		flags = append(flags, "s_down")
+	}
+	if r.lastPong.IsZero() {
+		flags = append(flags, "disconnected")
+	}
+	return fields(
+		"name", hostPort(r.address),
+		"ip", r.address.Host,
+		"port", strconv.Itoa(int(r.address.Port)),
+		"flags", strings.Join(flags, ","),
+		"last-ping-reply", milliseconds(time.Since(r.lastPong)),
+		"role-reported", r.role(),
+		"master-link-status", r.info["master_link_status"],
+		"master-host", m.address.Host,
+		"master-port", strconv.Itoa(int(m.address.Port)),
+		"slave-repl-offset", r.info["slave_repl_offset"],
+	)
+}
+
+func (s *Sentinel) info() resp.RespDataType {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var builder strings.Builder
+	builder.WriteString("# Server\r\n")
+	fmt.Fprintf(&builder, "redis_mode:sentinel\r\nrun_id:%v\r\ntcp_port:%d\r\n", s.id, s.port)
+	builder.WriteString("\r\n# Sentinel\r\n")
+	fmt.Fprintf(&builder, "sentinel_masters:%d\r\n", len(s.masters))
+	for index, m := range s.masters {
+		status := "ok"
+		if m.odown {
+			status = "odown"
+		} else if !m.sdownSince.IsZero() {
+			status = "sdown"
+		}
+		fmt.Fprintf(&builder, "master%d:name=%v,status=%v,address=%v,slaves=%d,sentinels=%d\r\n",
+			index, m.name, status, hostPort(m.address), len(m.replicas), len(m.sentinels)+1)
+	}
+	return resp.BulkString(builder.String())
+}
+
+func (s *Sentinel) role() resp.RespDataType {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	names := resp.Array{Content: []resp.RespDataType{}}
+	for _, m := range s.masters {
+		names.Content = append(names.Content, resp.BulkString(m.name))
+	}
+	return resp.Array{Content: []resp.RespDataType{resp.BulkString("sentinel"), names}}
+}
+
+// subscribe subscribes the client to events, the channels are named after
+// them, like +switch-master.
+func (s *Sentinel) subscribe(conn net.Conn, args []resp.RespDataType) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	count := 0
+	for _, subscribers := range s.subscribers {
+		if subscribers[conn] {
+			count += 1
+		}
+	}
+	for _, arg := range args {
+		channel := resp.String(arg)
+		if s.subscribers[channel] == nil {
+			s.subscribers[channel] = make(map[net.Conn]bool)
+		}
+		if !s.subscribers[channel][conn] {
+			s.subscribers[channel][conn] = true
+			count += 1
+		}
+		s.send(conn, resp.Array{Content: []resp.RespDataType{
+			resp.BulkString("subscribe"),
+			resp.BulkString(channel),
+			resp.Integer(count),
+		}}.Bytes())
+	}
+}
+
+func (s *Sentinel) unsubscribe(conn net.Conn) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.unsubscribeAll(conn)
+}
+
+// disconnect forgets the client once its connection is done.
+func (s *Sentinel) disconnect(conn net.Conn) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.drop(conn)
+}
+
+// drop unsubscribes the client and stops its writer. Caller must hold the
+// mutex.
+func (s *Sentinel) drop(conn net.Conn) {
+	s.unsubscribeAll(conn)
+	if queue, ok := s.outputs[conn]; ok {
+		close(queue)
+		delete(s.outputs, conn)
+	}
+}
+
+// unsubscribeAll removes the client from every channel. Caller must hold
+// the mutex.
+func (s *Sentinel) unsubscribeAll(conn net.Conn) {
+	for channel, subscribers := range s.subscribers {
+		delete(subscribers, conn)
+		if len(subscribers) == 0 {
+			delete(s.subscribers, channel)
+		}
+	}
+}
+
+func sortedInstances(instances map[replication.ReplicaAddress]*instance) []*instance {
+	sorted := make([]*instance, 0, len(instances))
+	for _, i := range instances {
+		sorted = append(sorted, i)
+	}
+	slices.SortFunc(sorted, func(a, b *instance) int {
+		return strings.Compare(hostPort(a.address), hostPort(b.address))
+	})
+	return sorted
+}
+
+// fields builds the flat name and value list used to describe instances.
+func fields(namesAndValues ...string) resp.Array {
+	array := resp.Array{}
+	for _, field := range namesAndValues {
+		array.Content = append(array.Content, resp.BulkString(field))
+	}
+	return array
+}
+
+func milliseconds(d time.Duration) string {
+	return strconv.FormatInt(d.Milliseconds(), 10)
+}
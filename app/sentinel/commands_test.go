@@ -0,0 +1,46 @@
+package sentinel
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/replication"
+	"github.com/codecrafters-io/redis-starter-go/app/resp"
+)
+
+func TestCkquorum(t *testing.T) {
+	tests := []struct {
+		name   string
+		quorum int
+		usable int
+		stale  int
+		want   resp.RespDataType
+	}{
+		{"alone", 1, 0, 0, resp.SimpleString("OK 1 usable Sentinels. Quorum and failover authorization can be reached")},
+		{"three of three", 2, 2, 0, resp.SimpleString("OK 3 usable Sentinels. Quorum and failover authorization can be reached")},
+		{"majority of three", 2, 1, 1, resp.SimpleString("OK 2 usable Sentinels. Quorum and failover authorization can be reached")},
+		{"quorum above usable", 3, 1, 1, resp.Error("NOQUORUM 2 usable Sentinels. Not enough available Sentinels to reach the specified quorum for this master")},
+		{"no majority", 1, 1, 2, resp.Error("NOQUORUM 2 usable Sentinels. Not enough available Sentinels to reach the majority and authorize a failover")},
+		{"even count needs more than half", 2, 1, 2, resp.Error("NOQUORUM 2 usable Sentinels. Not enough available Sentinels to reach the majority and authorize a failover")},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := testMaster()
+			m.quorum = test.quorum
+			for i := 0; i < test.usable+test.stale; i++ {
+				lastHello := time.Now()
+				if i >= test.usable {
+					lastHello = lastHello.Add(-5 * helloPeriod)
+				}
+				id := fmt.Sprintf("peer%d", i)
+				m.sentinels[id] = &peer{runId: id, address: replication.ReplicaAddress{Host: "127.0.0.1", Port: uint16(26380 + i)}, lastHello: lastHello}
+			}
+			got := testSentinel(m).sentinel([]resp.RespDataType{resp.BulkString("ckquorum"), resp.BulkString("mymaster")})
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("SENTINEL CKQUORUM = %#v, want %#v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,249 @@
+package sentinel
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/replication"
+	"github.com/codecrafters-io/redis-starter-go/app/resp"
+)
+
+const (
+	pingPeriod  = time.Second
+	infoPeriod  = 10 * time.Second
+	helloPeriod = 2 * time.Second
+	// callTimeout limits connecting to an instance and waiting for a reply.
+	callTimeout  = time.Second
+	helloChannel = "__sentinel__:hello"
+)
+
+// client sends commands to an instance and waits for the replies.
+type client struct {
+	conn   net.Conn
+	reader *resp.BufReader
+}
+
+func dial(address replication.ReplicaAddress) (*client, error) {
+	conn, err := net.DialTimeout("tcp", hostPort(address), callTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return &client{conn: conn, reader: resp.NewReader(conn)}, nil
+}
+
+func (c *client) call(args ...string) (resp.RespDataType, error) {
+	request := resp.Array{}
+	for _, arg := range args {
+		request.Content = append(request.Content, resp.BulkString(arg))
+	}
+	c.conn.SetDeadline(time.Now().Add(callTimeout))
+	_, err := c.conn.Write(request.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return resp.Parse(c.reader)
+}
+
+// localHost is the address other sentinels can reach this one at, the one
+// the instance sees the connection coming from.
+func (c *client) localHost() string {
+	host, _, _ := net.SplitHostPort(c.conn.LocalAddr().String())
+	return host
+}
+
+func (c *client) Close() error {
+	return c.conn.Close()
+}
+
+// call sends a single command on a new connection.
+func call(address replication.ReplicaAddress, args ...string) (resp.RespDataType, error) {
+	c, err := dial(address)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	return c.call(args...)
+}
+
+func hostPort(address replication.ReplicaAddress) string {
+	return net.JoinHostPort(address.Host, strconv.Itoa(int(address.Port)))
+}
+
+// instance is a master or a replica watched by the sentinel. Its fields are
+// guarded by the sentinel mutex.
+type instance struct {
+	address replication.ReplicaAddress
+	created time.Time
+	// lastPong is when the instance replied to PING last.
+	lastPong time.Time
+	// sdownSince is when the instance stopped replying, zero while it's up.
+	sdownSince time.Time
+	// upSince is when the instance replied again after being down.
+	upSince time.Time
+	// info is the last INFO reply, roleTime is when the instance started
+	// reporting its current role.
+	info     map[string]string
+	infoTime time.Time
+	roleTime time.Time
+	done     chan struct{}
+}
+
+func newInstance(address replication.ReplicaAddress) *instance {
+	now := time.Now()
+	return &instance{
+		address: address,
+		created: now,
+		upSince: now,
+		done:    make(chan struct{}),
+	}
+}
+
+func (i *instance) role() string {
+	return i.info["role"]
+}
+
+// watch pings the instance, refreshes its INFO and publishes hello messages
+// on it until the instance is forgotten. Hello messages of other sentinels
+// are received on a separate connection.
+func (s *Sentinel) watch(m *master, i *instance) {
+	go s.listenHello(i)
+	var c *client
+	var lastInfo, lastHello time.Time
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-i.done:
+			if c != nil {
+				c.Close()
+			}
+			return
+		case <-ticker.C:
+		}
+		if c == nil {
+			var err error
+			c, err = dial(i.address)
+			if err != nil {
+				continue
+			}
+		}
+		err := s.refresh(m, i, c, &lastInfo, &lastHello)
+		if err != nil {
+			c.Close()
+			c = nil
+		}
+	}
+}
+
+func (s *Sentinel) refresh(m *master, i *instance, c *client, lastInfo, lastHello *time.Time) error {
+	reply, err := c.call("PING")
+	if err != nil {
+		return err
+	}
+	if pong, ok := reply.(resp.SimpleString); ok && strings.EqualFold(string(pong), "pong") {
+		s.mutex.Lock()
+		i.lastPong = time.Now()
+		s.mutex.Unlock()
+	}
+
+	if time.Since(*lastInfo) >= s.infoPeriod(m) {
+		reply, err = c.call("INFO")
+		if err != nil {
+			return err
+		}
+		*lastInfo = time.Now()
+		s.processInfo(m, i, parseInfo(resp.String(reply)))
+	}
+
+	if time.Since(*lastHello) >= helloPeriod {
+		_, err = c.call("PUBLISH", helloChannel, s.hello(m, c.localHost()))
+		if err != nil {
+			return err
+		}
+		*lastHello = time.Now()
+	}
+	return nil
+}
+
+// infoPeriod is shorter while the master is down, so a failover notices a
+// promoted replica quickly.
+func (s *Sentinel) infoPeriod(m *master) time.Duration {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if m.failover != nil || !m.sdownSince.IsZero() {
+		return time.Second
+	}
+	return infoPeriod
+}
+
+// listenHello receives the hello messages other sentinels publish on the
+// instance.
+func (s *Sentinel) listenHello(i *instance) {
+	for {
+		select {
+		case <-i.done:
+			return
+		default:
+		}
+		c, err := dial(i.address)
+		if err == nil {
+			_, err = c.call("SUBSCRIBE", helloChannel)
+		}
+		for err == nil {
+			// This sentinel publishes every hello period itself, a longer
+			// silence means the connection is broken.
+			c.conn.SetReadDeadline(time.Now().Add(5 * helloPeriod))
+			var message resp.RespDataType
+			message, err = resp.Parse(c.reader)
+			if content, ok := message.(resp.Array); err == nil && ok && len(content.Content) == 3 {
+				s.processHello(resp.String(content.Content[2]))
+			}
+			select {
+			case <-i.done:
+				err = errStopped
+			default:
+			}
+		}
+		if c != nil {
+			c.Close()
+		}
+		select {
+		case <-i.done:
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// parseInfo parses the lines of an INFO reply into a map.
+func parseInfo(info string) map[string]string {
+	fields := make(map[string]string)
+	for _, line := range strings.Split(info, "\r\n") {
+		key, value, ok := strings.Cut(line, ":")
+		if ok && !strings.HasPrefix(line, "#") {
+			fields[key] = value
+		}
+	}
+	return fields
+}
+
+// parseReplica parses a slaveN line of INFO replication.
+func parseReplica(value string) (replication.ReplicaAddress, bool) {
+	fields := make(map[string]string)
+	for _, field := range strings.Split(value, ",") {
+		key, value, _ := strings.Cut(field, "=")
+		fields[key] = value
+	}
+	port, err := strconv.ParseUint(fields["port"], 10, 16)
+	if err != nil || fields["ip"] == "" {
+		return replication.ReplicaAddress{}, false
+	}
+	return replication.ReplicaAddress{Host: fields["ip"], Port: uint16(port)}, true
+}
+
+func (i *instance) String() string {
+	return fmt.Sprintf("%v %d", i.address.Host, i.address.Port)
+}
@@ -0,0 +1,60 @@
+package sentinel
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/codecrafters-io/redis-starter-go/app/replication"
+)
+
+func TestParseInfo(t *testing.T) {
+	tests := []struct {
+		name string
+		info string
+		want map[string]string
+	}{
+		{"empty", "", map[string]string{}},
+		{
+			name: "sections and fields",
+			info: "# Replication\r\nrole:master\r\nconnected_slaves:1\r\nslave0:ip=127.0.0.1,port=6380,state=online,offset=42,lag=0\r\n\r\n",
+			want: map[string]string{
+				"role":             "master",
+				"connected_slaves": "1",
+				"slave0":           "ip=127.0.0.1,port=6380,state=online,offset=42,lag=0",
+			},
+		},
+		{"value with colons", "master_host:::1\r\n", map[string]string{"master_host": "::1"}},
+		{"line without colon", "garbage\r\nrole:slave", map[string]string{"role": "slave"}},
+		{"commented field", "#role:master\r\n", map[string]string{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := parseInfo(test.info)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("parseInfo(%q) = %v, want %v", test.info, got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseReplica(t *testing.T) {
+	tests := []struct {
+		value  string
+		want   replication.ReplicaAddress
+		wantOk bool
+	}{
+		{"ip=127.0.0.1,port=6380,state=online,offset=42,lag=0", replication.ReplicaAddress{Host: "127.0.0.1", Port: 6380}, true},
+		{"port=6380,ip=10.0.0.2", replication.ReplicaAddress{Host: "10.0.0.2", Port: 6380}, true},
+		{"ip=127.0.0.1", replication.ReplicaAddress{}, false},
+		{"ip=127.0.0.1,port=70000", replication.ReplicaAddress{}, false},
+		{"ip=127.0.0.1,port=x", replication.ReplicaAddress{}, false},
+		{"port=6380", replication.ReplicaAddress{}, false},
+		{"", replication.ReplicaAddress{}, false},
+	}
+	for _, test := range tests {
+		got, ok := parseReplica(test.value)
+		if got != test.want || ok != test.wantOk {
+			t.Errorf("parseReplica(%q) = %v, %v, want %v, %v", test.value, got, ok, test.want, test.wantOk)
+		}
+	}
+}
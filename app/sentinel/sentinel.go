@@ -0,0 +1,538 @@
+package sentinel
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/args"
+	"github.com/codecrafters-io/redis-starter-go/app/replication"
+	"github.com/codecrafters-io/redis-starter-go/app/resp"
+)
+
+// Sentinel monitors masters and their replicas, agrees with other sentinels
+// that a master is down and fails it over to the best replica.
+type Sentinel struct {
+	id    string
+	port  uint16
+	mutex sync.Mutex
+	// currentEpoch is the last epoch seen, each failover attempt starts a
+	// new one and every sentinel votes once per epoch.
+	currentEpoch uint64
+	masters      []*master
+	// subscribers are the clients subscribed to events, by event name.
+	subscribers map[string]map[net.Conn]bool
+	// outputs queue the writes to subscribed clients, so that slow clients
+	// are written to without holding the mutex.
+	outputs map[net.Conn]chan []byte
+	// limits apply to requests of clients.
+	limits resp.Limits
+}
+
+type master struct {
+	*instance
+	name            string
+	quorum          int
+	downAfter       time.Duration
+	failoverTimeout time.Duration
+	// configEpoch is the epoch of the failover that promoted the master,
+	// the most recent configuration wins when sentinels disagree.
+	configEpoch uint64
+	replicas    map[replication.ReplicaAddress]*instance
+	sentinels   map[string]*peer
+	odown       bool
+	lastAsk     time.Time
+	// leader is the sentinel this one voted for in leaderEpoch.
+	leader      string
+	leaderEpoch uint64
+	failover    *failover
+	// failoverStart is when the last failover was attempted or another
+	// sentinel was voted for, the next attempt waits twice the timeout.
+	failoverStart time.Time
+}
+
+// peer is another sentinel monitoring the same master, discovered through
+// its hello messages.
+type peer struct {
+	runId     string
+	address   replication.ReplicaAddress
+	lastHello time.Time
+	// masterDown is the last reply to is-master-down-by-addr, leader and
+	// leaderEpoch the vote it contained.
+	masterDown  bool
+	replyTime   time.Time
+	leader      string
+	leaderEpoch uint64
+}
+
+// States of a failover led by this sentinel.
+const (
+	failoverWaitStart = "wait_start"
+	failoverPromoting = "wait_promotion"
+)
+
+type failover struct {
+	state     string
+	epoch     uint64
+	stateTime time.Time
+	promoted  *instance
+	// forced failovers started with SENTINEL FAILOVER skip the election.
+	forced bool
+}
+
+var errStopped = errors.New("instance forgotten")
+
+const (
+	// convertDelay is how long a master must be up, and a replica report
+	// the master role, before the replica is turned back into a replica.
+	// It leaves time to learn about failovers led by other sentinels.
+	convertDelay = 4 * helloPeriod
+	// replyValidity is how long the reply of another sentinel to
+	// is-master-down-by-addr counts.
+	replyValidity = 5 * time.Second
+	// electionTimeout limits waiting for votes.
+	electionTimeout = 10 * time.Second
+)
+
+func New(args args.Args) *Sentinel {
+	s := &Sentinel{
+		id:          generateRunId(),
+		port:        args.Port,
+		subscribers: make(map[string]map[net.Conn]bool),
+		outputs:     make(map[net.Conn]chan []byte),
+		limits: resp.Limits{
+			MaxBulkLength:      args.ProtoMaxBulkLen,
+			MaxMultibulkLength: args.ProtoMaxMultibulkLen,
+			MaxQueryBuffer:     args.ClientQueryBufferLimit,
+		},
+	}
+	for _, monitor := range args.SentinelMonitors {
+		s.masters = append(s.masters, &master{
+			instance:        newInstance(monitor.Address),
+			name:            monitor.Name,
+			quorum:          monitor.Quorum,
+			downAfter:       time.Duration(monitor.DownAfterMs) * time.Millisecond,
+			failoverTimeout: time.Duration(monitor.FailoverTimeoutMs) * time.Millisecond,
+			replicas:        make(map[replication.ReplicaAddress]*instance),
+			sentinels:       make(map[string]*peer),
+		})
+	}
+	return s
+}
+
+// Serve starts monitoring and answers clients on the listener.
+func (s *Sentinel) Serve(l net.Listener) {
+	fmt.Printf("sentinel id is %v\n", s.id)
+	for _, m := range s.masters {
+		fmt.Printf("+monitor master %v %v quorum %d\n", m.name, m.instance, m.quorum)
+		go s.watch(m, m.instance)
+	}
+	go s.cron()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			fmt.Println("Error accepting connection: ", err.Error())
+			continue
+		}
+		go s.serveClient(conn)
+	}
+}
+
+func (s *Sentinel) cron() {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		s.mutex.Lock()
+		for _, m := range s.masters {
+			s.check(m, now)
+		}
+		s.mutex.Unlock()
+	}
+}
+
+// check updates the state of the master and its replicas and advances a
+// failover. Caller must hold the mutex.
+func (s *Sentinel) check(m *master, now time.Time) {
+	s.checkDown("master", m, m.instance, now)
+	for _, r := range m.replicas {
+		s.checkDown("slave", m, r, now)
+	}
+
+	if !m.sdownSince.IsZero() && now.Sub(m.lastAsk) >= time.Second {
+		m.lastAsk = now
+		candidate := "*"
+		if m.failover != nil && m.failover.state == failoverWaitStart {
+			candidate = s.id
+		}
+		s.askSentinels(m, candidate)
+	}
+
+	odown := false
+	if !m.sdownSince.IsZero() {
+		votes := 1
+		for _, p := range m.sentinels {
+			if p.masterDown && now.Sub(p.replyTime) < replyValidity {
+				votes += 1
+			}
+		}
+		odown = votes >= m.quorum
+	}
+	if odown != m.odown {
+		m.odown = odown
+		if odown {
+			s.event("+odown", "master %v %v #quorum %d", m.name, m.instance, m.quorum)
+		} else {
+			s.event("-odown", "master %v %v", m.name, m.instance)
+		}
+	}
+
+	if m.odown && m.failover == nil && now.Sub(m.failoverStart) > 2*m.failoverTimeout {
+		s.startFailover(m, now, false)
+	}
+	if m.failover != nil {
+		s.advanceFailover(m, now)
+	}
+}
+
+// checkDown flags instances that didn't reply to PING within the down after
+// period as subjectively down. Caller must hold the mutex.
+func (s *Sentinel) checkDown(kind string, m *master, i *instance, now time.Time) {
+	lastReply := i.lastPong
+	if lastReply.Before(i.created) {
+		lastReply = i.created
+	}
+	down := now.Sub(lastReply) > m.downAfter
+	if down && i.sdownSince.IsZero() {
+		i.sdownSince = now
+		s.event("+sdown", "%v %v %v @ %v %v", kind, hostPort(i.address), i, m.name, m.instance)
+	} else if !down && !i.sdownSince.IsZero() {
+		i.sdownSince = time.Time{}
+		i.upSince = now
+		s.event("-sdown", "%v %v %v @ %v %v", kind, hostPort(i.address), i, m.name, m.instance)
+	}
+}
+
+// askSentinels asks the other sentinels whether they consider the master
+// down as well. A candidate other than * also asks for their vote. Caller
+// must hold the mutex.
+func (s *Sentinel) askSentinels(m *master, candidate string) {
+	epoch := strconv.FormatUint(s.currentEpoch, 10)
+	host, port := m.address.Host, strconv.Itoa(int(m.address.Port))
+	for _, p := range m.sentinels {
+		go func(p *peer, address replication.ReplicaAddress) {
+			reply, err := call(address, "SENTINEL", "is-master-down-by-addr", host, port, epoch, candidate)
+			content, ok := reply.(resp.Array)
+			if err != nil || !ok || len(content.Content) != 3 {
+				return
+			}
+			down, _ := content.Content[0].(resp.Integer)
+			leaderEpoch, _ := content.Content[2].(resp.Integer)
+			s.mutex.Lock()
+			defer s.mutex.Unlock()
+			p.masterDown = down == 1
+			p.replyTime = time.Now()
+			if leader := resp.String(content.Content[1]); leader != "*" {
+				p.leader = leader
+				p.leaderEpoch = uint64(leaderEpoch)
+			}
+		}(p, p.address)
+	}
+}
+
+// vote replies to is-master-down-by-addr of a sentinel asking to lead the
+// failover of the master in epoch. Every sentinel votes once per epoch,
+// for the first candidate that asks. Caller must hold the mutex.
+func (s *Sentinel) vote(m *master, candidate string, epoch uint64) {
+	if epoch > s.currentEpoch {
+		s.currentEpoch = epoch
+		s.event("+new-epoch", "%d", epoch)
+	}
+	if m.leaderEpoch < epoch && s.currentEpoch <= epoch {
+		m.leader = candidate
+		m.leaderEpoch = epoch
+		s.event("+vote-for-leader", "%v %d", candidate, epoch)
+		if candidate != s.id {
+			m.failoverStart = time.Now()
+		}
+	}
+}
+
+// startFailover starts a new epoch and asks the other sentinels to elect
+// this one to lead the failover. Caller must hold the mutex.
+func (s *Sentinel) startFailover(m *master, now time.Time, forced bool) {
+	s.currentEpoch += 1
+	s.event("+new-epoch", "%d", s.currentEpoch)
+	s.event("+try-failover", "master %v %v", m.name, m.instance)
+	m.failover = &failover{
+		state:     failoverWaitStart,
+		epoch:     s.currentEpoch,
+		stateTime: now,
+		forced:    forced,
+	}
+	m.failoverStart = now
+	s.vote(m, s.id, s.currentEpoch)
+	if !forced {
+		m.lastAsk = now
+		s.askSentinels(m, s.id)
+	}
+}
+
+// advanceFailover promotes the best replica once this sentinel is elected,
+// and switches to it once it reports the master role. Caller must hold the
+// mutex.
+func (s *Sentinel) advanceFailover(m *master, now time.Time) {
+	f := m.failover
+	switch f.state {
+	case failoverWaitStart:
+		if !f.forced && s.countVotes(m, f.epoch) < max(m.quorum, (len(m.sentinels)+1)/2+1) {
+			if now.Sub(f.stateTime) > min(electionTimeout, m.failoverTimeout) {
+				s.event("-failover-abort-not-elected", "master %v %v", m.name, m.instance)
+				m.failover = nil
+			}
+			return
+		}
+		s.event("+elected-leader", "master %v %v", m.name, m.instance)
+		promoted := s.selectReplica(m, now)
+		if promoted == nil {
+			s.event("-failover-abort-no-good-slave", "master %v %v", m.name, m.instance)
+			m.failover = nil
+			return
+		}
+		s.event("+selected-slave", "slave %v %v @ %v %v", hostPort(promoted.address), promoted, m.name, m.instance)
+		f.state = failoverPromoting
+		f.stateTime = now
+		f.promoted = promoted
+		go func() {
+			_, err := call(promoted.address, "REPLICAOF", "NO", "ONE")
+			if err != nil {
+				fmt.Printf("failed to promote %v: %v\n", hostPort(promoted.address), err)
+			}
+		}()
+	case failoverPromoting:
+		if f.promoted.role() == "master" && f.promoted.infoTime.After(f.stateTime) {
+			s.event("+promoted-slave", "slave %v %v @ %v %v", hostPort(f.promoted.address), f.promoted, m.name, m.instance)
+			old := m.address
+			for _, r := range m.replicas {
+				if r != f.promoted {
+					go reconfigure(r.address, f.promoted.address)
+				}
+			}
+			go reconfigure(old, f.promoted.address)
+			s.switchMaster(m, f.promoted.address, f.epoch)
+			s.event("+failover-end", "master %v %v", m.name, hostPort(old))
+			return
+		}
+		if now.Sub(f.stateTime) > m.failoverTimeout {
+			s.event("-failover-abort-slave-timeout", "master %v %v", m.name, m.instance)
+			m.failover = nil
+		}
+	}
+}
+
+func (s *Sentinel) countVotes(m *master, epoch uint64) int {
+	votes := 0
+	if m.leader == s.id && m.leaderEpoch == epoch {
+		votes += 1
+	}
+	for _, p := range m.sentinels {
+		if p.leader == s.id && p.leaderEpoch == epoch {
+			votes += 1
+		}
+	}
+	return votes
+}
+
+// selectReplica picks the replica with the largest replication offset among
+// the ones that are up and reported INFO recently. Caller must hold the
+// mutex.
+func (s *Sentinel) selectReplica(m *master, now time.Time) *instance {
+	// INFO is refreshed every second once the master is down.
+	infoValidity := 3 * infoPeriod
+	if !m.sdownSince.IsZero() {
+		infoValidity = 5 * pingPeriod
+	}
+	var candidates []*instance
+	for _, r := range m.replicas {
+		if r.sdownSince.IsZero() && r.role() == "slave" && now.Sub(r.infoTime) < infoValidity {
+			candidates = append(candidates, r)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	offset := func(i *instance) uint64 {
+		offset, _ := strconv.ParseUint(i.info["slave_repl_offset"], 10, 64)
+		return offset
+	}
+	slices.SortFunc(candidates, func(a, b *instance) int {
+		if offset(a) != offset(b) {
+			if offset(a) > offset(b) {
+				return -1
+			}
+			return 1
+		}
+		return strings.Compare(hostPort(a.address), hostPort(b.address))
+	})
+	return candidates[0]
+}
+
+func reconfigure(address replication.ReplicaAddress, master replication.ReplicaAddress) {
+	_, err := call(address, "REPLICAOF", master.Host, strconv.Itoa(int(master.Port)))
+	if err != nil {
+		fmt.Printf("failed to reconfigure %v: %v\n", hostPort(address), err)
+	}
+}
+
+// switchMaster makes the instance at address the master, the old master
+// becomes one of its replicas. Caller must hold the mutex.
+func (s *Sentinel) switchMaster(m *master, address replication.ReplicaAddress, epoch uint64) {
+	old := m.instance
+	s.event("+switch-master", "%v %v %v", m.name, old, strings.ReplaceAll(hostPort(address), ":", " "))
+	promoted, ok := m.replicas[address]
+	if !ok {
+		promoted = newInstance(address)
+		go s.watch(m, promoted)
+	}
+	delete(m.replicas, address)
+	m.replicas[old.address] = old
+	m.instance = promoted
+	m.configEpoch = epoch
+	m.odown = false
+	m.failover = nil
+	for _, p := range m.sentinels {
+		p.masterDown = false
+	}
+}
+
+// hello announces this sentinel and its configuration of the master to the
+// other sentinels.
+func (s *Sentinel) hello(m *master, host string) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return fmt.Sprintf("%v,%d,%v,%d,%v,%v,%d,%d", host, s.port, s.id, s.currentEpoch,
+		m.name, m.address.Host, m.address.Port, m.configEpoch)
+}
+
+// processHello records the sentinel that sent the hello message and adopts
+// its configuration of the master when it's more recent.
+func (s *Sentinel) processHello(hello string) {
+	parts := strings.Split(hello, ",")
+	if len(parts) != 8 {
+		return
+	}
+	port, err1 := strconv.ParseUint(parts[1], 10, 16)
+	epoch, err2 := strconv.ParseUint(parts[3], 10, 64)
+	masterPort, err3 := strconv.ParseUint(parts[6], 10, 16)
+	configEpoch, err4 := strconv.ParseUint(parts[7], 10, 64)
+	if err := errors.Join(err1, err2, err3, err4); err != nil || parts[2] == s.id {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	m := s.master(parts[4])
+	if m == nil {
+		return
+	}
+	address := replication.ReplicaAddress{Host: parts[0], Port: uint16(port)}
+	p, ok := m.sentinels[parts[2]]
+	if !ok {
+		// A sentinel restarted with a new id on the same address.
+		for id, other := range m.sentinels {
+			if other.address == address {
+				delete(m.sentinels, id)
+			}
+		}
+		p = &peer{runId: parts[2]}
+		m.sentinels[parts[2]] = p
+		s.event("+sentinel", "sentinel %v %v %d @ %v %v", parts[2], address.Host, address.Port, m.name, m.instance)
+	}
+	p.address = address
+	p.lastHello = time.Now()
+	if epoch > s.currentEpoch {
+		s.currentEpoch = epoch
+		s.event("+new-epoch", "%d", epoch)
+	}
+	masterAddress := replication.ReplicaAddress{Host: parts[5], Port: uint16(masterPort)}
+	if configEpoch > m.configEpoch {
+		if masterAddress != m.address {
+			s.event("+config-update-from", "sentinel %v %v %d @ %v %v", parts[2], address.Host, address.Port, m.name, m.instance)
+			s.switchMaster(m, masterAddress, configEpoch)
+		} else {
+			m.configEpoch = configEpoch
+		}
+	}
+}
+
+// processInfo records the INFO reply of an instance. Replicas reported by
+// the master are watched as well, and a replica reporting the master role,
+// like a master that failed and came back, is turned into a replica again.
+func (s *Sentinel) processInfo(m *master, i *instance, info map[string]string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := time.Now()
+	if info["role"] != i.role() {
+		i.roleTime = now
+	}
+	i.info = info
+	i.infoTime = now
+	if i == m.instance && i.role() == "master" {
+		for key, value := range info {
+			if !strings.HasPrefix(key, "slave") || strings.Contains(key, "_") {
+				continue
+			}
+			address, ok := parseReplica(value)
+			if !ok || address == m.address || m.replicas[address] != nil {
+				continue
+			}
+			replica := newInstance(address)
+			m.replicas[address] = replica
+			s.event("+slave", "slave %v %v @ %v %v", hostPort(address), replica, m.name, m.instance)
+			go s.watch(m, replica)
+		}
+	}
+	if i != m.instance && i.role() == "master" && m.failover == nil &&
+		m.sdownSince.IsZero() && now.Sub(m.upSince) > convertDelay && now.Sub(i.roleTime) > convertDelay {
+		s.event("+convert-to-slave", "slave %v %v @ %v %v", hostPort(i.address), i, m.name, m.instance)
+		i.roleTime = now
+		go reconfigure(i.address, m.address)
+	}
+}
+
+// master returns the master with the name, nil when it's not monitored.
+// Caller must hold the mutex.
+func (s *Sentinel) master(name string) *master {
+	for _, m := range s.masters {
+		if strings.EqualFold(m.name, name) {
+			return m
+		}
+	}
+	return nil
+}
+
+// event logs the event and publishes it to the clients subscribed to it.
+// Caller must hold the mutex.
+func (s *Sentinel) event(name string, format string, a ...any) {
+	details := fmt.Sprintf(format, a...)
+	fmt.Printf("%v %v\n", name, details)
+	message := resp.Array{Content: []resp.RespDataType{
+		resp.BulkString("message"),
+		resp.BulkString(name),
+		resp.BulkString(details),
+	}}.Bytes()
+	for conn := range s.subscribers[name] {
+		s.send(conn, message)
+	}
+}
+
+func generateRunId() string {
+	id := make([]byte, 20)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
@@ -0,0 +1,188 @@
+package sentinel
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/replication"
+)
+
+func testSentinel(m *master) *Sentinel {
+	return &Sentinel{
+		id:          "me",
+		masters:     []*master{m},
+		subscribers: make(map[string]map[net.Conn]bool),
+		outputs:     make(map[net.Conn]chan []byte),
+	}
+}
+
+func testMaster() *master {
+	return &master{
+		instance:  newInstance(replication.ReplicaAddress{Host: "127.0.0.1", Port: 6379}),
+		name:      "mymaster",
+		quorum:    2,
+		replicas:  make(map[replication.ReplicaAddress]*instance),
+		sentinels: make(map[string]*peer),
+	}
+}
+
+func TestVote(t *testing.T) {
+	tests := []struct {
+		name            string
+		currentEpoch    uint64
+		leader          string
+		leaderEpoch     uint64
+		candidate       string
+		epoch           uint64
+		wantLeader      string
+		wantEpoch       uint64
+		wantCurrent     uint64
+		wantStartedWait bool
+	}{
+		{
+			name:      "first vote of a new epoch",
+			candidate: "other", epoch: 1,
+			wantLeader: "other", wantEpoch: 1, wantCurrent: 1, wantStartedWait: true,
+		},
+		{
+			name:         "already voted in the epoch",
+			currentEpoch: 3, leader: "first", leaderEpoch: 3,
+			candidate: "second", epoch: 3,
+			wantLeader: "first", wantEpoch: 3, wantCurrent: 3,
+		},
+		{
+			name:         "older epoch",
+			currentEpoch: 5, leader: "first", leaderEpoch: 2,
+			candidate: "other", epoch: 4,
+			wantLeader: "first", wantEpoch: 2, wantCurrent: 5,
+		},
+		{
+			name:         "newer epoch replaces the vote",
+			currentEpoch: 3, leader: "first", leaderEpoch: 3,
+			candidate: "second", epoch: 7,
+			wantLeader: "second", wantEpoch: 7, wantCurrent: 7, wantStartedWait: true,
+		},
+		{
+			name:         "vote for itself",
+			currentEpoch: 2,
+			candidate:    "me", epoch: 3,
+			wantLeader: "me", wantEpoch: 3, wantCurrent: 3,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := testMaster()
+			m.leader = test.leader
+			m.leaderEpoch = test.leaderEpoch
+			s := testSentinel(m)
+			s.currentEpoch = test.currentEpoch
+			s.vote(m, test.candidate, test.epoch)
+			if m.leader != test.wantLeader || m.leaderEpoch != test.wantEpoch {
+				t.Errorf("voted for %q in %d, want %q in %d", m.leader, m.leaderEpoch, test.wantLeader, test.wantEpoch)
+			}
+			if s.currentEpoch != test.wantCurrent {
+				t.Errorf("currentEpoch = %d, want %d", s.currentEpoch, test.wantCurrent)
+			}
+			if started := !m.failoverStart.IsZero(); started != test.wantStartedWait {
+				t.Errorf("failoverStart set = %v, want %v", started, test.wantStartedWait)
+			}
+		})
+	}
+}
+
+func TestSelectReplica(t *testing.T) {
+	now := time.Now()
+	type replica struct {
+		port     uint16
+		role     string
+		offset   uint64
+		down     bool
+		infoTime time.Time
+	}
+	tests := []struct {
+		name       string
+		masterDown bool
+		replicas   []replica
+		want       uint16
+	}{
+		{"no replicas", false, nil, 0},
+		{
+			name: "largest offset",
+			replicas: []replica{
+				{port: 6380, role: "slave", offset: 10, infoTime: now},
+				{port: 6381, role: "slave", offset: 30, infoTime: now},
+				{port: 6382, role: "slave", offset: 20, infoTime: now},
+			},
+			want: 6381,
+		},
+		{
+			name: "same offset picks the lowest address",
+			replicas: []replica{
+				{port: 6382, role: "slave", offset: 30, infoTime: now},
+				{port: 6380, role: "slave", offset: 30, infoTime: now},
+				{port: 6381, role: "slave", offset: 30, infoTime: now},
+			},
+			want: 6380,
+		},
+		{
+			name: "skips down replicas and masters",
+			replicas: []replica{
+				{port: 6380, role: "slave", offset: 50, down: true, infoTime: now},
+				{port: 6381, role: "master", offset: 40, infoTime: now},
+				{port: 6382, role: "slave", offset: 10, infoTime: now},
+			},
+			want: 6382,
+		},
+		{
+			name: "skips stale info",
+			replicas: []replica{
+				{port: 6380, role: "slave", offset: 50, infoTime: now.Add(-3 * infoPeriod)},
+				{port: 6381, role: "slave", offset: 10, infoTime: now.Add(-infoPeriod)},
+			},
+			want: 6381,
+		},
+		{
+			name:       "fresher info once the master is down",
+			masterDown: true,
+			replicas: []replica{
+				{port: 6380, role: "slave", offset: 50, infoTime: now.Add(-infoPeriod)},
+				{port: 6381, role: "slave", offset: 10, infoTime: now.Add(-pingPeriod)},
+			},
+			want: 6381,
+		},
+		{
+			name: "no good replica",
+			replicas: []replica{
+				{port: 6380, role: "slave", offset: 50, down: true, infoTime: now},
+				{port: 6381, role: "slave", offset: 10},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := testMaster()
+			if test.masterDown {
+				m.sdownSince = now.Add(-time.Minute)
+			}
+			for _, r := range test.replicas {
+				i := newInstance(replication.ReplicaAddress{Host: "127.0.0.1", Port: r.port})
+				i.info = map[string]string{"role": r.role, "slave_repl_offset": strconv.FormatUint(r.offset, 10)}
+				i.infoTime = r.infoTime
+				if r.down {
+					i.sdownSince = now.Add(-time.Minute)
+				}
+				m.replicas[i.address] = i
+			}
+			got := testSentinel(m).selectReplica(m, now)
+			var port uint16
+			if got != nil {
+				port = got.address.Port
+			}
+			if port != test.want {
+				t.Errorf("selectReplica() picked port %d, want %d", port, test.want)
+			}
+		})
+	}
+}
@@ -2,16 +2,20 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
+	"time"
 
+	"github.com/codecrafters-io/redis-starter-go/app/aof"
 	"github.com/codecrafters-io/redis-starter-go/app/args"
 	"github.com/codecrafters-io/redis-starter-go/app/commands"
 	"github.com/codecrafters-io/redis-starter-go/app/rdb"
 	"github.com/codecrafters-io/redis-starter-go/app/replication"
 	"github.com/codecrafters-io/redis-starter-go/app/resp"
+	"github.com/codecrafters-io/redis-starter-go/app/sentinel"
 )
 
 func main() {
@@ -22,16 +26,30 @@ func main() {
 		os.Exit(1)
 	}
 	fmt.Printf("Listening on port %v\n", args.Port)
+	if args.Sentinel {
+		sentinel.New(args).Serve(l)
+		return
+	}
 
 	context := commands.NewContext(args)
-	err = syncWithRDB(&context)
-	if err != nil {
-		fmt.Println("failed to sync with rdb:", err)
+	if args.AppendOnly {
+		err = syncWithAOF(&context, args)
+	} else {
+		err = syncWithRDB(&context)
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		fmt.Println("persistence file does not exist, starting with an empty dataset")
+	} else if err != nil {
+		fmt.Println("failed to load persisted dataset:", err)
+		os.Exit(1)
 	}
 
-	slaveRole, ok := context.ReplicationRole.(replication.SlaveRole)
+	context.Replicate = func(slave *replication.SlaveRole) {
+		go syncWithMaster(slave, args.Port, &context)
+	}
+	slaveRole, ok := context.ReplicationRole().(*replication.SlaveRole)
 	if ok {
-		go syncWithMaster(&slaveRole, args.Port, &context)
+		context.Replicate(slaveRole)
 	}
 	for {
 		connection, err := l.Accept()
@@ -40,38 +58,132 @@ func main() {
 			continue
 		}
 		fmt.Println("Connection accepted")
+		output := context.Connect(connection)
 		go func() {
 			defer connection.Close()
+			defer context.Disconnect(connection)
 			reader := resp.NewReader(connection)
-			listenCommands(reader, connection, &context)
+			reader.SetLimits(resp.Limits{
+				MaxBulkLength:      args.ProtoMaxBulkLen,
+				MaxMultibulkLength: args.ProtoMaxMultibulkLen,
+				MaxQueryBuffer:     args.ClientQueryBufferLimit,
+			})
+			listenCommands(reader, connection, output, &context)
 		}()
 	}
 }
 
-func listenCommands(reader *resp.BufReader, writer io.Writer, context *commands.Context) {
+// listenCommands handles the requests of a client. Replies are flushed once
+// every request received so far is handled, so a pipeline is answered with
+// as few writes as possible.
+func listenCommands(reader *resp.BufReader, conn net.Conn, output *resp.Writer, context *commands.Context) {
 	for {
-		resp, err := resp.Parse(reader)
+		request, err := resp.ParseRequest(reader)
+		if resp.IsProtocolError(err) {
+			output.Encode(resp.Error("ERR "+err.Error()), 2)
+		}
 		if err != nil {
+			output.Flush()
 			fmt.Printf("RESP parsing failed: %s\n", err)
 			return
 		}
-		commands.Handle(resp, writer, context)
+		commands.Handle(request, conn, context)
+		if reader.Buffered() > 0 {
+			continue
+		}
+		if err := output.Flush(); err != nil {
+			fmt.Printf("failed to write replies: %s\n", err)
+			return
+		}
 	}
 }
 
+const (
+	reconnectMinDelay = 100 * time.Millisecond
+	reconnectMaxDelay = 10 * time.Second
+)
+
+// syncWithMaster keeps the replica connected to master, reconnecting with
+// an exponential backoff whenever the link breaks, until the replica is
+// stopped by REPLICAOF.
 func syncWithMaster(slave *replication.SlaveRole, listeningPort uint16, context *commands.Context) {
+	delay := reconnectMinDelay
+	for {
+		if replicate(slave, listeningPort, context) {
+			delay = reconnectMinDelay
+		} else {
+			delay = min(delay*2, reconnectMaxDelay)
+		}
+		select {
+		case <-slave.Done():
+			fmt.Println("replication from master stopped")
+			return
+		case <-time.After(delay):
+		}
+		fmt.Println("reconnecting to master")
+	}
+}
+
+// replicate runs a single connection with master and reports whether the
+// handshake succeeded.
+func replicate(slave *replication.SlaveRole, listeningPort uint16, context *commands.Context) bool {
 	conn, err := replication.ConnectToMaster(slave)
 	if err != nil {
 		fmt.Printf("failed to establish connection with master: %v\n", err)
-		return
+		return false
 	}
+	defer conn.Close()
 	fmt.Printf("connection with master established. Port: %d\n", listeningPort)
-	err = conn.Handshake(listeningPort)
+	strategy := &rdbReadStrategy{}
+	resynced, err := conn.Handshake(listeningPort, strategy)
 	if err != nil {
 		fmt.Printf("handshake failed: %v\n", err)
+		return false
+	}
+	if resynced {
+		context.Reset(strategy.entries)
+		fmt.Printf("handshake with master completed, %d keys loaded. Port: %d\n", len(strategy.entries), listeningPort)
+	} else {
+		fmt.Printf("handshake with master completed, continuing replication. Port: %d\n", listeningPort)
+	}
+	conn.Connected()
+	for {
+		request, err := resp.Parse(conn.Reader())
+		if err != nil {
+			fmt.Printf("RESP parsing failed: %s\n", err)
+			return true
+		}
+		commands.HandleReplicated(request, conn, context)
 	}
-	fmt.Printf("handshake with master completed. Port: %d\n", listeningPort)
-	listenCommands(conn.Reader(), conn, context)
+}
+
+func syncWithAOF(context *commands.Context, args args.Args) error {
+	appendOnly, err := aof.Open(aof.Config{
+		Dir:               args.RdbDir,
+		DirName:           args.AppendDirName,
+		FileName:          args.AppendFileName,
+		Fsync:             args.AppendFsync,
+		LoadTruncated:     args.AofLoadTruncated,
+		UseRdbPreamble:    args.AofUseRdbPreamble,
+		RewritePercentage: args.AutoAofRewritePercentage,
+		RewriteMinSize:    args.AutoAofRewriteMinSize,
+	})
+	if err != nil {
+		return err
+	}
+	strategy := &contextReadStrategy{context: context}
+	err = appendOnly.Load(strategy, func(request resp.RespDataType) {
+		commands.Handle(request, io.Discard, context)
+	})
+	if err != nil {
+		return err
+	}
+	err = appendOnly.StartAppending()
+	if err != nil {
+		return err
+	}
+	context.AppendOnly = appendOnly
+	return nil
 }
 
 func syncWithRDB(context *commands.Context) error {
@@ -82,23 +194,38 @@ func syncWithRDB(context *commands.Context) error {
 	}
 	defer file.Close()
 	reader := bufio.NewReader(file)
-	strategy := &rdbReadStrategy{
-		context: context,
-	}
-	err = rdb.Read(reader, strategy)
+	strategy := &rdbReadStrategy{}
+	err = rdb.Read(reader, strategy, context.RdbChecksum())
 	if err != nil {
 		fmt.Println("Error reading file:", err)
 		return err
 	}
+	for _, entry := range strategy.entries {
+		context.AddEntity(entry)
+	}
 	return nil
 }
 
+// rdbReadStrategy collects entries so that nothing is loaded into the
+// context until the whole file has been read and verified.
 type rdbReadStrategy struct {
-	context *commands.Context
+	entries []rdb.DbEntry
 }
 
 func (s *rdbReadStrategy) AddDbEntry(entry rdb.DbEntry) {
-	s.context.AddEntity(entry)
+	s.entries = append(s.entries, entry)
 }
 
 func (*rdbReadStrategy) AddAux(_ string, _ resp.RespDataType) {}
+
+// contextReadStrategy adds entries to the context right away. It is used for
+// the AOF base file, where keys must be loaded before replaying commands.
+type contextReadStrategy struct {
+	context *commands.Context
+}
+
+func (s *contextReadStrategy) AddDbEntry(entry rdb.DbEntry) {
+	s.context.AddEntity(entry)
+}
+
+func (*contextReadStrategy) AddAux(_ string, _ resp.RespDataType) {}
@@ -0,0 +1,38 @@
+package stream
+
+import (
+	"slices"
+	"time"
+)
+
+type ConsumerGroup struct {
+	Name        string
+	LastID      StreamID
+	EntriesRead int64
+	Pending     []PendingEntry
+	Consumers   []Consumer
+}
+
+type PendingEntry struct {
+	ID            StreamID
+	DeliveryTime  time.Time
+	DeliveryCount uint64
+}
+
+type Consumer struct {
+	Name       string
+	SeenTime   time.Time
+	ActiveTime time.Time
+	Pending    []StreamID
+}
+
+func (g *ConsumerGroup) clone() *ConsumerGroup {
+	clone := *g
+	clone.Pending = slices.Clone(g.Pending)
+	clone.Consumers = make([]Consumer, 0, len(g.Consumers))
+	for _, consumer := range g.Consumers {
+		consumer.Pending = slices.Clone(consumer.Pending)
+		clone.Consumers = append(clone.Consumers, consumer)
+	}
+	return &clone
+}
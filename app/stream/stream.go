@@ -31,9 +31,25 @@ type node struct {
 }
 
 type Stream struct {
-	root   node
-	lastID StreamID
-	len    uint64
+	root         node
+	lastID       StreamID
+	len          uint64
+	entriesAdded uint64
+	maxDeletedID StreamID
+	groups       []*ConsumerGroup
+}
+
+type Entry struct {
+	ID      StreamID
+	Payload []Pair
+}
+
+type Metadata struct {
+	Length       uint64
+	LastID       StreamID
+	FirstID      StreamID
+	MaxDeletedID StreamID
+	EntriesAdded uint64
 }
 
 type RangeMatch struct {
@@ -61,7 +77,23 @@ func New(id string, payload []Pair) (*Stream, error) {
 	root := node{
 		edges: []*node{&n},
 	}
-	return &Stream{root: root, lastID: StreamID, len: 1}, nil
+	return &Stream{root: root, lastID: StreamID, len: 1, entriesAdded: 1}, nil
+}
+
+// Restore rebuilds a stream from persisted entries, keeping the stored
+// metadata as is instead of deriving it from the entries.
+func Restore(entries []Entry, metadata Metadata, groups []*ConsumerGroup) *Stream {
+	s := &Stream{
+		lastID:       metadata.LastID,
+		len:          uint64(len(entries)),
+		entriesAdded: metadata.EntriesAdded,
+		maxDeletedID: metadata.MaxDeletedID,
+		groups:       groups,
+	}
+	for _, e := range entries {
+		s.root.insert([]byte(e.ID.String()), e.ID, e.Payload)
+	}
+	return s
 }
 
 func Block(duration time.Duration, incoming <-chan BlockingXReadPayload) *BlockingXReadPayload {
@@ -96,6 +128,8 @@ func (s *Stream) Insert(id string, payload []Pair) (string, error) {
 	}
 	id = StreamID.String()
 	s.lastID = StreamID
+	s.len += 1
+	s.entriesAdded += 1
 	s.root.insert([]byte(id), StreamID, payload)
 	return StreamID.String(), nil
 }
@@ -261,6 +295,75 @@ func (s *Stream) LastID() string {
 	return s.lastID.String()
 }
 
+// Entries returns every entry of the stream ordered by ID.
+func (s *Stream) Entries() []Entry {
+	entries := make([]Entry, 0, s.len)
+	s.root.collect(&entries)
+	slices.SortFunc(entries, func(a, b Entry) int {
+		return a.ID.Cmp(&b.ID)
+	})
+	return entries
+}
+
+func (s *Stream) Metadata() Metadata {
+	metadata := Metadata{
+		Length:       s.len,
+		LastID:       s.lastID,
+		MaxDeletedID: s.maxDeletedID,
+		EntriesAdded: s.entriesAdded,
+	}
+	entries := s.Entries()
+	if len(entries) > 0 {
+		metadata.FirstID = entries[0].ID
+	}
+	return metadata
+}
+
+func (s *Stream) Groups() []*ConsumerGroup {
+	return s.groups
+}
+
+// Clone returns a deep copy that is not affected by later inserts.
+func (s *Stream) Clone() *Stream {
+	groups := make([]*ConsumerGroup, 0, len(s.groups))
+	for _, group := range s.groups {
+		groups = append(groups, group.clone())
+	}
+	return Restore(s.Entries(), s.Metadata(), groups)
+}
+
+// SetLastID implements XSETID. Optional arguments are left untouched when nil.
+func (s *Stream) SetLastID(id StreamID, entriesAdded *uint64, maxDeletedID *StreamID) error {
+	entries := s.Entries()
+	if len(entries) > 0 && id.Cmp(&entries[len(entries)-1].ID) < 0 {
+		return fmt.Errorf("ERR The ID specified in XSETID is smaller than the target stream top item")
+	}
+	if entriesAdded != nil && *entriesAdded < s.len {
+		return fmt.Errorf("ERR The entries_added specified in XSETID is smaller than the target stream length")
+	}
+	if maxDeletedID != nil && id.Cmp(maxDeletedID) < 0 {
+		return fmt.Errorf("ERR The ID specified in XSETID is smaller than the provided max_deleted_entry_id")
+	}
+	s.lastID = id
+	if entriesAdded != nil {
+		s.entriesAdded = *entriesAdded
+	}
+	if maxDeletedID != nil {
+		s.maxDeletedID = *maxDeletedID
+	}
+	return nil
+}
+
+func (n *node) collect(entries *[]Entry) {
+	if n.leaf != nil {
+		*entries = append(*entries, Entry{ID: n.leaf.id, Payload: n.leaf.payload})
+		return
+	}
+	for _, edge := range n.edges {
+		edge.collect(entries)
+	}
+}
+
 func (n *node) child(prefix byte) (int, *node) {
 	for i, edge := range n.edges {
 		if edge.prefix[0] == prefix {
@@ -299,6 +402,9 @@ func ParseID(id string, lastID StreamID) (StreamID, error) {
 	if err != nil {
 		return StreamID{}, err
 	}
+	if len(parts) == 1 {
+		return StreamID{ms: ms, sequence: 0}, nil
+	}
 	if parts[1] == "*" {
 		if lastID.ms == ms {
 			return StreamID{ms: ms, sequence: lastID.sequence + 1}, nil
@@ -313,6 +419,18 @@ func ParseID(id string, lastID StreamID) (StreamID, error) {
 	return StreamID{ms: ms, sequence: seq}, nil
 }
 
+func NewID(ms uint64, sequence uint64) StreamID {
+	return StreamID{ms: ms, sequence: sequence}
+}
+
+func (id StreamID) Ms() uint64 {
+	return id.ms
+}
+
+func (id StreamID) Sequence() uint64 {
+	return id.sequence
+}
+
 func (id StreamID) String() string {
 	return fmt.Sprintf("%d-%d", id.ms, id.sequence)
 }
@@ -0,0 +1,154 @@
+// rdbtool inspects RDB snapshots offline.
+//
+//	rdbtool validate dump.rdb
+//	rdbtool stats dump.rdb
+//	rdbtool bigkeys -n 20 dump.rdb
+//	rdbtool export -format json dump.rdb
+//	rdbtool export -format resp dump.rdb | nc localhost 6379
+//
+// The JSON export writes one object per key, with stream entries, consumer
+// groups, their pending entries and consumers. Strings that are not valid
+// UTF-8 are written as {"base64": "..."}.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/codecrafters-io/redis-starter-go/app/rdb"
+)
+
+type subcommand func(args []string) error
+
+var subcommands = map[string]subcommand{
+	"validate": validate,
+	"stats":    stats,
+	"bigkeys":  bigkeys,
+	"export":   export,
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	run, ok := subcommands[os.Args[1]]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+	err := run(os.Args[2:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "rdbtool %s: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: rdbtool <validate|stats|bigkeys|export> [flags] <file.rdb>")
+}
+
+func parseFlags(set *flag.FlagSet, args []string) (string, error) {
+	err := set.Parse(args)
+	if err != nil {
+		return "", err
+	}
+	if set.NArg() != 1 {
+		return "", fmt.Errorf("exactly one RDB file expected")
+	}
+	return set.Arg(0), nil
+}
+
+// readFile decodes the file with the strategy.
+func readFile(path string, strategy rdb.ReadStrategy) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return rdb.Read(bufio.NewReader(file), strategy, true)
+}
+
+func validate(args []string) error {
+	set := flag.NewFlagSet("validate", flag.ExitOnError)
+	path, err := parseFlags(set, args)
+	if err != nil {
+		return err
+	}
+	collector := &statsCollector{}
+	err = readFile(path, collector)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("OK: %d keys, %d aux fields\n", collector.keys, len(collector.aux))
+	return nil
+}
+
+func stats(args []string) error {
+	set := flag.NewFlagSet("stats", flag.ExitOnError)
+	path, err := parseFlags(set, args)
+	if err != nil {
+		return err
+	}
+	collector := &statsCollector{}
+	err = readFile(path, collector)
+	if err != nil {
+		return err
+	}
+	collector.print(os.Stdout)
+	return nil
+}
+
+func bigkeys(args []string) error {
+	set := flag.NewFlagSet("bigkeys", flag.ExitOnError)
+	count := set.Int("n", 10, "number of keys to list")
+	path, err := parseFlags(set, args)
+	if err != nil {
+		return err
+	}
+	if *count < 1 {
+		fmt.Fprintf(os.Stderr, "invalid value %d for flag -n: must be at least 1\n", *count)
+		set.Usage()
+		os.Exit(2)
+	}
+	collector := &bigKeysCollector{limit: *count}
+	err = readFile(path, collector)
+	if err != nil {
+		return err
+	}
+	collector.print(os.Stdout)
+	return nil
+}
+
+func export(args []string) error {
+	set := flag.NewFlagSet("export", flag.ExitOnError)
+	format := set.String("format", "json", "output format: json or resp")
+	path, err := parseFlags(set, args)
+	if err != nil {
+		return err
+	}
+	output := bufio.NewWriter(os.Stdout)
+	var exporter interface {
+		rdb.ReadStrategy
+		err() error
+	}
+	switch *format {
+	case "json":
+		exporter = &jsonExporter{output: output}
+	case "resp":
+		exporter = &respExporter{output: output}
+	default:
+		return fmt.Errorf("unknown format: %v", *format)
+	}
+	err = readFile(path, exporter)
+	if err == nil {
+		err = exporter.err()
+	}
+	flushErr := output.Flush()
+	if err != nil {
+		return err
+	}
+	return flushErr
+}
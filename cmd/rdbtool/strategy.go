@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"unicode/utf8"
+
+	"github.com/codecrafters-io/redis-starter-go/app/aof"
+	"github.com/codecrafters-io/redis-starter-go/app/rdb"
+	"github.com/codecrafters-io/redis-starter-go/app/resp"
+	"github.com/codecrafters-io/redis-starter-go/app/stream"
+)
+
+func entryType(entry rdb.DbEntry) string {
+	switch entry.Value.(type) {
+	case *stream.Stream:
+		return "stream"
+	default:
+		return "string"
+	}
+}
+
+// entrySize approximates the memory used by the entry as the length of the
+// key plus the length of every string stored in the value.
+func entrySize(entry rdb.DbEntry) int {
+	size := len(entry.Key)
+	switch value := entry.Value.(type) {
+	case *stream.Stream:
+		for _, e := range value.Entries() {
+			size += len(e.ID.String())
+			for _, pair := range e.Payload {
+				size += len(pair.Field) + len(pair.Value)
+			}
+		}
+	case resp.RespDataType:
+		size += len(resp.String(value))
+	}
+	return size
+}
+
+type statsCollector struct {
+	keys       int
+	expires    int
+	aux        map[string]string
+	types      map[string]int
+	histograms map[string]map[int]int
+}
+
+func (c *statsCollector) AddAux(key string, value resp.RespDataType) {
+	if c.aux == nil {
+		c.aux = make(map[string]string)
+	}
+	c.aux[key] = resp.String(value)
+}
+
+func (c *statsCollector) AddDbEntry(entry rdb.DbEntry) {
+	if c.types == nil {
+		c.types = make(map[string]int)
+		c.histograms = make(map[string]map[int]int)
+	}
+	c.keys += 1
+	if !entry.ExpireAt.IsZero() {
+		c.expires += 1
+	}
+	t := entryType(entry)
+	c.types[t] += 1
+	histogram, ok := c.histograms[t]
+	if !ok {
+		histogram = make(map[int]int)
+		c.histograms[t] = histogram
+	}
+	bucket := 1
+	for size := entrySize(entry); bucket < size; bucket <<= 1 {
+	}
+	histogram[bucket] += 1
+}
+
+func (c *statsCollector) print(w io.Writer) {
+	for _, key := range sortedKeys(c.aux) {
+		fmt.Fprintf(w, "aux %s: %s\n", key, c.aux[key])
+	}
+	fmt.Fprintf(w, "keys: %d\nkeys with expiration: %d\n", c.keys, c.expires)
+	for _, t := range sortedKeys(c.types) {
+		fmt.Fprintf(w, "\n%s keys: %d\n", t, c.types[t])
+		histogram := c.histograms[t]
+		for _, bucket := range sortedKeys(histogram) {
+			fmt.Fprintf(w, "  <= %10d bytes: %d\n", bucket, histogram[bucket])
+		}
+	}
+}
+
+type bigKey struct {
+	key  string
+	kind string
+	size int
+}
+
+type bigKeysCollector struct {
+	limit int
+	keys  []bigKey
+}
+
+func (*bigKeysCollector) AddAux(_ string, _ resp.RespDataType) {}
+
+func (c *bigKeysCollector) AddDbEntry(entry rdb.DbEntry) {
+	key := bigKey{key: string(entry.Key), kind: entryType(entry), size: entrySize(entry)}
+	index, _ := slices.BinarySearchFunc(c.keys, key, func(a, b bigKey) int {
+		return b.size - a.size
+	})
+	c.keys = slices.Insert(c.keys, index, key)
+	if len(c.keys) > c.limit {
+		c.keys = c.keys[:c.limit]
+	}
+}
+
+func (c *bigKeysCollector) print(w io.Writer) {
+	for _, key := range c.keys {
+		fmt.Fprintf(w, "%10d bytes  %-6s  %q\n", key.size, key.kind, key.key)
+	}
+}
+
+type jsonEntry struct {
+	Key          jsonString       `json:"key"`
+	Type         string           `json:"type"`
+	ExpireAt     *int64           `json:"expire_at,omitempty"`
+	Value        *jsonString      `json:"value,omitempty"`
+	Entries      []jsonEntryItem  `json:"entries,omitempty"`
+	LastID       string           `json:"last_id,omitempty"`
+	EntriesAdded *uint64          `json:"entries_added,omitempty"`
+	MaxDeletedID string           `json:"max_deleted_id,omitempty"`
+	Groups       []jsonGroupEntry `json:"groups,omitempty"`
+}
+
+type jsonEntryItem struct {
+	ID     string          `json:"id"`
+	Fields [][2]jsonString `json:"fields"`
+}
+
+type jsonGroupEntry struct {
+	Name        jsonString         `json:"name"`
+	LastID      string             `json:"last_id"`
+	EntriesRead int64              `json:"entries_read"`
+	Pending     []jsonPendingEntry `json:"pending"`
+	Consumers   []jsonConsumer     `json:"consumers"`
+}
+
+type jsonPendingEntry struct {
+	ID            string `json:"id"`
+	DeliveryTime  int64  `json:"delivery_time"`
+	DeliveryCount uint64 `json:"delivery_count"`
+}
+
+type jsonConsumer struct {
+	Name       jsonString `json:"name"`
+	SeenTime   int64      `json:"seen_time"`
+	ActiveTime int64      `json:"active_time"`
+	Pending    []string   `json:"pending"`
+}
+
+// jsonString is marshaled as a JSON string when it's valid UTF-8. Other
+// bytes can't be kept by a JSON string, they're written as
+// {"base64": "..."} instead.
+type jsonString string
+
+func (s jsonString) MarshalJSON() ([]byte, error) {
+	if utf8.ValidString(string(s)) {
+		return json.Marshal(string(s))
+	}
+	return json.Marshal(map[string]string{"base64": base64.StdEncoding.EncodeToString([]byte(s))})
+}
+
+type jsonExporter struct {
+	output   *bufio.Writer
+	writeErr error
+}
+
+func (*jsonExporter) AddAux(_ string, _ resp.RespDataType) {}
+
+func (e *jsonExporter) AddDbEntry(entry rdb.DbEntry) {
+	if e.writeErr != nil {
+		return
+	}
+	out := jsonEntry{Key: jsonString(entry.Key), Type: entryType(entry)}
+	if !entry.ExpireAt.IsZero() {
+		ms := entry.ExpireAt.UnixMilli()
+		out.ExpireAt = &ms
+	}
+	switch value := entry.Value.(type) {
+	case *stream.Stream:
+		for _, item := range value.Entries() {
+			fields := make([][2]jsonString, 0, len(item.Payload))
+			for _, pair := range item.Payload {
+				fields = append(fields, [2]jsonString{jsonString(pair.Field), jsonString(pair.Value)})
+			}
+			out.Entries = append(out.Entries, jsonEntryItem{ID: item.ID.String(), Fields: fields})
+		}
+		metadata := value.Metadata()
+		out.LastID = metadata.LastID.String()
+		out.EntriesAdded = &metadata.EntriesAdded
+		out.MaxDeletedID = metadata.MaxDeletedID.String()
+		for _, group := range value.Groups() {
+			out.Groups = append(out.Groups, exportGroup(group))
+		}
+	case resp.RespDataType:
+		s := jsonString(resp.String(value))
+		out.Value = &s
+	}
+	bytes, err := json.Marshal(out)
+	if err == nil {
+		bytes = append(bytes, '\n')
+		_, err = e.output.Write(bytes)
+	}
+	e.writeErr = err
+}
+
+func exportGroup(group *stream.ConsumerGroup) jsonGroupEntry {
+	out := jsonGroupEntry{
+		Name:        jsonString(group.Name),
+		LastID:      group.LastID.String(),
+		EntriesRead: group.EntriesRead,
+		Pending:     make([]jsonPendingEntry, 0, len(group.Pending)),
+		Consumers:   make([]jsonConsumer, 0, len(group.Consumers)),
+	}
+	for _, pending := range group.Pending {
+		out.Pending = append(out.Pending, jsonPendingEntry{
+			ID:            pending.ID.String(),
+			DeliveryTime:  pending.DeliveryTime.UnixMilli(),
+			DeliveryCount: pending.DeliveryCount,
+		})
+	}
+	for _, consumer := range group.Consumers {
+		ids := make([]string, 0, len(consumer.Pending))
+		for _, id := range consumer.Pending {
+			ids = append(ids, id.String())
+		}
+		out.Consumers = append(out.Consumers, jsonConsumer{
+			Name:       jsonString(consumer.Name),
+			SeenTime:   consumer.SeenTime.UnixMilli(),
+			ActiveTime: consumer.ActiveTime.UnixMilli(),
+			Pending:    ids,
+		})
+	}
+	return out
+}
+
+func (e *jsonExporter) err() error {
+	return e.writeErr
+}
+
+// respExporter writes the commands an AOF rewrite would emit, so the
+// output can be piped into a running server.
+type respExporter struct {
+	output   *bufio.Writer
+	writeErr error
+}
+
+func (*respExporter) AddAux(_ string, _ resp.RespDataType) {}
+
+func (e *respExporter) AddDbEntry(entry rdb.DbEntry) {
+	if e.writeErr != nil {
+		return
+	}
+	commands, err := aof.RewriteCommands(entry)
+	if err != nil {
+		e.writeErr = err
+		return
+	}
+	for _, command := range commands {
+		if e.writeErr != nil {
+			return
+		}
+		_, e.writeErr = e.output.Write(command.Bytes())
+	}
+}
+
+func (e *respExporter) err() error {
+	return e.writeErr
+}
+
+func sortedKeys[K cmp.Ordered, V any](m map[K]V) []K {
+	keys := make([]K, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
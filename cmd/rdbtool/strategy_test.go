@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/app/rdb"
+	"github.com/codecrafters-io/redis-starter-go/app/resp"
+	"github.com/codecrafters-io/redis-starter-go/app/stream"
+)
+
+func exportJSON(t *testing.T, entry rdb.DbEntry) map[string]any {
+	t.Helper()
+	var buf bytes.Buffer
+	output := bufio.NewWriter(&buf)
+	exporter := &jsonExporter{output: output}
+	exporter.AddDbEntry(entry)
+	if err := exporter.err(); err != nil {
+		t.Fatal(err)
+	}
+	output.Flush()
+	var decoded map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatalf("invalid JSON %q: %v", buf.String(), err)
+	}
+	return decoded
+}
+
+func TestJSONExportBinarySafe(t *testing.T) {
+	tests := []struct {
+		name      string
+		key       string
+		value     string
+		wantKey   any
+		wantValue any
+	}{
+		{"utf-8", "clé", "välue\r\n", "clé", "välue\r\n"},
+		{"nul bytes", "k\x00", "\x00", "k\x00", "\x00"},
+		{"invalid utf-8", "\xff", "a\xc3\x28", map[string]any{"base64": "/w=="}, map[string]any{"base64": "YcMo"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := exportJSON(t, rdb.DbEntry{Key: resp.BulkString(test.key), Value: resp.BulkString(test.value)})
+			if !reflect.DeepEqual(got["key"], test.wantKey) {
+				t.Errorf("key = %#v, want %#v", got["key"], test.wantKey)
+			}
+			if !reflect.DeepEqual(got["value"], test.wantValue) {
+				t.Errorf("value = %#v, want %#v", got["value"], test.wantValue)
+			}
+		})
+	}
+}
+
+func TestJSONExportGroups(t *testing.T) {
+	delivered := time.UnixMilli(1700000000000)
+	id := stream.NewID(1, 0)
+	s := stream.Restore(
+		[]stream.Entry{{ID: id, Payload: []stream.Pair{{Field: "f", Value: "\xff"}}}},
+		stream.Metadata{Length: 1, LastID: id, EntriesAdded: 1},
+		[]*stream.ConsumerGroup{{
+			Name:        "g",
+			LastID:      id,
+			EntriesRead: 1,
+			Pending:     []stream.PendingEntry{{ID: id, DeliveryTime: delivered, DeliveryCount: 3}},
+			Consumers: []stream.Consumer{
+				{Name: "c", SeenTime: delivered, ActiveTime: delivered.Add(time.Second), Pending: []stream.StreamID{id}},
+			},
+		}},
+	)
+	got := exportJSON(t, rdb.DbEntry{Key: "s", Value: s})
+	wantEntries := []any{map[string]any{
+		"id":     "1-0",
+		"fields": []any{[]any{"f", map[string]any{"base64": "/w=="}}},
+	}}
+	if !reflect.DeepEqual(got["entries"], wantEntries) {
+		t.Errorf("entries = %#v, want %#v", got["entries"], wantEntries)
+	}
+	wantGroups := []any{map[string]any{
+		"name":         "g",
+		"last_id":      "1-0",
+		"entries_read": float64(1),
+		"pending": []any{map[string]any{
+			"id":             "1-0",
+			"delivery_time":  float64(1700000000000),
+			"delivery_count": float64(3),
+		}},
+		"consumers": []any{map[string]any{
+			"name":        "c",
+			"seen_time":   float64(1700000000000),
+			"active_time": float64(1700000001000),
+			"pending":     []any{"1-0"},
+		}},
+	}}
+	if !reflect.DeepEqual(got["groups"], wantGroups) {
+		t.Errorf("groups = %#v, want %#v", got["groups"], wantGroups)
+	}
+}